@@ -48,9 +48,13 @@ func main() {
 	}
 	defer node2.Stop()
 
-	// Set payloads.
-	node1.SetPayload("node1")
-	node2.SetPayload("node2")
+	// Set tags.
+	if err := node1.SetTags(map[string]string{"name": "node1", "role": "api"}); err != nil {
+		log.Fatal(err)
+	}
+	if err := node2.SetTags(map[string]string{"name": "node2", "role": "worker"}); err != nil {
+		log.Fatal(err)
+	}
 
 	// Start the gossipers.
 	node1.Start()
@@ -62,11 +66,11 @@ func main() {
 	// Print the membership lists.
 	fmt.Println("Node 1 members:")
 	for _, member := range node1.Members() {
-		fmt.Printf("- %s, payload: %s\n", member.Addr, string(member.Payload))
+		fmt.Printf("- %s, tags: %v\n", member.Addr, member.Tags)
 	}
 
 	fmt.Println("Node 2 members:")
 	for _, member := range node2.Members() {
-		fmt.Printf("- %s, payload: %s\n", member.Addr, string(member.Payload))
+		fmt.Printf("- %s, tags: %v\n", member.Addr, member.Tags)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,60 @@
+// Package testutil holds the helpers shared by the tests of the packages
+// built on the gossip layer. The gossip package's own tests cannot import it,
+// as it imports gossip, and keep their own copy of WaitFor.
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// WaitFor polls cond every 10ms until it holds, and fails the test if it does
+// not within timeout.
+func WaitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Cluster creates a gossiper over UDP on each of addrs, named by its address,
+// with the addresses before it as seeds and the options opts returns for its
+// index. The gossipers are not started, so that whatever their handlers call
+// into can be set up first. They and their transports are stopped when the
+// test ends.
+func Cluster(t testing.TB, addrs []string, opts func(i int) []gossip.Option) []*gossip.Gossiper {
+	t.Helper()
+	var gossipers []*gossip.Gossiper
+	for i, addr := range addrs {
+		tr, err := gossip.NewUDPTransport(addr)
+		if err != nil {
+			t.Fatalf("failed to create transport: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+
+		var o []gossip.Option
+		if opts != nil {
+			o = opts(i)
+		}
+		g, err := gossip.NewGossiper(addr, addr, addrs[:i], tr, o...)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		t.Cleanup(g.Stop)
+		gossipers = append(gossipers, g)
+	}
+	return gossipers
+}
+
+// Start starts gossipers.
+func Start(gossipers []*gossip.Gossiper) {
+	for _, g := range gossipers {
+		g.Start()
+	}
+}
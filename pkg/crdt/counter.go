@@ -0,0 +1,250 @@
+package crdt
+
+import (
+	"sort"
+	"sync"
+)
+
+// GCounter is a grow-only counter. Each node increments its own count, and
+// the value is the sum of the counts of every node.
+type GCounter struct {
+	node string
+	emit func(CRDT)
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// NewGCounter creates a zero counter that node increments.
+func NewGCounter(node string) *GCounter {
+	return &GCounter{node: node, counts: make(map[string]uint64)}
+}
+
+// Type implements CRDT.
+func (c *GCounter) Type() Type {
+	return TypeGCounter
+}
+
+// Inc adds n to the counter.
+func (c *GCounter) Inc(n uint64) {
+	c.mu.Lock()
+	c.counts[c.node] += n
+	delta := &GCounter{counts: map[string]uint64{c.node: c.counts[c.node]}}
+	c.mu.Unlock()
+	if c.emit != nil {
+		c.emit(delta)
+	}
+}
+
+// Value returns the sum of the counts of every node.
+func (c *GCounter) Value() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum uint64
+	for _, n := range c.counts {
+		sum += n
+	}
+	return sum
+}
+
+// Merge implements CRDT. It keeps the highest count seen for each node.
+func (c *GCounter) Merge(other CRDT) (bool, error) {
+	o, ok := other.(*GCounter)
+	if !ok {
+		return false, mismatch(TypeGCounter, other)
+	}
+	counts := o.snapshot()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return mergeCounts(c.counts, counts), nil
+}
+
+func (c *GCounter) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for node, n := range c.counts {
+		counts[node] = n
+	}
+	return counts
+}
+
+// MarshalBinary implements CRDT.
+func (c *GCounter) MarshalBinary() ([]byte, error) {
+	e := encodeHeader(TypeGCounter)
+	c.mu.Lock()
+	encodeCounts(e, c.counts)
+	c.mu.Unlock()
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements CRDT.
+func (c *GCounter) UnmarshalBinary(data []byte) error {
+	d, err := decodeHeader(TypeGCounter, data)
+	if err != nil {
+		return err
+	}
+	counts := decodeCounts(d)
+	if d.err != nil {
+		return d.err
+	}
+	c.mu.Lock()
+	c.counts = counts
+	c.mu.Unlock()
+	return nil
+}
+
+// mergeCounts raises the counts in dst to those in src and reports whether
+// any changed.
+func mergeCounts(dst, src map[string]uint64) bool {
+	changed := false
+	for node, n := range src {
+		if n > dst[node] {
+			dst[node] = n
+			changed = true
+		}
+	}
+	return changed
+}
+
+// encodeCounts writes per-node counts, sorted by node. Zero counts are left
+// out, so that equal states have equal encodings.
+func encodeCounts(e *encoder, counts map[string]uint64) {
+	nodes := make([]string, 0, len(counts))
+	for node, n := range counts {
+		if n > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	e.uvarint(uint64(len(nodes)))
+	for _, node := range nodes {
+		e.string(node)
+		e.uvarint(counts[node])
+	}
+}
+
+func decodeCounts(d *decoder) map[string]uint64 {
+	n := d.count(2)
+	counts := make(map[string]uint64, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		node := d.string()
+		counts[node] = d.uvarint()
+	}
+	return counts
+}
+
+// PNCounter is a counter that can be incremented and decremented. It pairs
+// a grow-only count of increments with one of decrements.
+type PNCounter struct {
+	node string
+	emit func(CRDT)
+
+	mu  sync.Mutex
+	inc map[string]uint64
+	dec map[string]uint64
+}
+
+// NewPNCounter creates a zero counter that node updates.
+func NewPNCounter(node string) *PNCounter {
+	return &PNCounter{node: node, inc: make(map[string]uint64), dec: make(map[string]uint64)}
+}
+
+// Type implements CRDT.
+func (c *PNCounter) Type() Type {
+	return TypePNCounter
+}
+
+// Inc adds n to the counter.
+func (c *PNCounter) Inc(n uint64) {
+	c.update(c.inc, n)
+}
+
+// Dec subtracts n from the counter.
+func (c *PNCounter) Dec(n uint64) {
+	c.update(c.dec, n)
+}
+
+func (c *PNCounter) update(counts map[string]uint64, n uint64) {
+	c.mu.Lock()
+	counts[c.node] += n
+	delta := &PNCounter{
+		inc: map[string]uint64{c.node: c.inc[c.node]},
+		dec: map[string]uint64{c.node: c.dec[c.node]},
+	}
+	c.mu.Unlock()
+	if c.emit != nil {
+		c.emit(delta)
+	}
+}
+
+// Value returns the increments of every node minus their decrements.
+func (c *PNCounter) Value() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum int64
+	for _, n := range c.inc {
+		sum += int64(n)
+	}
+	for _, n := range c.dec {
+		sum -= int64(n)
+	}
+	return sum
+}
+
+// Merge implements CRDT.
+func (c *PNCounter) Merge(other CRDT) (bool, error) {
+	o, ok := other.(*PNCounter)
+	if !ok {
+		return false, mismatch(TypePNCounter, other)
+	}
+	inc, dec := o.snapshot()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := mergeCounts(c.inc, inc)
+	if mergeCounts(c.dec, dec) {
+		changed = true
+	}
+	return changed, nil
+}
+
+func (c *PNCounter) snapshot() (inc, dec map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inc = make(map[string]uint64, len(c.inc))
+	for node, n := range c.inc {
+		inc[node] = n
+	}
+	dec = make(map[string]uint64, len(c.dec))
+	for node, n := range c.dec {
+		dec[node] = n
+	}
+	return inc, dec
+}
+
+// MarshalBinary implements CRDT.
+func (c *PNCounter) MarshalBinary() ([]byte, error) {
+	e := encodeHeader(TypePNCounter)
+	c.mu.Lock()
+	encodeCounts(e, c.inc)
+	encodeCounts(e, c.dec)
+	c.mu.Unlock()
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements CRDT.
+func (c *PNCounter) UnmarshalBinary(data []byte) error {
+	d, err := decodeHeader(TypePNCounter, data)
+	if err != nil {
+		return err
+	}
+	inc := decodeCounts(d)
+	dec := decodeCounts(d)
+	if d.err != nil {
+		return d.err
+	}
+	c.mu.Lock()
+	c.inc, c.dec = inc, dec
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,137 @@
+// Package crdt provides state-based conflict-free replicated data types
+// replicated over the gossip protocol.
+//
+// Every type merges concurrent updates deterministically, so replicas that
+// have seen the same updates hold the same state whatever order, and however
+// many times, the updates arrived in. A Registry replicates named instances
+// through a Gossiper: each local update is broadcast as a small delta, and
+// the full state travels in the gossiper's periodic state exchange.
+//
+// Every type has a stable binary encoding: a format version, the type and its
+// fields in a fixed order. Decoders ignore data after the fields they know, so
+// later versions may append fields and replicas of different versions can be
+// mixed during an upgrade.
+package crdt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Type identifies a CRDT type in its binary encoding. The values are part of
+// the encoding and must never change.
+type Type byte
+
+const (
+	TypeGCounter  Type = 1
+	TypePNCounter Type = 2
+	TypeORSet     Type = 3
+	TypeLWWMap    Type = 4
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeGCounter:
+		return "GCounter"
+	case TypePNCounter:
+		return "PNCounter"
+	case TypeORSet:
+		return "ORSet"
+	case TypeLWWMap:
+		return "LWWMap"
+	default:
+		return fmt.Sprintf("Type(%d)", byte(t))
+	}
+}
+
+// formatVersion is the version of the binary encoding written by this
+// package. Decoders accept every version up to it.
+const formatVersion = 1
+
+// ErrTypeMismatch is returned when merging CRDTs of different types, or when
+// a name is used for instances of different types.
+var ErrTypeMismatch = errors.New("crdt: type mismatch")
+
+// ErrUnsupportedVersion is returned when decoding an encoding written by a
+// newer, incompatible version of the format.
+var ErrUnsupportedVersion = errors.New("crdt: unsupported encoding version")
+
+// ErrUnknownType is returned when decoding an encoding of an unknown type.
+var ErrUnknownType = errors.New("crdt: unknown type")
+
+// CRDT is a state-based replicated data type. Implementations are safe for
+// concurrent use.
+type CRDT interface {
+	// Type returns the type of the CRDT.
+	Type() Type
+	// Merge merges the state of other, which must be of the same type, and
+	// reports whether the state changed. Merging is commutative,
+	// associative and idempotent.
+	Merge(other CRDT) (bool, error)
+	// MarshalBinary returns the stable binary encoding of the state.
+	MarshalBinary() ([]byte, error)
+	// UnmarshalBinary replaces the state with the one encoded in data.
+	UnmarshalBinary(data []byte) error
+}
+
+// newCRDT returns an empty instance of type t owned by node.
+func newCRDT(t Type, node string) (CRDT, error) {
+	switch t {
+	case TypeGCounter:
+		return NewGCounter(node), nil
+	case TypePNCounter:
+		return NewPNCounter(node), nil
+	case TypeORSet:
+		return NewORSet(node), nil
+	case TypeLWWMap:
+		return NewLWWMap(node), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, byte(t))
+	}
+}
+
+// Decode returns the CRDT encoded in data, of whichever type it is. The
+// instance is owned by node for any further local updates.
+func Decode(node string, data []byte) (CRDT, error) {
+	if len(data) < 2 {
+		return nil, errTruncated
+	}
+	c, err := newCRDT(Type(data[1]), node)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// encodeHeader starts the encoding of a CRDT of type t.
+func encodeHeader(t Type) *encoder {
+	e := &encoder{}
+	e.byte(formatVersion)
+	e.byte(byte(t))
+	return e
+}
+
+// decodeHeader checks the header of an encoding of type t and returns a
+// decoder positioned at its fields.
+func decodeHeader(t Type, data []byte) (*decoder, error) {
+	d := &decoder{buf: data}
+	version, typ := d.byte(), Type(d.byte())
+	if d.err != nil {
+		return nil, d.err
+	}
+	if version == 0 || version > formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if typ != t {
+		return nil, fmt.Errorf("%w: encoding of %v, want %v", ErrTypeMismatch, typ, t)
+	}
+	return d, nil
+}
+
+// mismatch returns the error for merging other into a CRDT of type t.
+func mismatch(t Type, other CRDT) error {
+	return fmt.Errorf("%w: cannot merge %v into %v", ErrTypeMismatch, other.Type(), t)
+}
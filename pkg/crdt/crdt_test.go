@@ -0,0 +1,251 @@
+package crdt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// generators build random replica states of each type: a few nodes applying
+// random operations and occasionally merging each other's state.
+var generators = map[Type]func(r *rand.Rand) CRDT{
+	TypeGCounter: func(r *rand.Rand) CRDT {
+		c := NewGCounter(fmt.Sprintf("node-%d", r.Intn(3)))
+		for i := r.Intn(5); i > 0; i-- {
+			c.Inc(uint64(r.Intn(10)))
+		}
+		return c
+	},
+	TypePNCounter: func(r *rand.Rand) CRDT {
+		c := NewPNCounter(fmt.Sprintf("node-%d", r.Intn(3)))
+		for i := r.Intn(5); i > 0; i-- {
+			if r.Intn(2) == 0 {
+				c.Inc(uint64(r.Intn(10)))
+			} else {
+				c.Dec(uint64(r.Intn(10)))
+			}
+		}
+		return c
+	},
+	TypeORSet: func(r *rand.Rand) CRDT {
+		s := NewORSet(fmt.Sprintf("node-%d", r.Intn(3)))
+		for i := r.Intn(8); i > 0; i-- {
+			elem := fmt.Sprintf("e%d", r.Intn(4))
+			if r.Intn(3) == 0 {
+				s.Remove(elem)
+			} else {
+				s.Add(elem)
+			}
+		}
+		return s
+	},
+	TypeLWWMap: func(r *rand.Rand) CRDT {
+		m := NewLWWMap(fmt.Sprintf("node-%d", r.Intn(3)))
+		for i := r.Intn(8); i > 0; i-- {
+			key := fmt.Sprintf("k%d", r.Intn(4))
+			if r.Intn(3) == 0 {
+				m.Delete(key)
+			} else {
+				m.Set(key, []byte(fmt.Sprintf("v%d", r.Intn(3))))
+			}
+		}
+		return m
+	},
+}
+
+// replicas returns three related random states of type t: each may have
+// merged some of the others' history, as replicas do.
+func replicas(r *rand.Rand, t Type) (a, b, c CRDT) {
+	a, b, c = generators[t](r), generators[t](r), generators[t](r)
+	if r.Intn(2) == 0 {
+		b.Merge(clone(a))
+	}
+	if r.Intn(2) == 0 {
+		c.Merge(clone(b))
+	}
+	return a, b, c
+}
+
+func clone(c CRDT) CRDT {
+	data, err := c.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	out, err := Decode("clone", data)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func encode(t *testing.T, c CRDT) []byte {
+	t.Helper()
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	return data
+}
+
+// merged returns the merge of the given states, in order, into a copy of the
+// first.
+func merged(cs ...CRDT) CRDT {
+	out := clone(cs[0])
+	for _, c := range cs[1:] {
+		if _, err := out.Merge(c); err != nil {
+			panic(err)
+		}
+	}
+	return out
+}
+
+func TestMerge_Properties(t *testing.T) {
+	for typ := range generators {
+		t.Run(typ.String(), func(t *testing.T) {
+			r := rand.New(rand.NewSource(int64(typ)))
+			for i := 0; i < 300; i++ {
+				a, b, c := replicas(r, typ)
+
+				if !bytes.Equal(encode(t, merged(a, b)), encode(t, merged(b, a))) {
+					t.Fatalf("a⊔b != b⊔a")
+				}
+				if !bytes.Equal(encode(t, merged(merged(a, b), c)), encode(t, merged(a, merged(b, c)))) {
+					t.Fatalf("(a⊔b)⊔c != a⊔(b⊔c)")
+				}
+				aa := merged(a, a)
+				if !bytes.Equal(encode(t, aa), encode(t, a)) {
+					t.Fatalf("a⊔a != a")
+				}
+				if changed, _ := aa.Merge(a); changed {
+					t.Fatalf("Expected re-merging a to report no change")
+				}
+			}
+		})
+	}
+}
+
+func TestMerge_TypeMismatch(t *testing.T) {
+	if _, err := NewGCounter("a").Merge(NewPNCounter("a")); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	a, b := NewPNCounter("a"), NewPNCounter("b")
+	a.Inc(5)
+	b.Inc(3)
+	b.Dec(10)
+	a.Merge(b)
+	b.Merge(a)
+	if a.Value() != -2 || b.Value() != -2 {
+		t.Errorf("Expected both replicas at -2, got %d and %d", a.Value(), b.Value())
+	}
+
+	g1, g2 := NewGCounter("a"), NewGCounter("b")
+	g1.Inc(2)
+	g2.Inc(3)
+	g1.Merge(g2)
+	g1.Merge(g2)
+	if g1.Value() != 5 {
+		t.Errorf("Expected 5, got %d", g1.Value())
+	}
+}
+
+func TestORSet_AddWins(t *testing.T) {
+	a, b := NewORSet("a"), NewORSet("b")
+	a.Add("x")
+	b.Merge(clone(a))
+
+	// b removes the x it has seen while a adds x again concurrently.
+	b.Remove("x")
+	a.Add("x")
+	a.Merge(clone(b))
+	b.Merge(clone(a))
+	if !a.Contains("x") || !b.Contains("x") {
+		t.Errorf("Expected the concurrent add to win")
+	}
+
+	// A removal that has seen every add removes the element.
+	b.Remove("x")
+	a.Merge(clone(b))
+	if a.Contains("x") || len(a.Elements()) != 0 {
+		t.Errorf("Expected x to be removed, got %v", a.Elements())
+	}
+}
+
+func TestORSet_RestartDoesNotReuseDots(t *testing.T) {
+	a, b := NewORSet("a"), NewORSet("b")
+	a.Add("x")
+	b.Merge(clone(a))
+	b.Remove("x")
+
+	// a restarts without its state and adds x again.
+	restarted := NewORSet("a")
+	restarted.Add("x")
+	b.Merge(clone(restarted))
+	if !b.Contains("x") {
+		t.Errorf("Expected the add after the restart to survive the earlier removal")
+	}
+}
+
+func TestLWWMap(t *testing.T) {
+	a, b := NewLWWMap("a"), NewLWWMap("b")
+	a.Set("k", []byte("1"))
+	b.Merge(clone(a))
+	b.Set("k", []byte("2"))
+	a.Merge(clone(b))
+	if v, _ := a.Get("k"); string(v) != "2" {
+		t.Errorf("Expected the later write to win, got %q", v)
+	}
+	a.Delete("k")
+	b.Merge(clone(a))
+	if _, ok := b.Get("k"); ok || len(b.Keys()) != 0 {
+		t.Errorf("Expected k to be deleted, got %v", b.Keys())
+	}
+}
+
+func TestEncoding_Stable(t *testing.T) {
+	c := NewGCounter("a")
+	c.Inc(1)
+	other := NewGCounter("b")
+	other.Inc(300)
+	c.Merge(other)
+
+	// Version, type, two entries sorted by node, varint counts.
+	want := []byte{1, byte(TypeGCounter), 2, 1, 'a', 1, 1, 'b', 0xac, 0x02}
+	if got := encode(t, c); !bytes.Equal(got, want) {
+		t.Errorf("Expected the encoding %v, got %v", want, got)
+	}
+}
+
+func TestEncoding_Compatibility(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for typ, gen := range generators {
+		data := encode(t, gen(r))
+
+		// Fields appended by a later version are ignored.
+		decoded, err := Decode("x", append(append([]byte(nil), data...), 0xff, 0x01))
+		if err != nil {
+			t.Fatalf("%v: failed to decode with trailing fields: %v", typ, err)
+		}
+		if !bytes.Equal(encode(t, decoded), data) {
+			t.Errorf("%v: round trip changed the encoding", typ)
+		}
+
+		newer := append([]byte(nil), data...)
+		newer[0] = formatVersion + 1
+		if _, err := Decode("x", newer); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%v: expected ErrUnsupportedVersion, got %v", typ, err)
+		}
+		if len(data) > 3 {
+			if _, err := Decode("x", data[:len(data)-1]); err == nil {
+				t.Errorf("%v: expected an error for a truncated encoding", typ)
+			}
+		}
+	}
+	if _, err := Decode("x", []byte{1, 99}); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Expected ErrUnknownType, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package crdt
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// register is the latest write of one key of an LWWMap.
+type register struct {
+	value     []byte
+	timestamp gossip.Timestamp
+	node      string
+	deleted   bool
+}
+
+// newer reports whether r supersedes o: the newer timestamp wins, then the
+// greater node name, then a delete, then the greater value.
+func (r register) newer(o register) bool {
+	if c := r.timestamp.Compare(o.timestamp); c != 0 {
+		return c > 0
+	}
+	if c := strings.Compare(r.node, o.node); c != 0 {
+		return c > 0
+	}
+	if r.deleted != o.deleted {
+		return r.deleted
+	}
+	return bytes.Compare(r.value, o.value) > 0
+}
+
+// LWWMap is a map of last-writer-wins registers ordered by hybrid logical
+// clock timestamps. Deleted keys are kept as tombstones.
+type LWWMap struct {
+	node  string
+	emit  func(CRDT)
+	clock *gossip.HLC
+
+	mu   sync.Mutex
+	regs map[string]register
+}
+
+// NewLWWMap creates an empty map that node updates.
+func NewLWWMap(node string) *LWWMap {
+	return &LWWMap{node: node, clock: gossip.NewHLC(), regs: make(map[string]register)}
+}
+
+// Type implements CRDT.
+func (m *LWWMap) Type() Type {
+	return TypeLWWMap
+}
+
+// Set sets key to value.
+func (m *LWWMap) Set(key string, value []byte) {
+	m.write(key, register{value: append([]byte(nil), value...)})
+}
+
+// Delete removes key.
+func (m *LWWMap) Delete(key string) {
+	m.write(key, register{deleted: true})
+}
+
+// write stamps r under m.mu, so that concurrent writes of a key are stored
+// in the order of their timestamps. The emitted delta shares the map's clock,
+// as it may have later deltas merged into it.
+func (m *LWWMap) write(key string, r register) {
+	m.mu.Lock()
+	r.timestamp = m.clock.Now()
+	r.node = m.node
+	m.regs[key] = r
+	m.mu.Unlock()
+	if m.emit != nil {
+		m.emit(&LWWMap{node: m.node, clock: m.clock, regs: map[string]register{key: r}})
+	}
+}
+
+// Get returns the value of key and whether it is set.
+func (m *LWWMap) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.regs[key]
+	if !ok || r.deleted {
+		return nil, false
+	}
+	return append([]byte(nil), r.value...), true
+}
+
+// Keys returns the keys that are set, sorted.
+func (m *LWWMap) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key, r := range m.regs {
+		if !r.deleted {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Merge implements CRDT. It keeps the newest write of each key.
+func (m *LWWMap) Merge(other CRDT) (bool, error) {
+	o, ok := other.(*LWWMap)
+	if !ok {
+		return false, mismatch(TypeLWWMap, other)
+	}
+	regs := o.snapshot()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for key, r := range regs {
+		m.clock.Update(r.timestamp)
+		if cur, ok := m.regs[key]; ok && !r.newer(cur) {
+			continue
+		}
+		m.regs[key] = r
+		changed = true
+	}
+	return changed, nil
+}
+
+func (m *LWWMap) snapshot() map[string]register {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	regs := make(map[string]register, len(m.regs))
+	for key, r := range m.regs {
+		regs[key] = r
+	}
+	return regs
+}
+
+// MarshalBinary implements CRDT. Keys are sorted.
+func (m *LWWMap) MarshalBinary() ([]byte, error) {
+	e := encodeHeader(TypeLWWMap)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.regs))
+	for key := range m.regs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	e.uvarint(uint64(len(keys)))
+	for _, key := range keys {
+		r := m.regs[key]
+		e.string(key)
+		e.bytes(r.value)
+		e.varint(r.timestamp.WallTime)
+		e.uvarint(uint64(r.timestamp.Logical))
+		e.string(r.node)
+		e.bool(r.deleted)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements CRDT.
+func (m *LWWMap) UnmarshalBinary(data []byte) error {
+	d, err := decodeHeader(TypeLWWMap, data)
+	if err != nil {
+		return err
+	}
+	n := d.count(6)
+	regs := make(map[string]register, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		key := d.string()
+		var r register
+		r.value = d.bytes()
+		r.timestamp.WallTime = d.varint()
+		r.timestamp.Logical = uint32(d.uvarint())
+		r.node = d.string()
+		r.deleted = d.bool()
+		regs[key] = r
+		m.clock.Update(r.timestamp)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	m.mu.Lock()
+	m.regs = regs
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,219 @@
+package crdt
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// dot identifies one addition: the node that made it and that node's
+// sequence number for it.
+type dot struct {
+	node string
+	seq  uint64
+}
+
+// ORSet is an observed-remove set of strings with add-wins semantics. Every
+// addition is tagged with a unique dot, and a removal only removes the dots it
+// has observed, so an addition concurrent with a removal survives. Removed
+// dots are kept as tombstones.
+type ORSet struct {
+	node string
+	emit func(CRDT)
+
+	mu sync.Mutex
+	// elems maps each element to its dots and whether each was removed.
+	elems map[string]map[dot]bool
+	// seq is the highest sequence number of the local node's dots.
+	seq uint64
+}
+
+// NewORSet creates an empty set that node updates. Sequence numbers start at
+// the current wall time, so that a node restarted without its state does not
+// reuse the dots of its earlier additions, which may have been removed.
+func NewORSet(node string) *ORSet {
+	return &ORSet{
+		node:  node,
+		elems: make(map[string]map[dot]bool),
+		seq:   uint64(time.Now().UnixNano()),
+	}
+}
+
+// Type implements CRDT.
+func (s *ORSet) Type() Type {
+	return TypeORSet
+}
+
+// Add adds elem to the set.
+func (s *ORSet) Add(elem string) {
+	s.mu.Lock()
+	s.seq++
+	d := dot{node: s.node, seq: s.seq}
+	if s.elems[elem] == nil {
+		s.elems[elem] = make(map[dot]bool)
+	}
+	s.elems[elem][d] = false
+	delta := &ORSet{elems: map[string]map[dot]bool{elem: {d: false}}}
+	s.mu.Unlock()
+	if s.emit != nil {
+		s.emit(delta)
+	}
+}
+
+// Remove removes elem from the set, as far as the additions observed so far
+// are concerned.
+func (s *ORSet) Remove(elem string) {
+	s.mu.Lock()
+	removed := make(map[dot]bool)
+	for d := range s.elems[elem] {
+		s.elems[elem][d] = true
+		removed[d] = true
+	}
+	s.mu.Unlock()
+	if len(removed) > 0 && s.emit != nil {
+		s.emit(&ORSet{elems: map[string]map[dot]bool{elem: removed}})
+	}
+}
+
+// Contains reports whether elem is in the set.
+func (s *ORSet) Contains(elem string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return live(s.elems[elem])
+}
+
+// Elements returns the elements of the set, sorted.
+func (s *ORSet) Elements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var elems []string
+	for elem, dots := range s.elems {
+		if live(dots) {
+			elems = append(elems, elem)
+		}
+	}
+	sort.Strings(elems)
+	return elems
+}
+
+// live reports whether any of dots has not been removed.
+func live(dots map[dot]bool) bool {
+	for _, removed := range dots {
+		if !removed {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge implements CRDT. It takes the union of the dots, and a dot removed on
+// either side stays removed.
+func (s *ORSet) Merge(other CRDT) (bool, error) {
+	o, ok := other.(*ORSet)
+	if !ok {
+		return false, mismatch(TypeORSet, other)
+	}
+	elems := o.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for elem, dots := range elems {
+		if s.elems[elem] == nil {
+			s.elems[elem] = make(map[dot]bool, len(dots))
+		}
+		for d, removed := range dots {
+			cur, ok := s.elems[elem][d]
+			if ok && (cur || !removed) {
+				continue
+			}
+			s.elems[elem][d] = removed
+			changed = true
+			if d.node == s.node && d.seq > s.seq {
+				s.seq = d.seq
+			}
+		}
+	}
+	return changed, nil
+}
+
+func (s *ORSet) snapshot() map[string]map[dot]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elems := make(map[string]map[dot]bool, len(s.elems))
+	for elem, dots := range s.elems {
+		copied := make(map[dot]bool, len(dots))
+		for d, removed := range dots {
+			copied[d] = removed
+		}
+		elems[elem] = copied
+	}
+	return elems
+}
+
+// MarshalBinary implements CRDT. Elements are sorted, and the dots of each
+// element sorted by node and sequence number.
+func (s *ORSet) MarshalBinary() ([]byte, error) {
+	e := encodeHeader(TypeORSet)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elems := make([]string, 0, len(s.elems))
+	for elem := range s.elems {
+		elems = append(elems, elem)
+	}
+	sort.Strings(elems)
+	e.uvarint(uint64(len(elems)))
+	for _, elem := range elems {
+		dots := make([]dot, 0, len(s.elems[elem]))
+		for d := range s.elems[elem] {
+			dots = append(dots, d)
+		}
+		sort.Slice(dots, func(i, j int) bool {
+			if dots[i].node != dots[j].node {
+				return dots[i].node < dots[j].node
+			}
+			return dots[i].seq < dots[j].seq
+		})
+		e.string(elem)
+		e.uvarint(uint64(len(dots)))
+		for _, d := range dots {
+			e.string(d.node)
+			e.uvarint(d.seq)
+			e.bool(s.elems[elem][d])
+		}
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements CRDT.
+func (s *ORSet) UnmarshalBinary(data []byte) error {
+	d, err := decodeHeader(TypeORSet, data)
+	if err != nil {
+		return err
+	}
+	n := d.count(2)
+	elems := make(map[string]map[dot]bool, n)
+	s.mu.Lock()
+	seq := s.seq
+	s.mu.Unlock()
+	for i := 0; i < n && d.err == nil; i++ {
+		elem := d.string()
+		m := d.count(3)
+		dots := make(map[dot]bool, m)
+		for j := 0; j < m && d.err == nil; j++ {
+			node := d.string()
+			dt := dot{node: node, seq: d.uvarint()}
+			dots[dt] = d.bool()
+			if node == s.node && dt.seq > seq {
+				seq = dt.seq
+			}
+		}
+		elems[elem] = dots
+	}
+	if d.err != nil {
+		return d.err
+	}
+	s.mu.Lock()
+	s.elems, s.seq = elems, seq
+	s.mu.Unlock()
+	return nil
+}
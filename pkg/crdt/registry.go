@@ -0,0 +1,298 @@
+package crdt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// DefaultRetransmits is the number of gossip rounds a delta is piggybacked on
+// when no WithRetransmits option is given.
+const DefaultRetransmits = 8
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithRetransmits sets the number of gossip rounds each delta is piggybacked
+// on. Replicas that still miss a delta catch up through the periodic state
+// exchange.
+func WithRetransmits(n int) Option {
+	return func(r *Registry) {
+		r.retransmits = n
+	}
+}
+
+// WithClock sets the hybrid logical clock that timestamps the writes of the
+// registry's LWWMaps. Sharing the gossiper's clock, as set with
+// gossip.WithClock, keeps them ordered consistently with the versions the
+// rest of the cluster has seen. By default every map has a clock of its own.
+func WithClock(c *gossip.HLC) Option {
+	return func(r *Registry) {
+		r.clock = c
+	}
+}
+
+// pendingDelta is the accumulated delta of one instance waiting to be
+// piggybacked on gossip.
+type pendingDelta struct {
+	delta     CRDT
+	msg       []byte
+	transmits int
+}
+
+// Registry replicates named CRDT instances through a Gossiper. It implements
+// gossip.Delegate: every local update is broadcast as a delta, deltas of the
+// same instance are folded together while they wait, and the full state of
+// every instance is merged in each state exchange. Instances are created on
+// first use, locally or when a peer's update arrives.
+type Registry struct {
+	node        string
+	retransmits int
+	clock       *gossip.HLC
+
+	mu      sync.Mutex
+	items   map[string]CRDT
+	pending map[string]*pendingDelta
+}
+
+var _ gossip.Delegate = (*Registry)(nil)
+
+// NewRegistry creates an empty registry. node names the local replica and
+// must be unique in the cluster; the gossiper's node name is a natural
+// choice.
+func NewRegistry(node string, opts ...Option) *Registry {
+	r := &Registry{
+		node:        node,
+		retransmits: DefaultRetransmits,
+		items:       make(map[string]CRDT),
+		pending:     make(map[string]*pendingDelta),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// GCounter returns the grow-only counter called name, creating it if needed.
+// It fails with ErrTypeMismatch if name holds an instance of another type.
+func (r *Registry) GCounter(name string) (*GCounter, error) {
+	c, err := r.instance(name, TypeGCounter)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*GCounter), nil
+}
+
+// PNCounter returns the counter called name, creating it if needed. It fails
+// with ErrTypeMismatch if name holds an instance of another type.
+func (r *Registry) PNCounter(name string) (*PNCounter, error) {
+	c, err := r.instance(name, TypePNCounter)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*PNCounter), nil
+}
+
+// ORSet returns the set called name, creating it if needed. It fails with
+// ErrTypeMismatch if name holds an instance of another type.
+func (r *Registry) ORSet(name string) (*ORSet, error) {
+	c, err := r.instance(name, TypeORSet)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*ORSet), nil
+}
+
+// LWWMap returns the map called name, creating it if needed. It fails with
+// ErrTypeMismatch if name holds an instance of another type.
+func (r *Registry) LWWMap(name string) (*LWWMap, error) {
+	c, err := r.instance(name, TypeLWWMap)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*LWWMap), nil
+}
+
+// Get returns the instance called name, of whichever type it is.
+func (r *Registry) Get(name string) (CRDT, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.items[name]
+	return c, ok
+}
+
+// Names returns the names of every instance, sorted.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.items))
+	for name := range r.items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instance returns the instance called name, creating an instance of type t
+// if there is none.
+func (r *Registry) instance(name string, t Type) (CRDT, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.items[name]; ok {
+		if c.Type() != t {
+			return nil, fmt.Errorf("%w: %q is a %v, not a %v", ErrTypeMismatch, name, c.Type(), t)
+		}
+		return c, nil
+	}
+	c, err := newCRDT(t, r.node)
+	if err != nil {
+		return nil, err
+	}
+	emit := func(delta CRDT) { r.queue(name, delta) }
+	switch c := c.(type) {
+	case *GCounter:
+		c.emit = emit
+	case *PNCounter:
+		c.emit = emit
+	case *ORSet:
+		c.emit = emit
+	case *LWWMap:
+		c.emit = emit
+		if r.clock != nil {
+			c.clock = r.clock
+		}
+	}
+	r.items[name] = c
+	return c, nil
+}
+
+// queue schedules delta to be gossiped, folded into any delta of the same
+// instance that has not finished spreading.
+func (r *Registry) queue(name string, delta CRDT) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[name]
+	if ok && p.delta.Type() == delta.Type() {
+		p.delta.Merge(delta)
+	} else {
+		p = &pendingDelta{delta: delta}
+		r.pending[name] = p
+	}
+	data, err := p.delta.MarshalBinary()
+	if err != nil {
+		delete(r.pending, name)
+		return
+	}
+	e := &encoder{}
+	e.byte(formatVersion)
+	e.string(name)
+	e.bytes(data)
+	p.msg = e.buf
+	p.transmits = 0
+}
+
+// merge merges the encoded state or delta of the instance called name and
+// returns the decoded update if it changed the local state.
+func (r *Registry) merge(name string, data []byte) CRDT {
+	update, err := Decode(r.node, data)
+	if err != nil {
+		return nil
+	}
+	c, err := r.instance(name, update.Type())
+	if err != nil {
+		return nil
+	}
+	changed, err := c.Merge(update)
+	if err != nil || !changed {
+		return nil
+	}
+	return update
+}
+
+// NodeMeta implements gossip.Delegate. The registry advertises no metadata.
+func (r *Registry) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg implements gossip.Delegate. It merges a delta gossiped by
+// another replica and gossips it on if it was new.
+func (r *Registry) NotifyMsg(msg []byte) {
+	d := &decoder{buf: msg}
+	version := d.byte()
+	name, data := d.string(), d.bytes()
+	if d.err != nil || version == 0 || version > formatVersion {
+		return
+	}
+	if update := r.merge(name, data); update != nil {
+		r.queue(name, update)
+	}
+}
+
+// GetBroadcasts implements gossip.Delegate. It returns the pending deltas
+// that fit within limit, least transmitted first, and forgets those that
+// have been sent the configured number of times.
+func (r *Registry) GetBroadcasts(overhead, limit int) [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return r.pending[names[i]].transmits < r.pending[names[j]].transmits
+	})
+
+	var msgs [][]byte
+	for _, name := range names {
+		p := r.pending[name]
+		if overhead+len(p.msg) > limit {
+			continue
+		}
+		limit -= overhead + len(p.msg)
+		msgs = append(msgs, p.msg)
+		p.transmits++
+		if p.transmits >= r.retransmits {
+			delete(r.pending, name)
+		}
+	}
+	return msgs
+}
+
+// LocalState implements gossip.Delegate. It returns the full state of every
+// instance, sorted by name.
+func (r *Registry) LocalState(join bool) []byte {
+	names := r.Names()
+	e := &encoder{}
+	e.byte(formatVersion)
+	e.uvarint(uint64(len(names)))
+	for _, name := range names {
+		c, _ := r.Get(name)
+		data, err := c.MarshalBinary()
+		if err != nil {
+			return nil
+		}
+		e.string(name)
+		e.bytes(data)
+	}
+	return e.buf
+}
+
+// MergeRemoteState implements gossip.Delegate. It merges the full state of
+// another replica's instances.
+func (r *Registry) MergeRemoteState(buf []byte, join bool) {
+	d := &decoder{buf: buf}
+	version := d.byte()
+	if d.err != nil || version == 0 || version > formatVersion {
+		return
+	}
+	n := d.count(2)
+	for i := 0; i < n && d.err == nil; i++ {
+		name, data := d.string(), d.bytes()
+		if d.err != nil {
+			return
+		}
+		r.merge(name, data)
+	}
+}
@@ -0,0 +1,192 @@
+package crdt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/internal/testutil"
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+func TestRegistry_TypeMismatch(t *testing.T) {
+	r := NewRegistry("a")
+	if _, err := r.GCounter("hits"); err != nil {
+		t.Fatalf("failed to create counter: %v", err)
+	}
+	if _, err := r.ORSet("hits"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch, got %v", err)
+	}
+	c1, _ := r.GCounter("hits")
+	c2, _ := r.GCounter("hits")
+	if c1 != c2 {
+		t.Errorf("Expected the same instance for the same name")
+	}
+}
+
+func TestRegistry_Clock(t *testing.T) {
+	clock := gossip.NewHLC()
+	r := NewRegistry("a", WithClock(clock))
+	m, err := r.LWWMap("config")
+	if err != nil {
+		t.Fatalf("failed to create map: %v", err)
+	}
+
+	// A version witnessed through the shared clock orders the map's writes.
+	seen := gossip.Timestamp{WallTime: time.Now().Add(time.Hour).UnixNano()}
+	clock.Update(seen)
+	m.Set("a", []byte("1"))
+	if ts := m.regs["a"].timestamp; ts.Compare(seen) <= 0 {
+		t.Errorf("Expected the write to be newer than %v, got %v", seen, ts)
+	}
+}
+
+func TestRegistry_DeltasAreFolded(t *testing.T) {
+	r := NewRegistry("a", WithRetransmits(1))
+	c, _ := r.PNCounter("sessions")
+	c.Inc(3)
+	c.Inc(4)
+	c.Dec(2)
+
+	msgs := r.GetBroadcasts(0, 1400)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected the three updates folded into one delta, got %d", len(msgs))
+	}
+	other := NewRegistry("b")
+	other.NotifyMsg(msgs[0])
+	got, _ := other.PNCounter("sessions")
+	if got.Value() != 5 {
+		t.Errorf("Expected 5, got %d", got.Value())
+	}
+	if len(r.GetBroadcasts(0, 1400)) != 0 {
+		t.Errorf("Expected the delta to be dropped after its retransmits")
+	}
+}
+
+func TestRegistry_MapDeltasAreFolded(t *testing.T) {
+	r := NewRegistry("a", WithRetransmits(1))
+	m, _ := r.LWWMap("config")
+	m.Set("x", []byte("1"))
+	m.Set("y", []byte("2"))
+
+	// A remote delta is folded into the pending local one as well.
+	remote := NewRegistry("b", WithRetransmits(1))
+	rm, _ := remote.LWWMap("config")
+	rm.Set("z", []byte("3"))
+	r.NotifyMsg(remote.GetBroadcasts(0, 1400)[0])
+
+	msgs := r.GetBroadcasts(0, 1400)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected the writes folded into one delta, got %d", len(msgs))
+	}
+	other := NewRegistry("c")
+	other.NotifyMsg(msgs[0])
+	got, _ := other.LWWMap("config")
+	if keys := fmt.Sprint(got.Keys()); keys != "[x y z]" {
+		t.Errorf("Expected [x y z], got %s", keys)
+	}
+}
+
+// TestRegistry_Converges runs replicas that exchange deltas over a network
+// that drops and duplicates messages, with occasional state exchanges, and
+// checks that every instance ends up identical.
+func TestRegistry_Converges(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	regs := make([]*Registry, 4)
+	for i := range regs {
+		regs[i] = NewRegistry(fmt.Sprintf("node-%d", i), WithRetransmits(2))
+	}
+
+	var total int64
+	for round := 0; round < 200; round++ {
+		reg := regs[r.Intn(len(regs))]
+		switch r.Intn(4) {
+		case 0:
+			c, _ := reg.PNCounter("sessions")
+			n := uint64(r.Intn(5))
+			c.Inc(n)
+			total += int64(n)
+		case 1:
+			c, _ := reg.PNCounter("sessions")
+			n := uint64(r.Intn(5))
+			c.Dec(n)
+			total -= int64(n)
+		case 2:
+			s, _ := reg.ORSet("members")
+			s.Add(fmt.Sprintf("m%d", r.Intn(6)))
+		case 3:
+			s, _ := reg.ORSet("members")
+			s.Remove(fmt.Sprintf("m%d", r.Intn(6)))
+		}
+
+		for i, reg := range regs {
+			for _, msg := range reg.GetBroadcasts(0, 1400) {
+				if r.Intn(3) == 0 {
+					continue
+				}
+				to := regs[(i+1+r.Intn(len(regs)-1))%len(regs)]
+				to.NotifyMsg(msg)
+				if r.Intn(4) == 0 {
+					to.NotifyMsg(msg)
+				}
+			}
+		}
+		if round%20 == 0 {
+			a, b := regs[r.Intn(len(regs))], regs[r.Intn(len(regs))]
+			a.MergeRemoteState(b.LocalState(false), false)
+		}
+	}
+
+	converged := func() bool {
+		want := regs[0].LocalState(false)
+		for _, reg := range regs[1:] {
+			if !bytes.Equal(reg.LocalState(false), want) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; !converged(); i++ {
+		if i == 500 {
+			t.Fatalf("replicas did not converge after %d state exchanges", i)
+		}
+		a, b := regs[r.Intn(len(regs))], regs[r.Intn(len(regs))]
+		a.MergeRemoteState(b.LocalState(false), false)
+	}
+	c, _ := regs[0].PNCounter("sessions")
+	if c.Value() != total {
+		t.Errorf("Expected the counter at %d, got %d", total, c.Value())
+	}
+}
+
+func TestRegistry_Gossip(t *testing.T) {
+	addrs := []string{"127.0.0.1:7099", "127.0.0.1:7100"}
+	regs := []*Registry{NewRegistry(addrs[0]), NewRegistry(addrs[1])}
+	testutil.Start(testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithDelegate(regs[i]),
+			gossip.WithGossip(20*time.Millisecond, 3),
+		}
+	}))
+
+	// The first update reaches the seed once the nodes have joined.
+	c1, _ := regs[1].GCounter("requests")
+	c1.Inc(7)
+	testutil.WaitFor(t, 5*time.Second, "the join", func() bool {
+		c, _ := regs[0].GCounter("requests")
+		return c.Value() == 7
+	})
+
+	// Later updates travel as deltas.
+	c0, _ := regs[0].GCounter("requests")
+	c0.Inc(5)
+	s0, _ := regs[0].ORSet("nodes")
+	s0.Add("api-1")
+	testutil.WaitFor(t, 5*time.Second, "the deltas", func() bool {
+		s1, _ := regs[1].ORSet("nodes")
+		return c1.Value() == 12 && s1.Contains("api-1")
+	})
+}
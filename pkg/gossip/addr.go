@@ -0,0 +1,100 @@
+package gossip
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// resolveAddr parses a "host:port" address. IP literals, including bracketed
+// IPv6 literals with a zone, are parsed without a DNS lookup; anything else is
+// resolved. IPv4-mapped IPv6 addresses are unmapped so that the same host
+// always produces the same membership key.
+func resolveAddr(addr string) (*net.UDPAddr, error) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())), nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := udpAddr.IP.To4(); ip4 != nil {
+		udpAddr.IP = ip4
+	}
+	return udpAddr, nil
+}
+
+// advertiseAddr determines the address announced to peers. An explicit
+// advertise address always wins; its port defaults to the bind port. When the
+// bind address is a wildcard, a private address of the host is chosen
+// instead, or the wildcard itself is advertised if the host has none.
+func advertiseAddr(bind *net.UDPAddr, advertise string) (*net.UDPAddr, error) {
+	if advertise != "" {
+		host, port, err := net.SplitHostPort(advertise)
+		if err != nil {
+			// Accept a bare host or IP literal and keep the bind port.
+			host, port = advertise, ""
+		}
+		if port == "" || port == "0" {
+			port = strconv.Itoa(bind.Port)
+		}
+		return resolveAddr(net.JoinHostPort(host, port))
+	}
+
+	if bind.IP != nil && !bind.IP.IsUnspecified() {
+		return bind, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		addrs = nil
+	}
+	return wildcardAdvertiseAddr(bind, addrs), nil
+}
+
+// wildcardAdvertiseAddr picks the address to advertise for a wildcard bind
+// address from the host's interface addresses. Without a private address it
+// falls back to the bind address, as releases before the advertise address
+// was introduced did: peers on the same host can still reach it, and others
+// need an advertise address set explicitly.
+func wildcardAdvertiseAddr(bind *net.UDPAddr, addrs []net.Addr) *net.UDPAddr {
+	// An unspecified IPv6 bind address listens on both families, so IPv4 is
+	// still an acceptable fallback.
+	ip := selectAdvertiseIP(addrs, bind.IP != nil && bind.IP.To4() == nil)
+	if ip == nil {
+		// Log.Printf("no private IP address found for wildcard bind address %s, advertising it as is", bind)
+		return bind
+	}
+	return &net.UDPAddr{IP: ip, Port: bind.Port}
+}
+
+// selectAdvertiseIP picks the address to advertise from a host's interface
+// addresses: the first private address of the preferred family, otherwise the
+// first private address of the other family.
+func selectAdvertiseIP(addrs []net.Addr, preferIPv6 bool) net.IP {
+	var fallback net.IP
+	for _, a := range addrs {
+		var ip net.IP
+		switch v := a.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		default:
+			continue
+		}
+		if !ip.IsPrivate() {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if (ip.To4() == nil) == preferIPv6 {
+			return ip
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+	return fallback
+}
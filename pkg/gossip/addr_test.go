@@ -0,0 +1,153 @@
+package gossip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolveAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"[::ffff:10.0.0.1]:8080", "10.0.0.1:8080"},
+		{"[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080"},
+		{"[2001:db8::1]:7946", "[2001:db8::1]:7946"},
+	}
+
+	for _, tt := range tests {
+		addr, err := resolveAddr(tt.in)
+		if err != nil {
+			t.Errorf("resolveAddr(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if addr.String() != tt.want {
+			t.Errorf("resolveAddr(%q) = %s, expected %s", tt.in, addr, tt.want)
+		}
+	}
+}
+
+func TestSelectAdvertiseIP(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+		&net.IPNet{IP: net.ParseIP("203.0.113.7"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)},
+	}
+
+	if ip := selectAdvertiseIP(addrs, false); !ip.Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("Expected 10.1.2.3 for IPv4 preference, got %s", ip)
+	}
+	if ip := selectAdvertiseIP(addrs, true); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("Expected fd00::2 for IPv6 preference, got %s", ip)
+	}
+	if ip := selectAdvertiseIP(addrs[:3], false); ip != nil {
+		t.Errorf("Expected no address without private interfaces, got %s", ip)
+	}
+	if ip := selectAdvertiseIP(addrs[3:4], false); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("Expected fallback to fd00::2, got %s", ip)
+	}
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	bind := &net.UDPAddr{IP: net.IPv4zero, Port: 7946}
+
+	addr, err := advertiseAddr(bind, "198.51.100.10")
+	if err != nil {
+		t.Fatalf("advertiseAddr failed: %v", err)
+	}
+	if addr.String() != "198.51.100.10:7946" {
+		t.Errorf("Expected bind port to be kept, got %s", addr)
+	}
+
+	addr, err = advertiseAddr(bind, "[2001:db8::5]:17946")
+	if err != nil {
+		t.Fatalf("advertiseAddr failed: %v", err)
+	}
+	if addr.String() != "[2001:db8::5]:17946" {
+		t.Errorf("Expected explicit advertise address, got %s", addr)
+	}
+
+	explicit := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+	addr, err = advertiseAddr(explicit, "")
+	if err != nil {
+		t.Fatalf("advertiseAddr failed: %v", err)
+	}
+	if addr.String() != explicit.String() {
+		t.Errorf("Expected bind address to be advertised, got %s", addr)
+	}
+}
+
+func TestWildcardAdvertiseAddr(t *testing.T) {
+	bind := &net.UDPAddr{IP: net.IPv4zero, Port: 7946}
+	private := []net.Addr{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)}}
+	if addr := wildcardAdvertiseAddr(bind, private); addr.String() != "10.1.2.3:7946" {
+		t.Errorf("Expected the private address to be advertised, got %s", addr)
+	}
+
+	// Without a private address the wildcard is advertised, as before
+	// advertise addresses existed.
+	public := []net.Addr{&net.IPNet{IP: net.ParseIP("203.0.113.7"), Mask: net.CIDRMask(24, 32)}}
+	if addr := wildcardAdvertiseAddr(bind, public); addr != bind {
+		t.Errorf("Expected the bind address to be advertised, got %s", addr)
+	}
+	if addr := wildcardAdvertiseAddr(bind, nil); addr != bind {
+		t.Errorf("Expected the bind address to be advertised, got %s", addr)
+	}
+}
+
+func TestNewGossiper_AdvertiseAddr(t *testing.T) {
+	g, err := NewGossiper("node1", "0.0.0.0:7946", []string{"[2001:db8::2]:7946"}, NewMockTransport(), WithAdvertiseAddr("203.0.113.5"))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	if g.self.Addr.String() != "203.0.113.5:7946" {
+		t.Errorf("Expected advertised address 203.0.113.5:7946, got %s", g.self.Addr)
+	}
+	if _, ok := g.members.Get("203.0.113.5:7946"); !ok {
+		t.Error("Self not registered under advertised address")
+	}
+	if _, ok := g.members.Get("[2001:db8::2]:7946"); !ok {
+		t.Error("IPv6 peer not registered")
+	}
+}
+
+func TestUDPTransport_DualStack(t *testing.T) {
+	tr, err := NewUDPTransport("[::]:9013")
+	if err != nil {
+		t.Skipf("dual-stack sockets unavailable: %v", err)
+	}
+	defer tr.Stop()
+
+	for _, src := range []string{"127.0.0.1:9014", "[::1]:9015"} {
+		sender, err := NewUDPTransport(src)
+		if err != nil {
+			t.Skipf("cannot bind %s: %v", src, err)
+		}
+
+		dst := "127.0.0.1:9013"
+		if src[0] == '[' {
+			dst = "[::1]:9013"
+		}
+		msg := []byte("hello from " + src)
+		err = sender.Write(msg, dst)
+		sender.Stop()
+		if err != nil {
+			t.Fatalf("failed to write from %s: %v", src, err)
+		}
+
+		select {
+		case received := <-tr.Read():
+			if string(received) != string(msg) {
+				t.Errorf("Expected %s, got %s", msg, received)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for message from %s", src)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package gossip
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// broadcast is a message disseminated epidemically: it is piggybacked on a
+// limited number of gossip packets to random members, and every member that
+// finds it new queues it again in turn.
+type broadcast struct {
+	// key identifies what the broadcast is about. A newer broadcast with the
+	// same key replaces an older one still in the queue.
+	key string
+	// order, if set, orders broadcasts of the same key: one with a lower
+	// order than the queued broadcast is dropped rather than replacing it.
+	order uint64
+	// msg is the encoded Message.
+	msg       []byte
+	transmits int
+	sentTo    map[string]struct{}
+	// target is the number of distinct members the broadcast must reach
+	// before its waiters are released. The broadcast is not retired before
+	// that, even if it has exhausted its transmit limit.
+	target  int
+	waiters []chan struct{}
+}
+
+// broadcastQueue holds the broadcasts waiting to be piggybacked on gossip
+// packets, least transmitted first.
+type broadcastQueue struct {
+	mu    sync.Mutex
+	items []*broadcast
+}
+
+// queue adds b, replacing any queued broadcast with the same key. Waiters of
+// the replaced broadcast are released when b reaches its target instead.
+func (q *broadcastQueue) queue(b *broadcast) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if b.key != "" {
+		for i, old := range q.items {
+			if old.key != b.key {
+				continue
+			}
+			if b.order < old.order {
+				return
+			}
+			b.waiters = append(b.waiters, old.waiters...)
+			if old.target > b.target {
+				b.target = old.target
+			}
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	q.items = append(q.items, b)
+}
+
+// next returns the broadcasts to piggyback on a packet to addr, taking up at
+// most limit bytes of a Compound payload as counted by compoundPartSize, and
+// retires broadcasts that have been transmitted transmitLimit times and
+// reached their target.
+func (q *broadcastQueue) next(addr string, limit, transmitLimit int) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	sort.SliceStable(q.items, func(i, j int) bool {
+		return q.items[i].transmits < q.items[j].transmits
+	})
+
+	var msgs [][]byte
+	size := 0
+	kept := q.items[:0]
+	for _, b := range q.items {
+		// The first broadcast always fits, so that one larger than the
+		// limit still goes out on a packet of its own.
+		if _, sent := b.sentTo[addr]; !sent && (size+compoundPartSize(b.msg) <= limit || len(msgs) == 0) {
+			msgs = append(msgs, b.msg)
+			size += compoundPartSize(b.msg)
+			b.transmits++
+			b.sentTo[addr] = struct{}{}
+			if len(b.sentTo) >= b.target {
+				b.release()
+			}
+		}
+		if b.transmits >= transmitLimit && len(b.waiters) == 0 {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	for i := len(kept); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = kept
+	return msgs
+}
+
+// cancel stops waiting for the broadcast that waiter was registered on.
+func (q *broadcastQueue) cancel(waiter chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.items {
+		for i, w := range b.waiters {
+			if w == waiter {
+				b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// len returns the number of queued broadcasts.
+func (q *broadcastQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (b *broadcast) release() {
+	for _, w := range b.waiters {
+		close(w)
+	}
+	b.waiters = nil
+}
+
+// retransmitLimit is the number of times a broadcast is transmitted in a
+// cluster of n members: enough for it to reach every member with high
+// probability, growing logarithmically with the cluster size.
+func (g *Gossiper) retransmitLimit(n int) int {
+	return g.retransmitMult * int(math.Ceil(math.Log10(float64(n+1))))
+}
+
+// broadcastNode queues an update about node for dissemination. If waitFor is
+// positive, the returned channel is closed once the update has been sent to
+// that fraction of the other members; otherwise it is nil.
+func (g *Gossiper) broadcastNode(node *Node, waitFor float64) chan struct{} {
+	payload, err := json.Marshal([]*Node{node})
+	if err != nil {
+		return nil
+	}
+	msg, err := (&Message{Type: Sync, Payload: payload}).Encode()
+	if err != nil {
+		return nil
+	}
+
+	b := &broadcast{
+		key:    "node:" + node.Addr.String(),
+		msg:    msg,
+		sentTo: make(map[string]struct{}),
+	}
+	var waiter chan struct{}
+	if waitFor > 0 {
+		peers := len(g.members.All()) - 1
+		b.target = int(math.Ceil(waitFor * float64(peers)))
+		waiter = make(chan struct{})
+		if b.target == 0 {
+			close(waiter)
+		} else {
+			b.waiters = []chan struct{}{waiter}
+		}
+	}
+	g.broadcasts.queue(b)
+	g.kickGossip()
+	return waiter
+}
+
+// compoundPartSize returns the number of bytes an encoded message takes up in
+// the payload of a Compound message, a JSON array of base64 strings: its
+// base64 encoding, the quotes around it and a separating comma.
+func compoundPartSize(msg []byte) int {
+	return base64.StdEncoding.EncodedLen(len(msg)) + 3
+}
+
+// compoundBudget returns the number of bytes of parts, as counted by
+// compoundPartSize, that fit in one gossip packet. The Compound payload is
+// base64-encoded again in the enclosing message, so only three quarters of
+// the packet size left by the message's own fields is available.
+func (g *Gossiper) compoundBudget() int {
+	empty, err := (&Message{Type: Compound, Payload: []byte{}, Label: g.label}).Encode()
+	if err != nil {
+		return 0
+	}
+	// The brackets of the array take two bytes, and the last part has no
+	// comma.
+	return (g.gossipPacketSize-len(empty))/4*3 - 1
+}
+
+// kickGossip makes the gossip loop run a round now rather than at its next
+// tick, so that fresh updates leave immediately.
+func (g *Gossiper) kickGossip() {
+	select {
+	case g.gossipKick <- struct{}{}:
+	default:
+	}
+}
+
+func (g *Gossiper) gossipLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.gossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.gossip()
+		case <-g.gossipKick:
+			g.gossip()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// gossip sends the queued broadcasts, followed by the delegate's user
+// messages, to a few random members.
+func (g *Gossiper) gossip() {
+	if g.broadcasts.len() == 0 && g.delegate == nil {
+		return
+	}
+
+	nodes := g.members.All()
+	// A broadcast goes to each member at most once, so in a cluster with
+	// fewer peers than the retransmit limit it retires once it has reached
+	// them all.
+	limit := min(g.retransmitLimit(len(nodes)), len(nodes)-1)
+	budget := g.compoundBudget()
+	self := g.self.Addr.String()
+	sent := 0
+	for _, i := range rand.Perm(len(nodes)) {
+		if sent == g.gossipNodes {
+			break
+		}
+		addr := nodes[i].Addr.String()
+		if addr == self {
+			continue
+		}
+		sent++
+
+		msgs := g.broadcasts.next(addr, budget, limit)
+		size := 0
+		for _, msg := range msgs {
+			size += compoundPartSize(msg)
+		}
+		if room := budget - size; room > 0 {
+			msgs = append(msgs, g.userBroadcasts(room)...)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(msgs)
+		if err != nil {
+			continue
+		}
+		if err := g.send(&Message{Type: Compound, Payload: payload}, addr); err != nil {
+			// Log.Printf("[%s] failed to send message to %s: %v", g.name, addr, err)
+		}
+	}
+}
+
+// handleCompound dispatches every message bundled in a Compound message. The
+// bundled messages share the label of the enclosing one.
+func (g *Gossiper) handleCompound(payload []byte) {
+	var msgs [][]byte
+	if err := json.Unmarshal(payload, &msgs); err != nil {
+		return
+	}
+	for _, data := range msgs {
+		msg, err := Decode(data)
+		if err != nil || msg.Type == Compound {
+			g.malformed.Add(1)
+			continue
+		}
+		g.dispatch(msg)
+	}
+}
@@ -0,0 +1,139 @@
+package gossip
+
+import (
+	"bytes"
+	"math/rand"
+	"time"
+)
+
+// Delegate lets an application piggyback its own data on the gossip
+// protocol. All methods are called from the gossiper's goroutines and must be
+// safe for concurrent use; they should return quickly.
+type Delegate interface {
+	// NodeMeta returns the raw metadata of the local node, at most limit
+	// bytes. It is read when the gossiper is created and again on every
+	// periodic sync, and a change is broadcast like SetMeta.
+	NodeMeta(limit int) []byte
+	// NotifyMsg is called with every user message received from a peer. The
+	// buffer must not be retained after the call returns.
+	NotifyMsg(msg []byte)
+	// GetBroadcasts returns user messages to piggyback on the next gossip
+	// packet. Each message costs overhead bytes on top of its length, and
+	// all of them together must fit within limit bytes.
+	GetBroadcasts(overhead, limit int) [][]byte
+	// LocalState returns the application state to send during a full state
+	// exchange. join is true when the exchange is part of joining the
+	// cluster.
+	LocalState(join bool) []byte
+	// MergeRemoteState merges the application state received from a peer
+	// during a full state exchange.
+	MergeRemoteState(buf []byte, join bool)
+}
+
+// localState returns the delegate's state for a full state exchange, if any.
+func (g *Gossiper) localState(join bool) []byte {
+	if g.delegate == nil {
+		return nil
+	}
+	return g.delegate.LocalState(join)
+}
+
+// mergeRemoteState hands state received in a full state exchange to the
+// delegate.
+func (g *Gossiper) mergeRemoteState(buf []byte, join bool) {
+	if g.delegate == nil || len(buf) == 0 {
+		return
+	}
+	g.delegate.MergeRemoteState(buf, join)
+}
+
+// handleUser passes a user message to the delegate.
+func (g *Gossiper) handleUser(payload []byte) {
+	if g.delegate == nil {
+		return
+	}
+	g.delegate.NotifyMsg(payload)
+}
+
+// userBroadcasts asks the delegate for user messages to fill room bytes of a
+// Compound payload, as counted by compoundPartSize, and returns them encoded.
+func (g *Gossiper) userBroadcasts(room int) [][]byte {
+	if g.delegate == nil {
+		return nil
+	}
+	empty, err := (&Message{Type: User, Payload: []byte{}}).Encode()
+	if err != nil {
+		return nil
+	}
+	// A payload is base64-encoded twice on its way into a Compound
+	// payload: in its User message, and as a part of the Compound array.
+	// n bytes of payload therefore take up at most 16n/9 bytes of room, plus
+	// 4/3 of the User message's own fields and the rounding and quoting of
+	// both encodings. The delegate is handed the room and overhead scaled
+	// back by 9/16, rounded so that what it returns always fits.
+	overhead := len(empty)*3/4 + 6
+	bufs := g.delegate.GetBroadcasts(overhead, room*9/16)
+
+	msgs := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		msg, err := (&Message{Type: User, Payload: buf}).Encode()
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// refreshNodeMeta broadcasts the delegate's node metadata if it differs from
+// the metadata currently advertised.
+func (g *Gossiper) refreshNodeMeta(current []byte, tagsSize int) {
+	if g.delegate == nil {
+		return
+	}
+	meta := g.delegate.NodeMeta(g.maxMetadataSize - tagsSize)
+	if bytes.Equal(meta, current) {
+		return
+	}
+	if err := g.SetMeta(meta); err != nil {
+		// Log.Printf("[%s] ignoring node metadata from delegate: %v", g.name, err)
+	}
+}
+
+// joinMaxBackoff caps the wait between two rounds of join attempts.
+const joinMaxBackoff = 30 * time.Second
+
+// join runs a push-pull exchange with the seed peers, in random order, until
+// one of them answers. It gives a new node the full cluster state, including
+// the delegate's, without waiting for the periodic sync. When no seed answers,
+// it tries them all again after a backoff that starts at the reconnect
+// timeout and doubles up to joinMaxBackoff, so that a node started before its
+// seeds joins them as soon as they are up.
+func (g *Gossiper) join() {
+	defer g.wg.Done()
+	backoff := g.reconnectTimeout
+	if backoff <= 0 {
+		backoff = DefaultReconnectTimeout
+	}
+	for {
+		for _, i := range rand.Perm(len(g.seeds)) {
+			if err := g.pushPull(g.seeds[i], g.reconnectTimeout, true); err == nil {
+				return
+			}
+			select {
+			case <-g.stop:
+				return
+			default:
+			}
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-g.stop:
+			timer.Stop()
+			return
+		}
+		backoff = min(2*backoff, joinMaxBackoff)
+	}
+}
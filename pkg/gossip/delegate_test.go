@@ -0,0 +1,138 @@
+package gossip
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDelegate records what the gossiper hands it.
+type testDelegate struct {
+	meta  []byte
+	state []byte
+
+	mu         sync.Mutex
+	broadcasts [][]byte
+	received   []string
+	merged     []string
+	joins      int
+}
+
+func (d *testDelegate) NodeMeta(limit int) []byte {
+	return d.meta
+}
+
+func (d *testDelegate) NotifyMsg(msg []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.received = append(d.received, string(msg))
+}
+
+func (d *testDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out [][]byte
+	for len(d.broadcasts) > 0 && overhead+len(d.broadcasts[0]) <= limit {
+		limit -= overhead + len(d.broadcasts[0])
+		out = append(out, d.broadcasts[0])
+		d.broadcasts = d.broadcasts[1:]
+	}
+	return out
+}
+
+func (d *testDelegate) LocalState(join bool) []byte {
+	return d.state
+}
+
+func (d *testDelegate) MergeRemoteState(buf []byte, join bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.merged = append(d.merged, string(buf))
+	if join {
+		d.joins++
+	}
+}
+
+func (d *testDelegate) snapshot() (received, merged []string, joins int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.received...), append([]string(nil), d.merged...), d.joins
+}
+
+func TestGossiper_Delegate(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7031", "127.0.0.1:7032"}
+	delegates := []*testDelegate{
+		{meta: []byte("meta-1"), state: []byte("state-1")},
+		{meta: []byte("meta-2"), state: []byte("state-2")},
+	}
+
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		// The second node only knows the first, and joins through it.
+		g, err := NewGossiper(addr, addr, addrs[:i], network.Transport(addr), WithDelegate(delegates[i]))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	// Joining exchanges the application state in both directions.
+	waitFor(t, time.Second, "the join state exchange", func() bool {
+		_, merged1, joins1 := delegates[0].snapshot()
+		_, merged2, joins2 := delegates[1].snapshot()
+		return joins1 == 1 && joins2 == 1 &&
+			len(merged1) > 0 && merged1[0] == "state-2" &&
+			len(merged2) > 0 && merged2[0] == "state-1"
+	})
+
+	// Node metadata comes from the delegate.
+	waitFor(t, time.Second, "the delegate's node metadata", func() bool {
+		node, ok := lookup(gossipers[1].members, addrs[0])
+		return ok && string(node.Meta) == "meta-1"
+	})
+
+	// User messages are piggybacked on gossip packets.
+	delegates[0].mu.Lock()
+	delegates[0].broadcasts = [][]byte{[]byte("hello"), []byte("world")}
+	delegates[0].mu.Unlock()
+	waitFor(t, time.Second, "user messages", func() bool {
+		received, _, _ := delegates[1].snapshot()
+		return len(received) == 2 && received[0] == "hello" && received[1] == "world"
+	})
+}
+
+func TestGossiper_DelegateMetaTooLarge(t *testing.T) {
+	d := &testDelegate{meta: make([]byte, 64)}
+	_, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithDelegate(d), WithMaxMetadataSize(32))
+	if err == nil {
+		t.Fatal("Expected an error for oversized delegate metadata")
+	}
+}
+
+// TestGossiper_JoinRetries checks that a node started while its seed is
+// unreachable keeps trying and joins once the seed is up.
+func TestGossiper_JoinRetries(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7112", "127.0.0.1:7113"}
+	network.SetDown(addrs[0], true)
+	delegates := []*testDelegate{{state: []byte("state-1")}, {state: []byte("state-2")}}
+	for i, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs[:i], network.Transport(addr),
+			WithDelegate(delegates[i]), WithReconnect(time.Hour, 50*time.Millisecond, time.Hour))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	network.SetDown(addrs[0], false)
+	waitFor(t, 2*time.Second, "the join", func() bool {
+		_, _, joins := delegates[1].snapshot()
+		return joins > 0
+	})
+}
@@ -0,0 +1,219 @@
+package gossip
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// digestEntry summarises one membership record: enough to tell which side of
+// an exchange holds the newer version, without the record's metadata.
+type digestEntry struct {
+	Addr        string    `json:"addr"`
+	Incarnation uint64    `json:"inc,omitempty"`
+	State       State     `json:"state,omitempty"`
+	Version     Timestamp `json:"version,omitzero"`
+	// LastUpdated is only set for records without a version, which are
+	// still ordered by wall time.
+	LastUpdated time.Time `json:"updated,omitzero"`
+}
+
+// node returns a record carrying the entry's ordering fields, for comparison
+// with supersedes.
+func (e *digestEntry) node() *Node {
+	return &Node{
+		Incarnation: e.Incarnation,
+		State:       e.State,
+		Version:     e.Version,
+		LastUpdated: e.LastUpdated,
+	}
+}
+
+// digest is the payload of a Digest message, the first phase of anti-entropy.
+// It carries only the ordering fields of each record; application state is
+// exchanged by the periodic push-pull instead, so the digest stays small
+// whatever the Delegate holds.
+type digest struct {
+	From    string        `json:"from"`
+	Entries []digestEntry `json:"entries"`
+}
+
+// digestReply is the payload of a DigestReply message: the records the
+// replier holds newer versions of, and the addresses of the records it wants.
+type digestReply struct {
+	From    string   `json:"from"`
+	Nodes   []*Node  `json:"nodes,omitempty"`
+	Request []string `json:"request,omitempty"`
+}
+
+// digest summarises every member and tombstone.
+func (m *MembershipList) digest() []digestEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]digestEntry, 0, len(m.nodes)+len(m.tombstones))
+	add := func(n *Node) {
+		e := digestEntry{
+			Addr:        n.Addr.String(),
+			Incarnation: n.Incarnation,
+			State:       n.State,
+			Version:     n.Version,
+		}
+		if n.Version.IsZero() {
+			e.LastUpdated = n.LastUpdated
+		}
+		entries = append(entries, e)
+	}
+	for _, n := range m.nodes {
+		add(n)
+	}
+	for _, ts := range m.tombstones {
+		add(ts.node)
+	}
+	return entries
+}
+
+// reconcile compares a remote digest with the list. It returns copies of the
+// local records that are newer than the remote ones or missing from the
+// digest, and the addresses of the remote records that are newer or unknown
+// locally.
+func (m *MembershipList) reconcile(entries []digestEntry) (newer []*Node, wanted []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[string]struct{}, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		seen[e.Addr] = struct{}{}
+		local := m.record(e.Addr)
+		switch {
+		case local == nil:
+			wanted = append(wanted, e.Addr)
+		case local.supersedes(e.node()):
+			n := *local
+			newer = append(newer, &n)
+		case e.node().supersedes(local):
+			wanted = append(wanted, e.Addr)
+		}
+	}
+	for key, n := range m.nodes {
+		if _, ok := seen[key]; !ok {
+			c := *n
+			newer = append(newer, &c)
+		}
+	}
+	for key, ts := range m.tombstones {
+		if _, ok := seen[key]; !ok {
+			c := *ts.node
+			newer = append(newer, &c)
+		}
+	}
+	return newer, wanted
+}
+
+// records returns copies of the members and tombstones stored under addrs.
+func (m *MembershipList) records(addrs []string) []*Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]*Node, 0, len(addrs))
+	for _, addr := range addrs {
+		if n := m.record(addr); n != nil {
+			c := *n
+			nodes = append(nodes, &c)
+		}
+	}
+	return nodes
+}
+
+// record returns the member or tombstone stored under addr. It must be called
+// with the lock held.
+func (m *MembershipList) record(addr string) *Node {
+	if n, ok := m.nodes[addr]; ok {
+		return n
+	}
+	if ts, ok := m.tombstones[addr]; ok {
+		return ts.node
+	}
+	return nil
+}
+
+// sendDigest starts an anti-entropy round with addr by sending it a digest of
+// the membership list.
+func (g *Gossiper) sendDigest(addr string) {
+	payload, err := json.Marshal(&digest{
+		From:    g.self.Addr.String(),
+		Entries: g.members.digest(),
+	})
+	if err != nil {
+		return
+	}
+	if err := g.send(&Message{Type: Digest, Payload: payload}, addr); err != nil {
+		// Log.Printf("[%s] failed to send message to %s: %v", g.name, addr, err)
+	}
+}
+
+// handleDigest answers a digest with the records the sender is missing or
+// holds older versions of, and requests the ones it holds newer versions of.
+func (g *Gossiper) handleDigest(payload []byte) {
+	var d digest
+	if err := json.Unmarshal(payload, &d); err != nil || d.From == "" {
+		g.malformed.Add(1)
+		return
+	}
+
+	newer, wanted := g.members.reconcile(d.Entries)
+	if len(newer) == 0 && len(wanted) == 0 {
+		return
+	}
+	// The reply is split into several messages when the records and
+	// requests do not fit in one packet; each part is handled on its own.
+	g.sendSplit(d.From, len(newer)+len(wanted), func(lo, hi int) *Message {
+		r := &digestReply{From: g.self.Addr.String()}
+		r.Nodes = newer[min(lo, len(newer)):min(hi, len(newer))]
+		r.Request = wanted[max(lo-len(newer), 0):max(hi-len(newer), 0)]
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil
+		}
+		return &Message{Type: DigestReply, Payload: data}
+	})
+}
+
+// sendSplit sends to addr the messages build returns for the items [0, n),
+// halving the ranges whose message exceeds the gossip packet size. A single
+// item that does not fit is sent on its own.
+func (g *Gossiper) sendSplit(addr string, n int, build func(lo, hi int) *Message) {
+	var send func(lo, hi int)
+	send = func(lo, hi int) {
+		msg := build(lo, hi)
+		if msg == nil {
+			return
+		}
+		msg.Label = g.label
+		data, err := msg.Encode()
+		if err != nil {
+			return
+		}
+		if len(data) > g.gossipPacketSize && hi-lo > 1 {
+			mid := (lo + hi) / 2
+			send(lo, mid)
+			send(mid, hi)
+			return
+		}
+		if err := g.transport.Write(data, addr); err != nil {
+			// Log.Printf("[%s] failed to send message to %s: %v", g.name, addr, err)
+		}
+	}
+	send(0, n)
+}
+
+// handleDigestReply merges the newer records of the replier and sends back
+// the ones it requested.
+func (g *Gossiper) handleDigestReply(payload []byte) {
+	var r digestReply
+	if err := json.Unmarshal(payload, &r); err != nil || r.From == "" {
+		g.malformed.Add(1)
+		return
+	}
+	g.mergeRemote(r.Nodes)
+	if len(r.Request) > 0 {
+		g.sendNodes(g.members.records(r.Request), r.From)
+	}
+}
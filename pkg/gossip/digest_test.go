@@ -0,0 +1,266 @@
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// pump delivers the messages queued on the given transports until none are
+// left, and returns the number of bytes delivered.
+func pump(gossipers map[*mockNetTransport]*Gossiper) int {
+	total := 0
+	for {
+		delivered := false
+		for tr, g := range gossipers {
+			select {
+			case data := <-tr.readCh:
+				total += len(data)
+				g.handleMessage(data)
+				delivered = true
+			default:
+			}
+		}
+		if !delivered {
+			return total
+		}
+	}
+}
+
+func TestMembershipList_Reconcile(t *testing.T) {
+	addr := func(port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	}
+	local := NewMembershipList()
+	remote := NewMembershipList()
+
+	same := &Node{Addr: addr(1), State: Alive}
+	local.stamp(same)
+	c := *same
+	local.Add(same)
+	remote.Add(&c)
+
+	// Newer locally, newer remotely, and known to one side only.
+	localNewer := &Node{Addr: addr(2), State: Alive}
+	remote.stamp(localNewer)
+	c2 := *localNewer
+	remote.Add(&c2)
+	local.Add(localNewer)
+	local.Suspect(addr(2).String())
+
+	remoteNewer := &Node{Addr: addr(3), State: Alive}
+	local.stamp(remoteNewer)
+	c3 := *remoteNewer
+	local.Add(remoteNewer)
+	remote.Add(&c3)
+	remote.Suspect(addr(3).String())
+
+	local.Add(&Node{Addr: addr(4), State: Alive, LastUpdated: time.Now()})
+	remote.Add(&Node{Addr: addr(5), State: Alive, LastUpdated: time.Now()})
+
+	newer, wanted := local.reconcile(remote.digest())
+	got := make(map[string]bool)
+	for _, n := range newer {
+		got[n.Addr.String()] = true
+	}
+	if len(newer) != 2 || !got[addr(2).String()] || !got[addr(4).String()] {
+		t.Errorf("Expected to offer 127.0.0.1:2 and 127.0.0.1:4, got %v", newer)
+	}
+	want := map[string]bool{}
+	for _, a := range wanted {
+		want[a] = true
+	}
+	if len(wanted) != 2 || !want[addr(3).String()] || !want[addr(5).String()] {
+		t.Errorf("Expected to request 127.0.0.1:3 and 127.0.0.1:5, got %v", wanted)
+	}
+}
+
+func TestGossiper_DigestSync(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7091", "127.0.0.1:7092"}
+	gossipers := make(map[*mockNetTransport]*Gossiper)
+	var a, b *Gossiper
+	for i, addr := range addrs {
+		tr := network.Transport(addr)
+		g, err := NewGossiper(addr, addr, addrs, tr)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		gossipers[tr] = g
+		if i == 0 {
+			a = g
+		} else {
+			b = g
+		}
+	}
+	if err := a.SetTags(map[string]string{"role": "a"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+	if err := b.SetTags(map[string]string{"role": "b"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+
+	// One round brings both sides up to date.
+	a.sendDigest(addrs[1])
+	pump(gossipers)
+	if n, _ := lookup(a.members, addrs[1]); !n.HasTag("role", "b") {
+		t.Errorf("Expected a to learn b's tags, got %v", n.Tags)
+	}
+	if n, _ := lookup(b.members, addrs[0]); !n.HasTag("role", "a") {
+		t.Errorf("Expected b to learn a's tags, got %v", n.Tags)
+	}
+
+	// Once in sync, a round costs only the digest.
+	digestSize := len(mustMarshal(t, &digest{From: addrs[0], Entries: a.members.digest()}))
+	a.sendDigest(addrs[1])
+	if sent := pump(gossipers); sent > digestSize+100 {
+		t.Errorf("Expected only a digest of about %d bytes once in sync, sent %d", digestSize, sent)
+	}
+}
+
+// TestGossiper_DigestReplySplit checks that a round between members that
+// each know many members the other does not stays within the packet size and
+// still brings both sides up to date.
+func TestGossiper_DigestReplySplit(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7118", "127.0.0.1:7119"}
+	gossipers := make(map[*mockNetTransport]*Gossiper)
+	var gs []*Gossiper
+	for _, addr := range addrs {
+		tr := network.Transport(addr)
+		g, err := NewGossiper(addr, addr, addrs, tr)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		gossipers[tr] = g
+		gs = append(gs, g)
+	}
+	for i, g := range gs {
+		for j := 0; j < 200; j++ {
+			node := &Node{
+				Name:  fmt.Sprintf("node-%d-%d", i, j),
+				Addr:  &net.UDPAddr{IP: net.IPv4(10, 0, byte(i), byte(j)), Port: 7946},
+				State: Alive,
+				Tags:  map[string]string{"role": "api"},
+			}
+			g.members.stamp(node)
+			g.members.Add(node)
+		}
+	}
+
+	gs[0].sendDigest(addrs[1])
+	messages := 0
+	for {
+		delivered := false
+		for tr, g := range gossipers {
+			select {
+			case data := <-tr.readCh:
+				msg, err := Decode(data)
+				if err != nil {
+					t.Fatalf("failed to decode message: %v", err)
+				}
+				if msg.Type != Digest {
+					messages++
+					if len(data) > DefaultGossipPacketSize {
+						t.Errorf("Expected messages of at most %d bytes, got %d", DefaultGossipPacketSize, len(data))
+					}
+				}
+				g.handleMessage(data)
+				delivered = true
+			default:
+			}
+		}
+		if !delivered {
+			break
+		}
+	}
+	if messages < 2 {
+		t.Errorf("Expected the reply to be split, got %d messages", messages)
+	}
+	for _, g := range gs {
+		if n := len(g.members.All()); n != 402 {
+			t.Errorf("Expected both gossipers and their 400 members, got %d", n)
+		}
+	}
+}
+
+func mustMarshal(t testing.TB, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	return data
+}
+
+// syncLists returns two membership lists of n members, identical except for
+// changed records that are newer in the first.
+func syncLists(n, changed int) (*MembershipList, *MembershipList) {
+	local, remote := NewMembershipList(), NewMembershipList()
+	for i := 0; i < n; i++ {
+		node := &Node{
+			Name:  fmt.Sprintf("node-%d", i),
+			Addr:  &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 7946},
+			State: Alive,
+			Tags:  map[string]string{"role": "api", "zone": "eu-west-1a", "version": "1.4.2"},
+		}
+		local.stamp(node)
+		c := *node
+		local.Add(node)
+		remote.Add(&c)
+	}
+	i := 0
+	for _, node := range local.All() {
+		if i == changed {
+			break
+		}
+		local.update(node, local.stamp)
+		i++
+	}
+	return local, remote
+}
+
+// BenchmarkSync compares the bytes one anti-entropy round puts on the wire
+// with a full-state Sync and with digest reconciliation, for a cluster of
+// 1000 members of which a few have changed.
+func BenchmarkSync(b *testing.B) {
+	for _, changed := range []int{0, 10, 100} {
+		local, remote := syncLists(1000, changed)
+
+		b.Run(fmt.Sprintf("Full/changed=%d", changed), func(b *testing.B) {
+			var bytes int
+			for i := 0; i < b.N; i++ {
+				msg, err := (&Message{Type: Sync, Payload: mustMarshal(b, local.snapshot())}).Encode()
+				if err != nil {
+					b.Fatal(err)
+				}
+				bytes = len(msg)
+			}
+			b.ReportMetric(float64(bytes), "bytes/round")
+		})
+
+		b.Run(fmt.Sprintf("Digest/changed=%d", changed), func(b *testing.B) {
+			var bytes int
+			for i := 0; i < b.N; i++ {
+				// The remote side starts the round, so the reply carries
+				// the changed records.
+				d, err := (&Message{Type: Digest, Payload: mustMarshal(b, &digest{From: "r", Entries: remote.digest()})}).Encode()
+				if err != nil {
+					b.Fatal(err)
+				}
+				bytes = len(d)
+				newer, wanted := local.reconcile(remote.digest())
+				if len(newer) > 0 || len(wanted) > 0 {
+					reply, err := (&Message{Type: DigestReply, Payload: mustMarshal(b, &digestReply{From: "l", Nodes: newer, Request: wanted})}).Encode()
+					if err != nil {
+						b.Fatal(err)
+					}
+					bytes += len(reply)
+				}
+			}
+			b.ReportMetric(float64(bytes), "bytes/round")
+		})
+	}
+}
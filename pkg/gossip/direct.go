@@ -0,0 +1,360 @@
+package gossip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrUnknownNode is returned when a destination does not name a current
+// member.
+var ErrUnknownNode = errors.New("unknown node")
+
+// ErrNoAck is returned by SendReliable when the destination did not
+// acknowledge the message after every attempt.
+var ErrNoAck = errors.New("message not acknowledged")
+
+// MessageHandler is called with every message sent to the local node with
+// SendTo or SendReliable. from is the sender's node name, or its address if
+// it has none. It is called from the gossiper's receive goroutine, for
+// messages read from streams too, so it should return quickly, and must not
+// retain payload after returning.
+type MessageHandler func(from string, payload []byte)
+
+// direct is the payload of a Direct message.
+type direct struct {
+	// ID identifies the message for de-duplication of retries. It is only
+	// set on reliable messages.
+	ID string `json:"id,omitempty"`
+	// Seq is the sequence number the receiver acknowledges. Zero means no
+	// acknowledgement is wanted.
+	Seq     uint32 `json:"seq,omitempty"`
+	From    string `json:"from"`
+	Name    string `json:"name,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// SendTo sends payload to a single member, identified by node name or
+// advertised address, in one best-effort packet. It fails with
+// ErrUnknownNode if no such member is known, and with ErrMessageTooLarge if
+// payload exceeds the WithMaxDirectSize limit.
+func (g *Gossiper) SendTo(node string, payload []byte) error {
+	if err := g.checkDirectSize(payload); err != nil {
+		return err
+	}
+	addr, err := g.resolveMember(node)
+	if err != nil {
+		return err
+	}
+	return g.sendDirect(&direct{
+		From:    g.self.Addr.String(),
+		Name:    g.name,
+		Payload: payload,
+	}, addr)
+}
+
+// SendReliable sends payload to a single member, identified by node name or
+// advertised address, and waits for it to be acknowledged. If the transport is
+// a StreamTransport, such as UDPTransport, each attempt sends the message over
+// a stream of its own and reads the acknowledgement from it; otherwise each
+// attempt is a single packet, like SendTo's. Each attempt waits for the
+// configured timeout before the message is sent again, up to the configured
+// number of attempts. The receiver delivers the message to its handler at
+// most once, however many attempts arrive.
+//
+// It returns ErrMessageTooLarge if payload exceeds the WithMaxDirectSize
+// limit, ErrNoAck if every attempt went unacknowledged, ctx.Err() if ctx is
+// done first, or ErrStopped if the gossiper is stopped.
+func (g *Gossiper) SendReliable(ctx context.Context, node string, payload []byte) error {
+	if err := g.checkDirectSize(payload); err != nil {
+		return err
+	}
+	addr, err := g.resolveMember(node)
+	if err != nil {
+		return err
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	msg := &direct{
+		ID:      hex.EncodeToString(id[:]),
+		From:    g.self.Addr.String(),
+		Name:    g.name,
+		Payload: payload,
+	}
+	if st, ok := g.transport.(StreamTransport); ok {
+		return g.sendReliableStream(ctx, st, node, addr, msg)
+	}
+
+	seq, reply, done := g.expectReply(addr)
+	defer done()
+	msg.Seq = seq
+	for attempt := 0; attempt < g.reliableAttempts; attempt++ {
+		if err := g.sendDirect(msg, addr); err != nil {
+			return err
+		}
+		timer := time.NewTimer(g.reliableTimeout)
+		select {
+		case <-reply:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-g.stop:
+			timer.Stop()
+			return ErrStopped
+		}
+	}
+	return fmt.Errorf("%w by %s after %d attempts", ErrNoAck, node, g.reliableAttempts)
+}
+
+// sendReliableStream makes the attempts of SendReliable over streams. An
+// attempt that fails early, such as on a refused connection, still waits out
+// its timeout before the next one.
+func (g *Gossiper) sendReliableStream(ctx context.Context, st StreamTransport, node, addr string, msg *direct) error {
+	for attempt := 0; attempt < g.reliableAttempts; attempt++ {
+		start := time.Now()
+		if err := g.streamDirect(ctx, st, msg, addr); err == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		timer := time.NewTimer(g.reliableTimeout - time.Since(start))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-g.stop:
+			timer.Stop()
+			return ErrStopped
+		}
+	}
+	return fmt.Errorf("%w by %s after %d attempts", ErrNoAck, node, g.reliableAttempts)
+}
+
+// streamDirect sends a direct message over a new stream to addr and waits for
+// its acknowledgement on the same stream, for at most the reliable timeout.
+func (g *Gossiper) streamDirect(ctx context.Context, st StreamTransport, d *direct, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, g.reliableTimeout)
+	defer cancel()
+	conn, err := st.DialStream(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	data, err := (&Message{Type: Direct, Payload: payload, Label: g.label}).Encode()
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(conn, data); err != nil {
+		return err
+	}
+	data, err = readFrame(conn, g.maxStreamFrame())
+	if err != nil {
+		return err
+	}
+	msg, err := Decode(data)
+	if err != nil || msg.Type != Ack {
+		return errors.New("unexpected reply to a stream message")
+	}
+	return nil
+}
+
+// resolveMember returns the address of the alive or suspected member with the
+// given node name or address.
+func (g *Gossiper) resolveMember(node string) (string, error) {
+	if _, ok := g.members.Get(node); ok {
+		return node, nil
+	}
+	_, members := g.members.view(false)
+	for _, m := range members {
+		if m.Name == node {
+			return m.Addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownNode, node)
+}
+
+// checkDirectSize rejects payloads too large to send in a direct message.
+func (g *Gossiper) checkDirectSize(payload []byte) error {
+	if len(payload) > g.maxDirectSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, len(payload), g.maxDirectSize)
+	}
+	return nil
+}
+
+func (g *Gossiper) sendDirect(d *direct, addr string) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return g.send(&Message{Type: Direct, Payload: data}, addr)
+}
+
+// handleDirect acknowledges a direct message if asked to, and delivers it to
+// the handler unless it is a retry of a message already delivered.
+func (g *Gossiper) handleDirect(payload []byte) {
+	var d direct
+	if err := json.Unmarshal(payload, &d); err != nil || d.From == "" {
+		g.malformed.Add(1)
+		return
+	}
+
+	if d.Seq != 0 {
+		data, err := json.Marshal(&ack{Seq: d.Seq, From: g.self.Addr.String()})
+		if err == nil {
+			g.send(&Message{Type: Ack, Payload: data}, d.From)
+		}
+	}
+	g.deliverDirect(&d)
+}
+
+// deliverDirect passes a direct message to the handler unless it is a retry
+// of a message already delivered.
+func (g *Gossiper) deliverDirect(d *direct) {
+	if d.ID != "" && !g.seenDirect.add(d.ID) {
+		return
+	}
+	if g.messageHandler == nil {
+		return
+	}
+	from := d.Name
+	if from == "" {
+		from = d.From
+	}
+	g.messageHandler(from, d.Payload)
+}
+
+// streamedDirect is a direct message read from a stream, handed to the
+// receive goroutine. done is closed once it has been delivered.
+type streamedDirect struct {
+	msg  direct
+	done chan struct{}
+}
+
+// acceptStreams handles the streams other members open until the gossiper is
+// stopped.
+func (g *Gossiper) acceptStreams(st StreamTransport) {
+	defer g.wg.Done()
+	for {
+		select {
+		case conn := <-st.Streams():
+			if conn == nil {
+				continue
+			}
+			g.wg.Add(1)
+			go g.handleStream(conn)
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// handleStream reads one direct message from a stream, has the receive
+// goroutine deliver it, and acknowledges it on the stream. The whole exchange
+// is bounded by the reliable timeout.
+func (g *Gossiper) handleStream(conn net.Conn) {
+	defer g.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(g.reliableTimeout))
+
+	data, err := readFrame(conn, g.maxStreamFrame())
+	if err != nil {
+		return
+	}
+	msg, err := Decode(data)
+	if err != nil {
+		g.malformed.Add(1)
+		return
+	}
+	if !g.acceptLabel(msg.Label) {
+		g.labelMismatch.Add(1)
+		return
+	}
+	s := &streamedDirect{done: make(chan struct{})}
+	if msg.Type != Direct || json.Unmarshal(msg.Payload, &s.msg) != nil || s.msg.From == "" {
+		g.malformed.Add(1)
+		return
+	}
+	if len(s.msg.Payload) > g.maxDirectSize {
+		g.malformed.Add(1)
+		return
+	}
+
+	select {
+	case g.streamed <- s:
+	case <-g.stop:
+		return
+	}
+	select {
+	case <-s.done:
+	case <-g.stop:
+		return
+	}
+
+	payload, err := json.Marshal(&ack{From: g.self.Addr.String()})
+	if err != nil {
+		return
+	}
+	if data, err = (&Message{Type: Ack, Payload: payload, Label: g.label}).Encode(); err == nil {
+		writeFrame(conn, data)
+	}
+}
+
+// maxStreamFrame returns the largest frame accepted from a stream: a direct
+// message whose payload is at the size limit, base64-encoded twice over, with
+// room to spare for its other fields.
+func (g *Gossiper) maxStreamFrame() int {
+	return 2*g.maxDirectSize + 4096
+}
+
+// writeFrame writes data to w behind its length as a 4-byte big-endian
+// integer.
+func writeFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame, refusing frames longer than
+// limit.
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if int64(n) > int64(limit) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, n, limit)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,183 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// messageRecorder collects the direct messages delivered to a handler.
+type messageRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *messageRecorder) handle(from string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, from+": "+string(payload))
+}
+
+func (r *messageRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func startDirectPair(t *testing.T, network *mockNetwork, addrs []string) ([]*Gossiper, *messageRecorder) {
+	t.Helper()
+	r := &messageRecorder{}
+	names := []string{"alpha", "beta"}
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		g, err := NewGossiper(names[i], addr, addrs, network.Transport(addr),
+			WithMessageHandler(r.handle), WithReliableSend(4, 50*time.Millisecond))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		t.Cleanup(g.Stop)
+		gossipers = append(gossipers, g)
+	}
+	waitFor(t, time.Second, "node names to propagate", func() bool {
+		_, err := gossipers[0].resolveMember("beta")
+		return err == nil
+	})
+	return gossipers, r
+}
+
+func TestGossiper_SendTo(t *testing.T) {
+	network := newMockNetwork()
+	gossipers, r := startDirectPair(t, network, []string{"127.0.0.1:7081", "127.0.0.1:7082"})
+
+	if err := gossipers[0].SendTo("beta", []byte("hello")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if err := gossipers[0].SendTo("127.0.0.1:7082", []byte("by address")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	waitFor(t, time.Second, "direct messages", func() bool {
+		return len(r.get()) == 2
+	})
+	if got := r.get(); got[0] != "alpha: hello" || got[1] != "alpha: by address" {
+		t.Errorf("Expected both messages from alpha, got %v", got)
+	}
+
+	if err := gossipers[0].SendTo("gamma", nil); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("Expected ErrUnknownNode, got %v", err)
+	}
+}
+
+func TestGossiper_SendReliable(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7083", "127.0.0.1:7084"}
+	gossipers, r := startDirectPair(t, network, addrs)
+
+	// The first attempts are lost; a retry gets through.
+	network.SetLinkDown(addrs[0], addrs[1], true)
+	time.AfterFunc(80*time.Millisecond, func() {
+		network.SetLinkDown(addrs[0], addrs[1], false)
+	})
+	if err := gossipers[0].SendReliable(context.Background(), "beta", []byte("retried")); err != nil {
+		t.Fatalf("failed to send reliably: %v", err)
+	}
+	if got := r.get(); len(got) != 1 || got[0] != "alpha: retried" {
+		t.Errorf("Expected the message to be delivered once, got %v", got)
+	}
+
+	// Acks are lost, so every attempt arrives but the sender gives up. The
+	// receiver must still deliver the message only once.
+	network.SetLinkDown(addrs[1], addrs[0], true)
+	err := gossipers[0].SendReliable(context.Background(), "beta", []byte("unacked"))
+	if !errors.Is(err, ErrNoAck) {
+		t.Fatalf("Expected ErrNoAck, got %v", err)
+	}
+	if got := r.get(); len(got) != 2 || got[1] != "alpha: unacked" {
+		t.Errorf("Expected the retried message to be delivered once, got %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := gossipers[0].SendReliable(ctx, "beta", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestGossiper_DirectSize checks that payloads up to the default limit get
+// through the UDP transport, and that larger ones are refused up front.
+func TestGossiper_DirectSize(t *testing.T) {
+	addrs := []string{"127.0.0.1:7106", "127.0.0.1:7107"}
+	r := &messageRecorder{}
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		tr, err := NewUDPTransport(addr)
+		if err != nil {
+			t.Fatalf("failed to create transport: %v", err)
+		}
+		defer tr.Stop()
+		g, err := NewGossiper(addr, addr, addrs, tr, WithMessageHandler(r.handle))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	payload := bytes.Repeat([]byte{0xff}, DefaultMaxDirectSize)
+	if err := gossipers[0].SendReliable(context.Background(), addrs[1], payload); err != nil {
+		t.Fatalf("failed to send a payload at the limit: %v", err)
+	}
+	if got := r.get(); len(got) != 1 || len(got[0]) != len(addrs[0]+": ")+DefaultMaxDirectSize {
+		t.Errorf("Expected the payload to be delivered whole, got %d messages", len(got))
+	}
+
+	payload = append(payload, 0)
+	if err := gossipers[0].SendTo(addrs[1], payload); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge from SendTo, got %v", err)
+	}
+	if err := gossipers[0].SendReliable(context.Background(), addrs[1], payload); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge from SendReliable, got %v", err)
+	}
+}
+
+// TestGossiper_SendReliableStream checks that SendReliable goes over the UDP
+// transport's streams, which carry payloads no datagram could, and that it
+// gives up once the destination stops answering.
+func TestGossiper_SendReliableStream(t *testing.T) {
+	addrs := []string{"127.0.0.1:7120", "127.0.0.1:7121"}
+	r := &messageRecorder{}
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		tr, err := NewUDPTransport(addr)
+		if err != nil {
+			t.Fatalf("failed to create transport: %v", err)
+		}
+		defer tr.Stop()
+		g, err := NewGossiper(addr, addr, addrs, tr, WithMessageHandler(r.handle),
+			WithMaxDirectSize(256*1024), WithReliableSend(2, 200*time.Millisecond))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	payload := bytes.Repeat([]byte{0xff}, 128*1024)
+	if err := gossipers[0].SendReliable(context.Background(), addrs[1], payload); err != nil {
+		t.Fatalf("failed to send reliably: %v", err)
+	}
+	if got := r.get(); len(got) != 1 || len(got[0]) != len(addrs[0]+": ")+len(payload) {
+		t.Errorf("Expected the payload to be delivered whole, got %d messages", len(got))
+	}
+
+	gossipers[1].Stop()
+	err := gossipers[0].SendReliable(context.Background(), addrs[1], []byte("lost"))
+	if !errors.Is(err, ErrNoAck) {
+		t.Errorf("Expected ErrNoAck, got %v", err)
+	}
+}
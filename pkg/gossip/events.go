@@ -0,0 +1,248 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserEvent is a named event delivered to every member of the cluster.
+type UserEvent struct {
+	// LTime is the Lamport time at which the event was emitted. Events of
+	// the same name with a higher time supersede earlier ones.
+	LTime   uint64 `json:"ltime"`
+	Name    string `json:"name"`
+	Payload []byte `json:"payload,omitempty"`
+	// Coalesce allows receivers to deliver only the latest event of this
+	// name within the coalescing window.
+	Coalesce bool `json:"coalesce,omitempty"`
+}
+
+// EventHandler is called with every user event, including those emitted
+// locally. It is called from the gossiper's goroutines, so it should return
+// quickly.
+type EventHandler func(UserEvent)
+
+// eventSlot holds the events seen at one Lamport time.
+type eventSlot struct {
+	ltime  uint64
+	events []UserEvent
+}
+
+// eventBuffer remembers the events of the most recent Lamport times, one slot
+// per time, to de-duplicate events and replay them to joining members.
+type eventBuffer struct {
+	mu    sync.Mutex
+	slots []eventSlot
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	return &eventBuffer{slots: make([]eventSlot, size)}
+}
+
+// add records e and reports whether it is new. Events older than the buffer
+// relative to now, the current time of the clock, are rejected since they
+// can no longer be told apart from duplicates.
+func (b *eventBuffer) add(e UserEvent, now uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := uint64(len(b.slots))
+	if now > size && e.LTime < now-size {
+		return false
+	}
+
+	slot := &b.slots[e.LTime%size]
+	if slot.ltime != e.LTime {
+		if slot.ltime > e.LTime && len(slot.events) > 0 {
+			// The slot already holds a newer time.
+			return false
+		}
+		slot.ltime = e.LTime
+		slot.events = nil
+	}
+	for _, seen := range slot.events {
+		if seen.Name == e.Name && bytes.Equal(seen.Payload, e.Payload) {
+			return false
+		}
+	}
+	slot.events = append(slot.events, e)
+	return true
+}
+
+// recent returns the buffered events, oldest first.
+func (b *eventBuffer) recent() []UserEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []UserEvent
+	for _, slot := range b.slots {
+		events = append(events, slot.events...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LTime < events[j].LTime
+	})
+	return events
+}
+
+// eventCoalescer delays coalescable events for a window and then delivers
+// only the latest event of each name.
+type eventCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]UserEvent
+	// latest is the time of the newest event delivered per name, so that an
+	// older event arriving late is not delivered after a newer one.
+	latest map[string]uint64
+	timer  *time.Timer
+}
+
+// UserEvent emits a named event to every member of the cluster, including
+// this one. If coalesce is true, members that have an event coalescing window
+// configured deliver only the latest event of this name within the window.
+// It fails with ErrBroadcastTooLarge if name and payload together exceed the
+// configured broadcast size limit.
+func (g *Gossiper) UserEvent(name string, payload []byte, coalesce bool) error {
+	if size := len(name) + len(payload); size > g.maxBroadcastSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBroadcastTooLarge, size, g.maxBroadcastSize)
+	}
+
+	e := UserEvent{
+		LTime:    g.eventClock.Increment(),
+		Name:     name,
+		Payload:  append([]byte(nil), payload...),
+		Coalesce: coalesce,
+	}
+	g.events.add(e, g.eventClock.Time())
+	if err := g.queueEvent(e); err != nil {
+		return err
+	}
+	g.deliverEvent(e)
+	return nil
+}
+
+// EventTime returns the current time of the cluster's event clock.
+func (g *Gossiper) EventTime() uint64 {
+	return g.eventClock.Time()
+}
+
+func (g *Gossiper) queueEvent(e UserEvent) error {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	msg, err := (&Message{Type: Event, Payload: data}).Encode()
+	if err != nil {
+		return err
+	}
+	// A coalescable event replaces the older one of its name still in the
+	// queue, as receivers would only deliver the latest anyway. Other events
+	// are all delivered, so only a copy of the same event is replaced.
+	key := fmt.Sprintf("event:%s:%d", e.Name, e.LTime)
+	if e.Coalesce {
+		key = "event:" + e.Name
+	}
+	g.broadcasts.queue(&broadcast{
+		key:    key,
+		order:  e.LTime,
+		msg:    msg,
+		sentTo: make(map[string]struct{}),
+	})
+	g.kickGossip()
+	return nil
+}
+
+// handleEvent processes an event received through gossip.
+func (g *Gossiper) handleEvent(payload []byte) {
+	var e UserEvent
+	if err := json.Unmarshal(payload, &e); err != nil || len(e.Name)+len(e.Payload) > g.maxBroadcastSize {
+		g.malformed.Add(1)
+		return
+	}
+	if g.receiveEvent(e) {
+		g.queueEvent(e)
+	}
+}
+
+// receiveEvent witnesses the time of a remote event and delivers it if it is
+// new.
+func (g *Gossiper) receiveEvent(e UserEvent) bool {
+	now := g.eventClock.Time()
+	g.eventClock.Witness(e.LTime)
+	if !g.events.add(e, now) {
+		return false
+	}
+	g.deliverEvent(e)
+	return true
+}
+
+// replayEvents processes the recent events received in a push-pull exchange,
+// and moves the clock past the sender's.
+func (g *Gossiper) replayEvents(ltime uint64, events []UserEvent) {
+	if ltime > 0 {
+		g.eventClock.Witness(ltime - 1)
+	}
+	for _, e := range events {
+		if len(e.Name)+len(e.Payload) > g.maxBroadcastSize {
+			continue
+		}
+		g.receiveEvent(e)
+	}
+}
+
+// deliverEvent hands an event to the handler, through the coalescer if the
+// event allows it.
+func (g *Gossiper) deliverEvent(e UserEvent) {
+	if g.eventHandler == nil {
+		return
+	}
+	if !e.Coalesce || g.eventCoalesce <= 0 {
+		g.eventHandler(e)
+		return
+	}
+
+	c := &g.coalescer
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.LTime <= c.latest[e.Name] {
+		return
+	}
+	if p, ok := c.pending[e.Name]; ok && p.LTime >= e.LTime {
+		return
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]UserEvent)
+		c.latest = make(map[string]uint64)
+	}
+	c.pending[e.Name] = e
+	if c.timer == nil {
+		c.timer = time.AfterFunc(g.eventCoalesce, g.flushEvents)
+	}
+}
+
+// flushEvents delivers the coalesced events, oldest first.
+func (g *Gossiper) flushEvents() {
+	c := &g.coalescer
+	c.mu.Lock()
+	events := make([]UserEvent, 0, len(c.pending))
+	for name, e := range c.pending {
+		events = append(events, e)
+		c.latest[name] = e.LTime
+	}
+	c.pending = make(map[string]UserEvent)
+	c.timer = nil
+	c.mu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].LTime < events[j].LTime
+	})
+	for _, e := range events {
+		select {
+		case <-g.stop:
+			return
+		default:
+		}
+		g.eventHandler(e)
+	}
+}
@@ -0,0 +1,208 @@
+package gossip
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder collects the user events delivered to a handler.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []UserEvent
+}
+
+func (r *eventRecorder) handle(e UserEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) get() []UserEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]UserEvent(nil), r.events...)
+}
+
+func TestEventBuffer(t *testing.T) {
+	b := newEventBuffer(4)
+
+	e := UserEvent{LTime: 5, Name: "deploy", Payload: []byte("v1")}
+	if !b.add(e, 5) {
+		t.Fatal("Expected a new event to be accepted")
+	}
+	if b.add(e, 5) {
+		t.Error("Expected a duplicate event to be rejected")
+	}
+	if !b.add(UserEvent{LTime: 5, Name: "deploy", Payload: []byte("v2")}, 5) {
+		t.Error("Expected a different event at the same time to be accepted")
+	}
+	if b.add(UserEvent{LTime: 1, Name: "old"}, 8) {
+		t.Error("Expected an event older than the buffer to be rejected")
+	}
+	if !b.add(UserEvent{LTime: 7, Name: "restart"}, 8) {
+		t.Error("Expected a recent event to be accepted")
+	}
+
+	recent := b.recent()
+	if len(recent) != 3 || recent[0].LTime != 5 || recent[2].LTime != 7 {
+		t.Errorf("Expected 3 events ordered by time, got %v", recent)
+	}
+}
+
+func TestGossiper_UserEvent(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7051", "127.0.0.1:7052", "127.0.0.1:7053"}
+
+	recorders := make([]*eventRecorder, len(addrs))
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		recorders[i] = &eventRecorder{}
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), WithEventHandler(recorders[i].handle))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	if err := gossipers[0].UserEvent("deploy", []byte("v42"), false); err != nil {
+		t.Fatalf("failed to emit event: %v", err)
+	}
+	waitFor(t, 2*time.Second, "the event to reach every member", func() bool {
+		for _, r := range recorders {
+			if len(r.get()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	for i, r := range recorders {
+		events := r.get()
+		if len(events) != 1 || events[0].Name != "deploy" || string(events[0].Payload) != "v42" {
+			t.Errorf("Member %d: expected deploy=v42 once, got %v", i, events)
+		}
+	}
+	for i, g := range gossipers[1:] {
+		if g.EventTime() < 1 {
+			t.Errorf("Member %d did not witness the event's time", i+1)
+		}
+	}
+}
+
+func TestGossiper_UserEventCoalesce(t *testing.T) {
+	r := &eventRecorder{}
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithEventHandler(r.handle), WithEventCoalesce(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if err := g.UserEvent("deploy", []byte(v), true); err != nil {
+			t.Fatalf("failed to emit event: %v", err)
+		}
+	}
+	if err := g.UserEvent("restart", nil, false); err != nil {
+		t.Fatalf("failed to emit event: %v", err)
+	}
+	if events := r.get(); len(events) != 1 || events[0].Name != "restart" {
+		t.Fatalf("Expected only the uncoalesced event before the window ends, got %v", events)
+	}
+
+	waitFor(t, time.Second, "coalesced events", func() bool {
+		return len(r.get()) == 2
+	})
+	if events := r.get(); events[1].Name != "deploy" || string(events[1].Payload) != "v3" {
+		t.Errorf("Expected only the latest deploy event, got %v", events)
+	}
+
+	// An earlier event of the same name arriving late is superseded.
+	late, err := json.Marshal(&UserEvent{LTime: 2, Name: "deploy", Payload: []byte("v0"), Coalesce: true})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	g.handleEvent(late)
+	time.Sleep(200 * time.Millisecond)
+	if events := r.get(); len(events) != 2 {
+		t.Errorf("Expected the late event to be dropped, got %v", events)
+	}
+}
+
+// TestGossiper_UserEventQueue checks that a busy emitter's events retire from
+// every member's queue, and that queued coalescable events replace each other.
+func TestGossiper_UserEventQueue(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport())
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		g.UserEvent("deploy", []byte{byte(i)}, true)
+	}
+	if n := g.broadcasts.len(); n != 1 {
+		t.Errorf("Expected the coalescable events to replace each other, got %d queued", n)
+	}
+
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7114", "127.0.0.1:7115", "127.0.0.1:7116"}
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), WithGossip(20*time.Millisecond, 3))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+	for i := 0; i < 200; i++ {
+		if err := gossipers[i%len(gossipers)].UserEvent("tick", []byte{byte(i)}, false); err != nil {
+			t.Fatalf("failed to emit event: %v", err)
+		}
+	}
+	waitFor(t, 5*time.Second, "the queues to drain", func() bool {
+		for _, g := range gossipers {
+			if g.broadcasts.len() > 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestGossiper_UserEventReplay(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7054", "127.0.0.1:7055"}
+
+	first, err := NewGossiper(addrs[0], addrs[0], nil, network.Transport(addrs[0]))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	first.Start()
+	defer first.Stop()
+	for _, v := range []string{"v1", "v2"} {
+		if err := first.UserEvent("deploy", []byte(v), false); err != nil {
+			t.Fatalf("failed to emit event: %v", err)
+		}
+	}
+
+	// A node joining later receives the recent events in the join
+	// push-pull.
+	r := &eventRecorder{}
+	joiner, err := NewGossiper(addrs[1], addrs[1], addrs[:1], network.Transport(addrs[1]), WithEventHandler(r.handle))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	joiner.Start()
+	defer joiner.Stop()
+
+	waitFor(t, time.Second, "replayed events", func() bool {
+		return len(r.get()) == 2
+	})
+	if joiner.EventTime() < first.EventTime() {
+		t.Errorf("Expected the joiner's clock to reach %d, got %d", first.EventTime(), joiner.EventTime())
+	}
+}
@@ -1,10 +1,13 @@
 package gossip
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
-	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,45 +17,542 @@ type Gossiper struct {
 	members   *MembershipList
 	transport Transport
 	stop      chan struct{}
+	stopOnce  sync.Once
 	self      *Node
 	wg        sync.WaitGroup
+
+	advertise       string
+	label           string
+	acceptUnlabeled bool
+	seeds           []string
+	delegate        Delegate
+
+	probeInterval      time.Duration
+	probeTimeout       time.Duration
+	suspicionTimeout   time.Duration
+	tombstoneRetention time.Duration
+
+	reconnectInterval time.Duration
+	reconnectTimeout  time.Duration
+	reconnectMaxAge   time.Duration
+	maxMetadataSize   int
+
+	pushPullInterval time.Duration
+	pushPullTimeout  time.Duration
+
+	gossipInterval      time.Duration
+	gossipNodes         int
+	gossipPacketSize    int
+	retransmitMult      int
+	propagationFraction float64
+	broadcasts          broadcastQueue
+	gossipKick          chan struct{}
+
+	watchCoalesce time.Duration
+
+	maxBroadcastSize int
+	broadcastHandler BroadcastHandler
+	seenBroadcasts   seenSet
+
+	eventClock    LamportClock
+	events        *eventBuffer
+	eventHandler  EventHandler
+	eventCoalesce time.Duration
+	coalescer     eventCoalescer
+	eventBuffer   int
+
+	queryHandler     QueryHandler
+	queryTimeoutMult int
+	seenQueries      seenSet
+	queriesMu        sync.Mutex
+	queries          map[string]*QueryResponse
+
+	messageHandler   MessageHandler
+	reliableAttempts int
+	reliableTimeout  time.Duration
+	maxDirectSize    int
+	seenDirect       seenSet
+	// streamed carries the direct messages read from streams to the
+	// receive goroutine.
+	streamed chan *streamedDirect
+
+	skewThreshold    time.Duration
+	skewHandler      SkewWarningHandler
+	skewWarned       skewWarnings
+	skewWarningCount atomic.Uint64
+
+	seq       atomic.Uint32
+	pendingMu sync.Mutex
+	pending   map[uint32]pendingReply
+
+	malformed     atomic.Uint64
+	labelMismatch atomic.Uint64
+	queryDropped  atomic.Uint64
 }
 
-// NewGossiper creates a new gossiper.
-func NewGossiper(name, listenAddr string, peers []string, transport Transport) (*Gossiper, error) {
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return nil, err
+const (
+	// DefaultProbeInterval is how often a random member is pinged when no
+	// WithProbeInterval option is given.
+	DefaultProbeInterval = 1 * time.Second
+	// DefaultProbeTimeout is how long a ping waits for its Ack when no
+	// WithProbeTimeout option is given.
+	DefaultProbeTimeout = 500 * time.Millisecond
+	// DefaultSuspicionTimeout is how long a member stays suspected before it
+	// is declared dead when no WithSuspicionTimeout option is given.
+	DefaultSuspicionTimeout = 5 * time.Second
+	// DefaultTombstoneRetention is how long dead and departed members are
+	// remembered when no WithTombstoneRetention option is given.
+	DefaultTombstoneRetention = 1 * time.Hour
+	// DefaultReconnectInterval is how often a dead member is contacted when
+	// no WithReconnect option is given.
+	DefaultReconnectInterval = 10 * time.Second
+	// DefaultReconnectTimeout is how long a reconnect attempt waits for the
+	// dead member to answer when no WithReconnect option is given.
+	DefaultReconnectTimeout = 2 * time.Second
+	// DefaultReconnectMaxAge is how long after its death a member is still
+	// contacted when no WithReconnect option is given.
+	DefaultReconnectMaxAge = 30 * time.Minute
+	// DefaultPushPullInterval is how often a full state exchange is run with
+	// a random member in clusters of up to 32 members when no WithPushPull
+	// option is given.
+	DefaultPushPullInterval = 30 * time.Second
+	// DefaultPushPullTimeout is how long a periodic push-pull exchange waits
+	// for the answer when no WithPushPull option is given.
+	DefaultPushPullTimeout = 2 * time.Second
+	// DefaultMaxMetadataSize is the limit on a node's tags and raw metadata
+	// when no WithMaxMetadataSize option is given.
+	DefaultMaxMetadataSize = 512
+	// DefaultGossipInterval is how often queued broadcasts are gossiped when
+	// no WithGossip option is given.
+	DefaultGossipInterval = 200 * time.Millisecond
+	// DefaultGossipNodes is the number of random members each gossip round
+	// is sent to when no WithGossip option is given.
+	DefaultGossipNodes = 3
+	// DefaultGossipPacketSize is the maximum size of an encoded gossip packet
+	// in bytes when no WithGossipPacketSize option is given.
+	DefaultGossipPacketSize = 1400
+	// DefaultRetransmitMult is the retransmission multiplier when no
+	// WithRetransmitMult option is given.
+	DefaultRetransmitMult = 4
+	// DefaultWatchCoalesce is how long WaitForChange and Watch gather further
+	// changes after the first one when no WithWatchCoalesce option is given.
+	DefaultWatchCoalesce = 50 * time.Millisecond
+	// DefaultMaxBroadcastSize is the maximum size of a user broadcast's name
+	// and payload in bytes when no WithMaxBroadcastSize option is given.
+	DefaultMaxBroadcastSize = 512
+	// DefaultEventBufferSize is the number of recent Lamport times whose
+	// user events are remembered when no WithEventBufferSize option is
+	// given.
+	DefaultEventBufferSize = 64
+	// DefaultQueryTimeoutMult is the query timeout multiplier when no
+	// WithQueryTimeoutMult option is given.
+	DefaultQueryTimeoutMult = 16
+	// DefaultReliableAttempts is the number of times SendReliable sends a
+	// message when no WithReliableSend option is given.
+	DefaultReliableAttempts = 3
+	// DefaultReliableTimeout is how long SendReliable waits for an
+	// acknowledgement per attempt when no WithReliableSend option is given.
+	DefaultReliableTimeout = 500 * time.Millisecond
+	// DefaultClockSkewThreshold is the estimated clock offset above which a
+	// member is reported when no WithClockSkewThreshold option is given.
+	DefaultClockSkewThreshold = time.Second
+	// DefaultMaxDirectSize is the maximum size of a SendTo or SendReliable
+	// payload in bytes when no WithMaxDirectSize option is given.
+	DefaultMaxDirectSize = 16 * 1024
+)
+
+// ErrMetadataTooLarge is returned when local metadata exceeds the configured
+// size limit.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+// ErrBroadcastTooLarge is returned when a user broadcast exceeds the
+// configured size limit.
+var ErrBroadcastTooLarge = errors.New("broadcast too large")
+
+// ErrMessageTooLarge is returned by SendTo and SendReliable when a payload
+// exceeds the configured size limit.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrStopped is returned by calls that were waiting on a Gossiper when it was
+// stopped.
+var ErrStopped = errors.New("gossiper stopped")
+
+// Option configures a Gossiper.
+type Option func(*Gossiper)
+
+// WithAdvertiseAddr sets the address announced to peers, for example the
+// public address of a container behind NAT. It may be a "host:port" pair or a
+// bare host, in which case the port of the listen address is used. Without
+// it, the listen address is advertised, or a private interface address if the
+// listen address is a wildcard such as 0.0.0.0 or [::].
+func WithAdvertiseAddr(addr string) Option {
+	return func(g *Gossiper) {
+		g.advertise = addr
 	}
+}
 
-	self := &Node{
-		Addr:  addr,
-		State: Alive,
-		LastUpdated: time.Now(),
+// WithClusterLabel sets the cluster label attached to every outgoing message.
+// Messages carrying a different label are dropped, which keeps clusters that
+// share a network and a key from merging.
+func WithClusterLabel(label string) Option {
+	return func(g *Gossiper) {
+		g.label = label
+	}
+}
+
+// WithAcceptUnlabeled makes a labeled gossiper also accept messages without a
+// label, and a gossiper without a label accept messages with any label. It is
+// meant for migrating a running cluster to a label: enable it on every node,
+// roll the label out to every node, then roll the option back out. Nodes
+// that have the label and nodes still waiting for it hear each other
+// throughout.
+func WithAcceptUnlabeled(accept bool) Option {
+	return func(g *Gossiper) {
+		g.acceptUnlabeled = accept
+	}
+}
+
+// WithProbeInterval sets how often a random member is pinged for failure
+// detection.
+func WithProbeInterval(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.probeInterval = d
+	}
+}
+
+// WithProbeTimeout sets how long a ping waits for an Ack before the pinged
+// member is suspected. It should be shorter than the probe interval.
+func WithProbeTimeout(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.probeTimeout = d
+	}
+}
+
+// WithSuspicionTimeout sets how long a member stays suspected, giving it the
+// chance to refute the suspicion, before it is declared dead.
+func WithSuspicionTimeout(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.suspicionTimeout = d
+	}
+}
+
+// WithTombstoneRetention sets how long dead and departed members are kept as
+// tombstones. While a tombstone exists, older gossip claiming the member is
+// alive is rejected; afterwards the entry is garbage-collected. It should be
+// well above the time gossip takes to reach every member.
+func WithTombstoneRetention(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.tombstoneRetention = d
+	}
+}
+
+// WithReconnect configures gossip to the dead: every interval, a random member
+// that died less than maxAge ago is sent a push-pull exchange, which succeeds
+// if it answers within timeout. This heals partitions in which both sides
+// declared each other dead. maxAge should not exceed the tombstone retention;
+// a zero interval disables reconnection.
+func WithReconnect(interval, timeout, maxAge time.Duration) Option {
+	return func(g *Gossiper) {
+		g.reconnectInterval = interval
+		g.reconnectTimeout = timeout
+		g.reconnectMaxAge = maxAge
+	}
+}
+
+// WithPushPull configures periodic full state synchronization: every
+// interval, the local node and a random member exchange their complete
+// membership lists and application state and both merge what they receive.
+// Above 32 members the interval grows by one interval each time the cluster
+// doubles, which keeps the full state traffic of large clusters bounded. An
+// exchange fails if the member does not answer within timeout. A zero interval
+// disables periodic push-pull.
+func WithPushPull(interval, timeout time.Duration) Option {
+	return func(g *Gossiper) {
+		g.pushPullInterval = interval
+		g.pushPullTimeout = timeout
+	}
+}
+
+// WithMaxMetadataSize sets the limit, in bytes, on the local node's tags and
+// raw metadata combined. Metadata travels in every membership exchange, so it
+// should stay small.
+func WithMaxMetadataSize(n int) Option {
+	return func(g *Gossiper) {
+		g.maxMetadataSize = n
+	}
+}
+
+// WithGossip sets how often queued broadcasts, such as membership and
+// metadata updates, are gossiped and to how many random members per round.
+func WithGossip(interval time.Duration, nodes int) Option {
+	return func(g *Gossiper) {
+		g.gossipInterval = interval
+		g.gossipNodes = nodes
+	}
+}
+
+// WithGossipPacketSize sets the maximum size of a gossip packet in bytes,
+// once encoded. It should stay below the path MTU. A single broadcast larger
+// than the packet still goes out on a packet of its own.
+func WithGossipPacketSize(n int) Option {
+	return func(g *Gossiper) {
+		g.gossipPacketSize = n
+	}
+}
+
+// WithRetransmitMult sets the retransmission multiplier: each broadcast is
+// sent mult * ceil(log10(n+1)) times in a cluster of n members.
+func WithRetransmitMult(mult int) Option {
+	return func(g *Gossiper) {
+		g.retransmitMult = mult
+	}
+}
+
+// WithPropagationFraction makes UpdateMetadata block until the update has
+// been gossiped to the given fraction, between 0 and 1, of the other members.
+// Zero, the default, returns as soon as the update is queued.
+func WithPropagationFraction(f float64) Option {
+	return func(g *Gossiper) {
+		g.propagationFraction = f
+	}
+}
+
+// WithDelegate sets the Delegate through which the application piggybacks
+// its own metadata, messages and state on the gossip protocol.
+func WithDelegate(d Delegate) Option {
+	return func(g *Gossiper) {
+		g.delegate = d
+	}
+}
+
+// WithBroadcastHandler sets the function that receives user broadcasts sent
+// by other members with Broadcast.
+func WithBroadcastHandler(h BroadcastHandler) Option {
+	return func(g *Gossiper) {
+		g.broadcastHandler = h
+	}
+}
+
+// WithMaxBroadcastSize sets the maximum size of a user broadcast's name and
+// payload in bytes. Broadcasts should fit in a single gossip packet.
+func WithMaxBroadcastSize(n int) Option {
+	return func(g *Gossiper) {
+		g.maxBroadcastSize = n
+	}
+}
+
+// WithEventHandler sets the function that receives user events.
+func WithEventHandler(h EventHandler) Option {
+	return func(g *Gossiper) {
+		g.eventHandler = h
+	}
+}
+
+// WithEventCoalesce sets how long coalescable user events are held back so
+// that only the latest event of each name is delivered. Zero, the default,
+// delivers every event immediately.
+func WithEventCoalesce(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.eventCoalesce = d
+	}
+}
+
+// WithEventBufferSize sets how many recent Lamport times of user events are
+// remembered for de-duplication and replay to joining members. Events older
+// than that are dropped. Values below one are ignored.
+func WithEventBufferSize(n int) Option {
+	return func(g *Gossiper) {
+		if n > 0 {
+			g.eventBuffer = n
+		}
+	}
+}
+
+// WithQueryHandler sets the function that answers queries from the cluster.
+func WithQueryHandler(h QueryHandler) Option {
+	return func(g *Gossiper) {
+		g.queryHandler = h
+	}
+}
+
+// WithQueryTimeoutMult sets the default query timeout, which is mult gossip
+// intervals times ceil(log10(n+1)) in a cluster of n members.
+func WithQueryTimeoutMult(mult int) Option {
+	return func(g *Gossiper) {
+		g.queryTimeoutMult = mult
+	}
+}
+
+// WithMessageHandler sets the function that receives messages sent to the
+// local node with SendTo or SendReliable.
+func WithMessageHandler(h MessageHandler) Option {
+	return func(g *Gossiper) {
+		g.messageHandler = h
+	}
+}
+
+// WithMaxDirectSize sets the maximum size of a SendTo or SendReliable payload
+// in bytes. A direct message travels in a single packet, and encoding makes
+// it about 16/9 times the size of its payload, so the limit must stay well
+// below the transport's largest datagram: about 36KB over UDP.
+func WithMaxDirectSize(n int) Option {
+	return func(g *Gossiper) {
+		g.maxDirectSize = n
+	}
+}
+
+// WithClock sets the hybrid logical clock that versions the gossiper's
+// records. Sharing one clock with the application's replicated stores, which
+// are created before the gossiper when they serve as its Delegate, orders
+// their versions consistently with the membership's.
+func WithClock(c *HLC) Option {
+	return func(g *Gossiper) {
+		g.members.clock = c
+	}
+}
+
+// WithReliableSend sets how many times SendReliable sends a message and how
+// long it waits for an acknowledgement after each attempt. Values below one
+// leave the defaults in place.
+func WithReliableSend(attempts int, timeout time.Duration) Option {
+	return func(g *Gossiper) {
+		if attempts > 0 {
+			g.reliableAttempts = attempts
+		}
+		if timeout > 0 {
+			g.reliableTimeout = timeout
+		}
+	}
+}
+
+// WithClockSkewThreshold sets the estimated clock offset above which a member
+// is counted in Stats and reported to the skew warning handler. Zero disables
+// warnings.
+func WithClockSkewThreshold(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.skewThreshold = d
+	}
+}
+
+// WithSkewWarningHandler sets the function called when a member's clock
+// offset exceeds the skew threshold.
+func WithSkewWarningHandler(h SkewWarningHandler) Option {
+	return func(g *Gossiper) {
+		g.skewHandler = h
+	}
+}
+
+// WithWatchCoalesce sets how long WaitForChange and Watch wait after the
+// first change for further ones, so that a burst of updates produces a single
+// view. Zero returns on the first change.
+func WithWatchCoalesce(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.watchCoalesce = d
 	}
+}
+
+// Stats holds message counters and clock skew figures for a Gossiper.
+type Stats struct {
+	// Malformed is the number of received messages that could not be
+	// decoded.
+	Malformed uint64
+	// LabelMismatch is the number of received messages dropped because
+	// their cluster label did not match.
+	LabelMismatch uint64
+	// QueryDropped is the number of query acks and responses dropped
+	// because the reader of their QueryResponse was not keeping up.
+	QueryDropped uint64
+	// SkewWarnings is the number of times a member's estimated clock offset
+	// crossed the skew threshold.
+	SkewWarnings uint64
+	// MaxClockOffset is the largest absolute estimated clock offset among
+	// the current members.
+	MaxClockOffset time.Duration
+	// QueuedBroadcasts is the number of broadcasts waiting to be gossiped.
+	QueuedBroadcasts int
+}
 
+// NewGossiper creates a new gossiper. listenAddr is the address the transport
+// is bound to; IPv4 and IPv6 literals and host names are accepted.
+func NewGossiper(name, listenAddr string, peers []string, transport Transport, opts ...Option) (*Gossiper, error) {
 	g := &Gossiper{
 		name:      name,
 		members:   NewMembershipList(),
 		transport: transport,
 		stop:      make(chan struct{}),
-		self:      self,
+
+		probeInterval:      DefaultProbeInterval,
+		probeTimeout:       DefaultProbeTimeout,
+		suspicionTimeout:   DefaultSuspicionTimeout,
+		tombstoneRetention: DefaultTombstoneRetention,
+		reconnectInterval:  DefaultReconnectInterval,
+		reconnectTimeout:   DefaultReconnectTimeout,
+		reconnectMaxAge:    DefaultReconnectMaxAge,
+		maxMetadataSize:    DefaultMaxMetadataSize,
+		pushPullInterval:   DefaultPushPullInterval,
+		pushPullTimeout:    DefaultPushPullTimeout,
+		gossipInterval:     DefaultGossipInterval,
+		gossipNodes:        DefaultGossipNodes,
+		gossipPacketSize:   DefaultGossipPacketSize,
+		retransmitMult:     DefaultRetransmitMult,
+		gossipKick:         make(chan struct{}, 1),
+		watchCoalesce:      DefaultWatchCoalesce,
+		maxBroadcastSize:   DefaultMaxBroadcastSize,
+		eventBuffer:        DefaultEventBufferSize,
+		queryTimeoutMult:   DefaultQueryTimeoutMult,
+		queries:            make(map[string]*QueryResponse),
+		reliableAttempts:   DefaultReliableAttempts,
+		reliableTimeout:    DefaultReliableTimeout,
+		maxDirectSize:      DefaultMaxDirectSize,
+		streamed:           make(chan *streamedDirect),
+		skewThreshold:      DefaultClockSkewThreshold,
+		pending:            make(map[uint32]pendingReply),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.events = newEventBuffer(g.eventBuffer)
+
+	bind, err := resolveAddr(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := advertiseAddr(bind, g.advertise)
+	if err != nil {
+		return nil, err
 	}
 
-	g.members.Add(self)
+	g.self = &Node{
+		Name:  name,
+		Addr:  addr,
+		State: Alive,
+	}
+	g.members.stamp(g.self)
+	if g.delegate != nil {
+		g.self.Meta = g.delegate.NodeMeta(g.maxMetadataSize)
+		if size := g.self.MetadataSize(); size > g.maxMetadataSize {
+			return nil, fmt.Errorf("%w: %d bytes from delegate, limit %d", ErrMetadataTooLarge, size, g.maxMetadataSize)
+		}
+	}
+	g.members.Add(g.self)
 
 	// Add initial peers
 	for _, peerAddr := range peers {
-		peerUDPAddr, err := net.ResolveUDPAddr("udp", peerAddr)
+		peerUDPAddr, err := resolveAddr(peerAddr)
 		if err != nil {
 			return nil, err
 		}
+		if peerUDPAddr.String() == addr.String() {
+			continue
+		}
+		// Seeds carry no timestamp, so that whatever the seed itself
+		// announces supersedes this placeholder.
 		peerNode := &Node{
 			Addr:  peerUDPAddr,
 			State: Alive,
-			LastUpdated: time.Now(),
 		}
 		g.members.Add(peerNode)
+		g.seeds = append(g.seeds, peerUDPAddr.String())
 	}
 
 	return g, nil
@@ -60,27 +560,238 @@ func NewGossiper(name, listenAddr string, peers []string, transport Transport) (
 
 // Start starts the gossip loops.
 func (g *Gossiper) Start() {
-	g.wg.Add(3)
+	g.wg.Add(4)
 	go g.pingLoop()
 	go g.syncLoop()
+	go g.gossipLoop()
 	go g.listen()
+	if len(g.seeds) > 0 {
+		g.wg.Add(1)
+		go g.join()
+	}
+	if g.reconnectInterval > 0 {
+		g.wg.Add(1)
+		go g.reconnectLoop()
+	}
+	if g.pushPullInterval > 0 {
+		g.wg.Add(1)
+		go g.pushPullLoop()
+	}
+	if st, ok := g.transport.(StreamTransport); ok {
+		g.wg.Add(1)
+		go g.acceptStreams(st)
+	}
 }
 
 // Stop stops the gossip loops.
 func (g *Gossiper) Stop() {
-	close(g.stop)
+	g.stopOnce.Do(func() {
+		close(g.stop)
+	})
 	g.wg.Wait()
 }
 
+// SetTags replaces the tags of the local node and broadcasts the change.
+// Passing nil or an empty map clears them. It fails with ErrMetadataTooLarge
+// if the tags and the raw metadata together exceed the configured limit.
+func (g *Gossiper) SetTags(tags map[string]string) error {
+	copied := copyTags(tags)
+	_, err := g.setMetadata(func(self *Node) {
+		self.Tags = copied
+	}, 0)
+	return err
+}
+
+// UpdateMetadata replaces the tags of the local node, bumps its incarnation
+// and broadcasts the change immediately. If a propagation fraction is
+// configured, it then blocks until the update has been gossiped to that
+// fraction of the other members or ctx is done, returning ctx.Err() in the
+// latter case. The update itself is applied and keeps spreading either way.
+func (g *Gossiper) UpdateMetadata(ctx context.Context, tags map[string]string) error {
+	copied := copyTags(tags)
+	waiter, err := g.setMetadata(func(self *Node) {
+		self.Tags = copied
+	}, g.propagationFraction)
+	if err != nil || waiter == nil {
+		return err
+	}
+
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		g.broadcasts.cancel(waiter)
+		return ctx.Err()
+	case <-g.stop:
+		return ErrStopped
+	}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// SetMeta replaces the raw metadata of the local node. Passing nil clears it.
+// It fails with ErrMetadataTooLarge if the tags and the raw metadata together
+// exceed the configured limit.
+func (g *Gossiper) SetMeta(meta []byte) error {
+	copied := append([]byte(nil), meta...)
+	_, err := g.setMetadata(func(self *Node) {
+		self.Meta = copied
+	}, 0)
+	return err
+}
+
 // SetPayload sets the payload for the local node.
+//
+// Deprecated: Use SetTags or SetMeta.
 func (g *Gossiper) SetPayload(payload string) {
-	g.self.Payload = payload
-	g.self.LastUpdated = time.Now()
+	g.SetMeta([]byte(payload))
+}
+
+// Tags returns a copy of the local node's tags.
+func (g *Gossiper) Tags() map[string]string {
+	g.members.mu.RLock()
+	defer g.members.mu.RUnlock()
+	tags := make(map[string]string, len(g.self.Tags))
+	for k, v := range g.self.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// setMetadata applies set to the local node under the membership lock if the
+// resulting metadata fits within the size limit, bumps the incarnation so the
+// update wins over any earlier claim, and broadcasts it. The returned channel
+// is that of broadcastNode for waitFor.
+func (g *Gossiper) setMetadata(set func(self *Node), waitFor float64) (chan struct{}, error) {
+	var (
+		updated *Node
+		err     error
+	)
+	g.members.update(g.self, func(self *Node) {
+		n := *self
+		set(&n)
+		if size := n.MetadataSize(); size > g.maxMetadataSize {
+			err = fmt.Errorf("%w: %d bytes, limit %d", ErrMetadataTooLarge, size, g.maxMetadataSize)
+			return
+		}
+		set(self)
+		self.Incarnation++
+		g.members.stamp(self)
+		n = *self
+		updated = &n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g.broadcastNode(updated, waitFor), nil
+}
+
+// leaveFanout is the number of members told directly about a Leave.
+const leaveFanout = 3
+
+// Leave marks the local node as having left the cluster and tells a few
+// members about it, so that it is not mistaken for a failure. The gossiper
+// should be stopped afterwards.
+func (g *Gossiper) Leave() {
+	g.members.update(g.self, func(self *Node) {
+		self.State = Left
+		self.Incarnation++
+		g.members.stamp(self)
+	})
+
+	self, _ := g.members.tombstoned(g.self.Addr.String())
+	g.broadcastNode(self, 0)
+	nodes := g.members.All()
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	for i := 0; i < len(nodes) && i < leaveFanout; i++ {
+		g.sendNodes([]*Node{self}, nodes[i].Addr.String())
+	}
+}
+
+// View is an immutable snapshot of the cluster membership.
+type View struct {
+	// Version increases whenever the membership list changes, so two views
+	// with the same version hold the same members.
+	Version uint64
+	// Members holds copies of the alive and suspected members, sorted by
+	// address.
+	Members []Node
 }
 
-// Members returns all nodes in the membership list.
-func (g *Gossiper) Members() []*Node {
-	return g.members.All()
+// View returns a snapshot of the current members and the version of the
+// membership list it was taken from.
+func (g *Gossiper) View() View {
+	version, nodes := g.members.view(false)
+	return View{Version: version, Members: nodes}
+}
+
+// Members returns copies of the alive and suspected members, sorted by
+// address. Modifying them does not affect the gossiper.
+func (g *Gossiper) Members() []Node {
+	_, nodes := g.members.view(false)
+	return nodes
+}
+
+// AliveMembers returns copies of the members that are alive.
+func (g *Gossiper) AliveMembers() []Node {
+	return g.MembersByState(Alive)
+}
+
+// MembersByState returns copies of the known nodes in the given state. Dead
+// and departed nodes are returned for as long as their tombstones are
+// retained.
+func (g *Gossiper) MembersByState(state State) []Node {
+	_, nodes := g.members.view(state.isTombstone())
+	return filterNodes(nodes, func(n *Node) bool {
+		return n.State == state
+	})
+}
+
+// MembersWithTag returns copies of the members that have the tag key set to
+// value.
+func (g *Gossiper) MembersWithTag(key, value string) []Node {
+	_, nodes := g.members.view(false)
+	return filterNodes(nodes, func(n *Node) bool {
+		return n.HasTag(key, value)
+	})
+}
+
+// filterNodes returns the nodes for which keep returns true, reusing the
+// backing array of nodes.
+func filterNodes(nodes []Node, keep func(*Node) bool) []Node {
+	kept := nodes[:0]
+	for i := range nodes {
+		if keep(&nodes[i]) {
+			kept = append(kept, nodes[i])
+		}
+	}
+	return kept
+}
+
+// Clock returns the hybrid logical clock that versions the gossiper's
+// records. Applications can use it to version their own records consistently
+// with the cluster.
+func (g *Gossiper) Clock() *HLC {
+	return g.members.clock
+}
+
+// Stats returns a snapshot of the gossiper's message counters and clock skew
+// figures.
+func (g *Gossiper) Stats() Stats {
+	return Stats{
+		Malformed:        g.malformed.Load(),
+		LabelMismatch:    g.labelMismatch.Load(),
+		QueryDropped:     g.queryDropped.Load(),
+		SkewWarnings:     g.skewWarningCount.Load(),
+		MaxClockOffset:   g.members.maxClockOffset(),
+		QueuedBroadcasts: g.broadcasts.len(),
+	}
 }
 
 func (g *Gossiper) listen() {
@@ -89,6 +800,9 @@ func (g *Gossiper) listen() {
 		select {
 		case data := <-g.transport.Read():
 			g.handleMessage(data)
+		case s := <-g.streamed:
+			g.deliverDirect(&s.msg)
+			close(s.done)
 		case <-g.stop:
 			return
 		}
@@ -97,13 +811,14 @@ func (g *Gossiper) listen() {
 
 func (g *Gossiper) pingLoop() {
 	defer g.wg.Done()
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(g.probeInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			g.sendPing()
+			g.probe()
+			g.expire()
 		case <-g.stop:
 			return
 		}
@@ -125,92 +840,195 @@ func (g *Gossiper) syncLoop() {
 	}
 }
 
-func (g *Gossiper) sendPing() {
+// randomPeer returns a random member other than the local node, or nil if
+// there is none.
+func (g *Gossiper) randomPeer() *Node {
 	nodes := g.members.All()
-	if len(nodes) <= 1 {
-		return
-	}
-
-	// Select a random node to gossip to (excluding self).
-	var node *Node
-	for {
-		node = nodes[rand.Intn(len(nodes))]
-		if node.Addr.String() != g.self.Addr.String() {
-			break
+	self := g.self.Addr.String()
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	for _, node := range nodes {
+		if node.Addr.String() != self {
+			return node
 		}
 	}
+	return nil
+}
 
-	msg := &Message{
-		Type: Ping,
+// sendSync refreshes the delegate's node metadata and runs an anti-entropy
+// round with a random member.
+func (g *Gossiper) sendSync() {
+	if g.delegate != nil {
+		g.members.mu.RLock()
+		meta, tagsSize := g.self.Meta, metadataSize(g.self.Tags, nil)
+		g.members.mu.RUnlock()
+		g.refreshNodeMeta(meta, tagsSize)
 	}
 
-	// Encode the message.
-	data, err := msg.Encode()
-	if err != nil {
+	node := g.randomPeer()
+	if node == nil {
 		return
 	}
 
-	// Send the message.
-	if err := g.transport.Write(data, node.Addr.String()); err != nil {
-		// Log.Printf("[%s] failed to send message to %s: %v", g.name, node.Addr.String(), err)
-	}
+	// Only a digest is sent; records travel in the reply and the delta that
+	// follows it, so the cost grows with the number of differences rather
+	// than the size of the cluster.
+	g.sendDigest(node.Addr.String())
 }
 
-func (g *Gossiper) sendSync() {
-	g.self.LastUpdated = time.Now()
-
-	nodes := g.members.All()
-	if len(nodes) <= 1 {
-		return
-	}
-
-	// Select a random node to gossip to (excluding self).
-	var node *Node
-	for {
-		node = nodes[rand.Intn(len(nodes))]
-		if node.Addr.String() != g.self.Addr.String() {
-			break
+// sendNodes sends Sync messages carrying nodes to addr, as many as it takes
+// to keep each within the gossip packet size.
+func (g *Gossiper) sendNodes(nodes []*Node, addr string) {
+	g.sendSplit(addr, len(nodes), func(lo, hi int) *Message {
+		payload, err := json.Marshal(nodes[lo:hi])
+		if err != nil {
+			return nil
 		}
-	}
+		return &Message{Type: Sync, Payload: payload}
+	})
+}
 
-	// Create a sync message with the membership list.
-	payload, err := json.Marshal(g.members.All())
+// send labels, encodes and writes a message to addr.
+func (g *Gossiper) send(msg *Message, addr string) error {
+	msg.Label = g.label
+	data, err := msg.Encode()
 	if err != nil {
-		return
+		return err
 	}
+	return g.transport.Write(data, addr)
+}
 
-	msg := &Message{
-		Type:    Sync,
-		Payload: payload,
+// pendingReply is a request waiting for its reply.
+type pendingReply struct {
+	// from is the address the reply must come from, or empty if any
+	// address may answer.
+	from string
+	ch   chan []byte
+}
+
+// expectReply allocates a sequence number for a request to the member at
+// from and returns the channel its reply payload is delivered on. Only
+// replies from that address are delivered, unless from is empty. The returned
+// function must be called once the reply is no longer awaited.
+func (g *Gossiper) expectReply(from string) (uint32, <-chan []byte, func()) {
+	seq := g.seq.Add(1)
+	reply := make(chan []byte, 1)
+	g.pendingMu.Lock()
+	g.pending[seq] = pendingReply{from: from, ch: reply}
+	g.pendingMu.Unlock()
+	return seq, reply, func() {
+		g.pendingMu.Lock()
+		delete(g.pending, seq)
+		g.pendingMu.Unlock()
 	}
+}
 
-	// Encode the message.
-	data, err := msg.Encode()
-	if err != nil {
+// deliverReply hands a reply payload sent by the member at from to the
+// request waiting for seq, if any. A reply from another member than the one
+// the request went to is dropped, so that a late or stray reply reusing the
+// sequence number cannot answer for it. Replies from older versions carry no
+// sender and are matched on seq alone.
+func (g *Gossiper) deliverReply(seq uint32, from string, payload []byte) {
+	g.pendingMu.Lock()
+	reply, ok := g.pending[seq]
+	g.pendingMu.Unlock()
+	if !ok || reply.from != "" && from != "" && from != reply.from {
 		return
 	}
+	select {
+	case reply.ch <- payload:
+	default:
+	}
+}
 
-	// Send the message.
-	if err := g.transport.Write(data, node.Addr.String()); err != nil {
-		// Log.Printf("[%s] failed to send message to %s: %v", g.name, node.Addr.String(), err)
+// acceptLabel reports whether a message with the given cluster label belongs
+// to this gossiper's cluster.
+func (g *Gossiper) acceptLabel(label string) bool {
+	if label == g.label {
+		return true
 	}
+	return g.acceptUnlabeled && (label == "" || g.label == "")
 }
 
 func (g *Gossiper) handleMessage(data []byte) {
 	msg, err := Decode(data)
 	if err != nil {
+		g.malformed.Add(1)
 		return
 	}
+	if !g.acceptLabel(msg.Label) {
+		g.labelMismatch.Add(1)
+		return
+	}
+	if msg.Type == Compound {
+		g.handleCompound(msg.Payload)
+		return
+	}
+	g.dispatch(msg)
+}
 
+// dispatch handles a decoded message according to its type.
+func (g *Gossiper) dispatch(msg *Message) {
 	switch msg.Type {
 	case Ping:
-		// Do nothing for now.
-		// In the future, this could be used to request a sync.
+		g.handlePing(msg.Payload)
+	case Ack:
+		g.handleAck(msg.Payload)
 	case Sync:
-		var nodes []*Node
-		if err := json.Unmarshal(msg.Payload, &nodes); err != nil {
+		g.handleSync(msg.Payload)
+	case PushPull:
+		g.handlePushPull(msg.Payload)
+	case PushPullReply:
+		var p pushPull
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
 			return
 		}
-		g.members.Merge(nodes)
+		g.deliverReply(p.Seq, p.From, msg.Payload)
+	case User:
+		g.handleUser(msg.Payload)
+	case UserBroadcast:
+		g.handleUserBroadcast(msg.Payload)
+	case Event:
+		g.handleEvent(msg.Payload)
+	case Query:
+		g.handleQuery(msg.Payload)
+	case QueryReply:
+		g.handleQueryReply(msg.Payload)
+	case Relay:
+		g.handleRelay(msg.Payload)
+	case Direct:
+		g.handleDirect(msg.Payload)
+	case Digest:
+		g.handleDigest(msg.Payload)
+	case DigestReply:
+		g.handleDigestReply(msg.Payload)
 	}
-}
\ No newline at end of file
+}
+
+// handleSync merges a Sync message, whose payload is a list of nodes.
+// Application state travels only in push-pull exchanges.
+func (g *Gossiper) handleSync(payload []byte) {
+	var nodes []*Node
+	if err := json.Unmarshal(payload, &nodes); err != nil {
+		return
+	}
+	g.mergeRemote(nodes)
+}
+
+// mergeRemote merges nodes received from a peer. Entries describing the local
+// node are never merged; they are refuted if necessary.
+func (g *Gossiper) mergeRemote(nodes []*Node) {
+	self := g.self.Addr.String()
+	remote := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Addr.String() == self {
+			g.refute(node)
+			continue
+		}
+		remote = append(remote, node)
+	}
+
+	// Pass on what was news to us, so that updates spread epidemically.
+	for _, node := range g.members.mergeChanged(remote) {
+		g.broadcastNode(node, 0)
+	}
+}
@@ -0,0 +1,496 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncMessage encodes a Sync message announcing a single node at addr.
+func syncMessage(t *testing.T, label, addr string) []byte {
+	t.Helper()
+	udpAddr, err := resolveAddr(addr)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", addr, err)
+	}
+	payload, err := json.Marshal([]*Node{{Addr: udpAddr, State: Alive, LastUpdated: time.Now()}})
+	if err != nil {
+		t.Fatalf("failed to marshal nodes: %v", err)
+	}
+	data, err := (&Message{Type: Sync, Payload: payload, Label: label}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	return data
+}
+
+func TestGossiper_ClusterLabel(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithClusterLabel("prod"))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	g.handleMessage(syncMessage(t, "staging", "127.0.0.1:7947"))
+	g.handleMessage(syncMessage(t, "", "127.0.0.1:7948"))
+	g.handleMessage(syncMessage(t, "prod", "127.0.0.1:7949"))
+	g.handleMessage([]byte("not a message"))
+
+	if _, ok := g.members.Get("127.0.0.1:7947"); ok {
+		t.Error("Merged a node from a message with a different label")
+	}
+	if _, ok := g.members.Get("127.0.0.1:7948"); ok {
+		t.Error("Merged a node from an unlabeled message")
+	}
+	if _, ok := g.members.Get("127.0.0.1:7949"); !ok {
+		t.Error("Did not merge a node from a message with the same label")
+	}
+
+	stats := g.Stats()
+	if stats.LabelMismatch != 2 {
+		t.Errorf("Expected 2 label mismatches, got %d", stats.LabelMismatch)
+	}
+	if stats.Malformed != 1 {
+		t.Errorf("Expected 1 malformed message, got %d", stats.Malformed)
+	}
+}
+
+func TestGossiper_AcceptUnlabeled(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithClusterLabel("prod"), WithAcceptUnlabeled(true))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	g.handleMessage(syncMessage(t, "", "127.0.0.1:7948"))
+	g.handleMessage(syncMessage(t, "staging", "127.0.0.1:7947"))
+
+	if _, ok := g.members.Get("127.0.0.1:7948"); !ok {
+		t.Error("Did not merge a node from an unlabeled message during migration")
+	}
+	if _, ok := g.members.Get("127.0.0.1:7947"); ok {
+		t.Error("Merged a node from a message with a different label")
+	}
+}
+
+// TestGossiper_LabelMigration checks that a node that has the label and one
+// still waiting for it converge while both accept unlabeled messages.
+func TestGossiper_LabelMigration(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7110", "127.0.0.1:7111"}
+	labels := []string{"prod", ""}
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs[:i], network.Transport(addr),
+			WithClusterLabel(labels[i]), WithAcceptUnlabeled(true))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	waitFor(t, 5*time.Second, "the nodes to converge", func() bool {
+		return len(gossipers[0].AliveMembers()) == 2 && len(gossipers[1].AliveMembers()) == 2
+	})
+	for _, g := range gossipers {
+		if n := g.Stats().LabelMismatch; n != 0 {
+			t.Errorf("Expected no label mismatches, got %d", n)
+		}
+	}
+}
+
+func TestGossiper_SendsLabel(t *testing.T) {
+	tr := NewMockTransport()
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, tr, WithClusterLabel("prod"))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	g.sendSync()
+
+	select {
+	case data := <-tr.writeCh:
+		msg, err := Decode(data)
+		if err != nil {
+			t.Fatalf("failed to decode sent message: %v", err)
+		}
+		if msg.Label != "prod" {
+			t.Errorf("Expected label prod, got %q", msg.Label)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for sync message")
+	}
+}
+
+// mockNetwork routes messages between mockNetTransports by address and can
+// take addresses or single links offline to simulate failures.
+type mockNetwork struct {
+	mu         sync.Mutex
+	transports map[string]*mockNetTransport
+	down       map[string]bool
+	cut        map[[2]string]bool
+}
+
+func newMockNetwork() *mockNetwork {
+	return &mockNetwork{
+		transports: make(map[string]*mockNetTransport),
+		down:       make(map[string]bool),
+		cut:        make(map[[2]string]bool),
+	}
+}
+
+// Transport returns a transport registered on the network under addr.
+func (n *mockNetwork) Transport(addr string) *mockNetTransport {
+	t := &mockNetTransport{net: n, addr: addr, readCh: make(chan []byte, 1024)}
+	n.mu.Lock()
+	n.transports[addr] = t
+	n.mu.Unlock()
+	return t
+}
+
+// SetDown drops all traffic to and from addr while down is true.
+func (n *mockNetwork) SetDown(addr string, down bool) {
+	n.mu.Lock()
+	n.down[addr] = down
+	n.mu.Unlock()
+}
+
+// SetLinkDown drops all traffic sent from one address to another while down
+// is true. The reverse direction is unaffected.
+func (n *mockNetwork) SetLinkDown(from, to string, down bool) {
+	n.mu.Lock()
+	n.cut[[2]string{from, to}] = down
+	n.mu.Unlock()
+}
+
+type mockNetTransport struct {
+	net    *mockNetwork
+	addr   string
+	readCh chan []byte
+}
+
+func (t *mockNetTransport) Write(data []byte, addr string) error {
+	t.net.mu.Lock()
+	dst, ok := t.net.transports[addr]
+	down := t.net.down[addr] || t.net.down[t.addr] || t.net.cut[[2]string{t.addr, addr}]
+	t.net.mu.Unlock()
+	if !ok || down {
+		return nil
+	}
+	select {
+	case dst.readCh <- data:
+	default:
+	}
+	return nil
+}
+
+func (t *mockNetTransport) Read() <-chan []byte {
+	return t.readCh
+}
+
+func (t *mockNetTransport) Stop() {}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lookup returns a copy of the member or tombstone stored under addr, read
+// under the list's lock.
+func lookup(ml *MembershipList, addr string) (Node, bool) {
+	for _, node := range ml.snapshot() {
+		if node.Addr.String() == addr {
+			return *node, true
+		}
+	}
+	return Node{}, false
+}
+
+// fastFailureDetection shortens failure detection timings for tests.
+var fastFailureDetection = []Option{
+	WithProbeInterval(20 * time.Millisecond),
+	WithProbeTimeout(10 * time.Millisecond),
+	WithSuspicionTimeout(100 * time.Millisecond),
+}
+
+func TestGossiper_FailureDetectionAndRejoin(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003"}
+
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), fastFailureDetection...)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		gossipers = append(gossipers, g)
+	}
+	defer func() {
+		for _, g := range gossipers {
+			g.Stop()
+		}
+	}()
+
+	// Take the third node down; the others must declare it dead.
+	network.SetDown(addrs[2], true)
+	waitFor(t, 5*time.Second, "node 3 to be declared dead", func() bool {
+		ts, ok := gossipers[0].members.tombstoned(addrs[2])
+		return ok && ts.State == Dead
+	})
+	if _, ok := gossipers[0].members.Get(addrs[2]); ok {
+		t.Error("Dead node still listed as a member")
+	}
+
+	// Restart the third node under the same address with a fresh
+	// incarnation. It must learn about its tombstone, refute it and
+	// reclaim its entry.
+	gossipers[2].Stop()
+	network.SetDown(addrs[2], false)
+	restarted, err := NewGossiper(addrs[2], addrs[2], addrs[:1], network.Transport(addrs[2]), fastFailureDetection...)
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	restarted.Start()
+	gossipers[2] = restarted
+
+	waitFor(t, 15*time.Second, "node 3 to reclaim its entry", func() bool {
+		node, ok := lookup(gossipers[0].members, addrs[2])
+		return ok && node.State == Alive && node.Incarnation > 0
+	})
+}
+
+func TestGossiper_ReconnectHealsPartition(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7011", "127.0.0.1:7012"}
+
+	opts := append([]Option{WithReconnect(50*time.Millisecond, 20*time.Millisecond, time.Minute)}, fastFailureDetection...)
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), opts...)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	// Partition the two nodes until each has declared the other dead.
+	network.SetDown(addrs[1], true)
+	waitFor(t, 5*time.Second, "both sides to declare each other dead", func() bool {
+		_, ok1 := gossipers[0].members.tombstoned(addrs[1])
+		_, ok2 := gossipers[1].members.tombstoned(addrs[0])
+		return ok1 && ok2
+	})
+
+	// Heal the partition; reconnection must restore the cluster without
+	// any other traffic.
+	network.SetDown(addrs[1], false)
+	waitFor(t, 5*time.Second, "the partition to heal", func() bool {
+		n1, ok1 := lookup(gossipers[0].members, addrs[1])
+		n2, ok2 := lookup(gossipers[1].members, addrs[0])
+		return ok1 && ok2 && n1.State == Alive && n2.State == Alive
+	})
+}
+
+func TestGossiper_SetTags(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithMaxMetadataSize(32))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	tags := map[string]string{"role": "api", "zone": "eu-1"}
+	if err := g.SetTags(tags); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+	tags["role"] = "mutated"
+	if role, _ := g.self.Tag("role"); role != "api" {
+		t.Errorf("Expected tags to be copied, got role %q", role)
+	}
+
+	err = g.SetTags(map[string]string{"version": strings.Repeat("x", 32)})
+	if !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("Expected ErrMetadataTooLarge, got %v", err)
+	}
+	if !g.self.HasTag("zone", "eu-1") {
+		t.Error("Rejected update modified the tags")
+	}
+
+	// Tags and raw metadata share the limit.
+	if err := g.SetMeta(make([]byte, 20)); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Errorf("Expected ErrMetadataTooLarge for combined metadata, got %v", err)
+	}
+
+	if err := g.SetTags(nil); err != nil {
+		t.Fatalf("failed to clear tags: %v", err)
+	}
+	if len(g.Tags()) != 0 {
+		t.Errorf("Expected tags to be cleared, got %v", g.Tags())
+	}
+}
+
+func TestGossiper_UpdateMetadata(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7021", "127.0.0.1:7022", "127.0.0.1:7023", "127.0.0.1:7024"}
+
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), WithPropagationFraction(1))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := gossipers[0].UpdateMetadata(ctx, map[string]string{"role": "db"}); err != nil {
+		t.Fatalf("failed to update metadata: %v", err)
+	}
+	if self, _ := lookup(gossipers[0].members, addrs[0]); self.Incarnation == 0 {
+		t.Error("Expected the incarnation to be bumped")
+	}
+
+	// The periodic sync runs every few seconds; the update must arrive well
+	// before that through the gossip broadcast.
+	waitFor(t, time.Second, "the update to reach every member", func() bool {
+		for _, g := range gossipers[1:] {
+			node, ok := lookup(g.members, addrs[0])
+			if !ok || !node.HasTag("role", "db") {
+				return false
+			}
+		}
+		return true
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Update took %v to propagate", elapsed)
+	}
+}
+
+func TestGossiper_UpdateMetadataCancel(t *testing.T) {
+	// The gossiper is never started, so the update cannot propagate.
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, NewMockTransport(), WithPropagationFraction(1))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = g.UpdateMetadata(ctx, map[string]string{"role": "db"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if !g.self.HasTag("role", "db") {
+		t.Error("Expected the update to be applied locally")
+	}
+	if n := g.broadcasts.len(); n != 1 {
+		t.Errorf("Expected the update to stay queued, got %d broadcasts", n)
+	}
+}
+
+func TestGossiper_MembersFilters(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947", "127.0.0.1:7948"}, NewMockTransport())
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	if err := g.SetTags(map[string]string{"role": "api"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+	g.members.Suspect("127.0.0.1:7947")
+	g.members.Merge([]*Node{{Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7949}, State: Dead, LastUpdated: time.Now()}})
+
+	view := g.View()
+	if len(view.Members) != 3 {
+		t.Fatalf("Expected 3 members, got %d", len(view.Members))
+	}
+	for i := 1; i < len(view.Members); i++ {
+		if view.Members[i-1].Addr.String() >= view.Members[i].Addr.String() {
+			t.Errorf("Members not sorted by address: %v", view.Members)
+		}
+	}
+	if again := g.View(); again.Version != view.Version {
+		t.Errorf("Expected version %d for an unchanged list, got %d", view.Version, again.Version)
+	}
+
+	// Members are copies; changing them must not leak into the list.
+	members := g.Members()
+	for i := range members {
+		members[i].State = Dead
+		members[i].Tags = nil
+	}
+	if !g.self.HasTag("role", "api") {
+		t.Error("Mutating a returned member changed the local node")
+	}
+
+	if alive := g.AliveMembers(); len(alive) != 2 {
+		t.Errorf("Expected 2 alive members, got %d", len(alive))
+	}
+	if suspected := g.MembersByState(Suspected); len(suspected) != 1 || suspected[0].Addr.String() != "127.0.0.1:7947" {
+		t.Errorf("Expected 127.0.0.1:7947 to be suspected, got %v", suspected)
+	}
+	if dead := g.MembersByState(Dead); len(dead) != 1 || dead[0].Addr.String() != "127.0.0.1:7949" {
+		t.Errorf("Expected 127.0.0.1:7949 to be dead, got %v", dead)
+	}
+	if tagged := g.MembersWithTag("role", "api"); len(tagged) != 1 || tagged[0].Addr.String() != "127.0.0.1:7946" {
+		t.Errorf("Expected only the local node to have role=api, got %v", tagged)
+	}
+
+	g.Leave()
+	if g.View().Version <= view.Version {
+		t.Error("Expected the version to increase after leaving")
+	}
+}
+
+func TestGossiper_AckFromOtherMember(t *testing.T) {
+	tr := NewMockTransport()
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, tr,
+		WithProbeTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	// Another member answers the probe's ping with its sequence number.
+	done := make(chan struct{})
+	go func() {
+		g.probe()
+		close(done)
+	}()
+	msg, err := Decode(<-tr.writeCh)
+	if err != nil || msg.Type != Ping {
+		t.Fatalf("Expected a ping, got %v (%v)", msg, err)
+	}
+	var p ping
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		t.Fatalf("failed to decode ping: %v", err)
+	}
+	payload, err := json.Marshal(&ack{Seq: p.Seq, From: "127.0.0.1:7948"})
+	if err != nil {
+		t.Fatalf("failed to marshal ack: %v", err)
+	}
+	data, err := (&Message{Type: Ack, Payload: payload}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode ack: %v", err)
+	}
+	g.handleMessage(data)
+	<-done
+
+	if n, _ := g.members.Get("127.0.0.1:7947"); n.State != Suspected {
+		t.Errorf("Expected the probed member to be suspected, got %s", n.State)
+	}
+}
@@ -0,0 +1,118 @@
+package gossip
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp: a wall time in nanoseconds
+// since the Unix epoch, and a logical counter that orders events sharing the
+// same wall time. The zero Timestamp is older than every other.
+type Timestamp struct {
+	WallTime int64  `json:"wall"`
+	Logical  uint32 `json:"logical,omitempty"`
+}
+
+// IsZero reports whether t is the zero Timestamp.
+func (t Timestamp) IsZero() bool {
+	return t.WallTime == 0 && t.Logical == 0
+}
+
+// Compare returns -1 if t is older than u, +1 if it is newer and 0 if they
+// are equal.
+func (t Timestamp) Compare(u Timestamp) int {
+	switch {
+	case t.WallTime < u.WallTime:
+		return -1
+	case t.WallTime > u.WallTime:
+		return 1
+	case t.Logical < u.Logical:
+		return -1
+	case t.Logical > u.Logical:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// After reports whether t is newer than u.
+func (t Timestamp) After(u Timestamp) bool {
+	return t.Compare(u) > 0
+}
+
+// Before reports whether t is older than u.
+func (t Timestamp) Before(u Timestamp) bool {
+	return t.Compare(u) < 0
+}
+
+// Time returns the wall time component of t. It is meant for display only.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.WallTime)
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.Time().UTC().Format(time.RFC3339Nano), t.Logical)
+}
+
+// HLC is a hybrid logical clock. Its timestamps stay close to wall time but
+// never go backwards, even when the wall clock is stepped back, and they
+// always exceed every timestamp the clock has witnessed. Every timestamp a
+// member issues is therefore newer than anything it has received, regardless
+// of how far its own wall clock is off.
+type HLC struct {
+	mu   sync.Mutex
+	last Timestamp
+	// wallTime returns the current wall time in nanoseconds. It is
+	// replaceable for tests.
+	wallTime func() int64
+}
+
+// NewHLC creates a hybrid logical clock driven by the system wall clock.
+func NewHLC() *HLC {
+	return &HLC{
+		wallTime: func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Now returns a timestamp for a local event, such as stamping a record that is
+// about to be sent.
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := c.wallTime()
+	if wall > c.last.WallTime {
+		c.last = Timestamp{WallTime: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update witnesses a timestamp received from another member, so that later
+// local timestamps are newer than it.
+func (c *HLC) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := c.wallTime()
+	switch {
+	case wall > c.last.WallTime && wall > remote.WallTime:
+		c.last = Timestamp{WallTime: wall}
+	case remote.WallTime > c.last.WallTime:
+		c.last = Timestamp{WallTime: remote.WallTime, Logical: remote.Logical + 1}
+	case c.last.WallTime > remote.WallTime:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+}
+
+// Last returns the most recent timestamp issued or witnessed.
+func (c *HLC) Last() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
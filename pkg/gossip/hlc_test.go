@@ -0,0 +1,101 @@
+package gossip
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeWall is a wall clock that tests can move freely.
+type fakeWall struct {
+	now int64
+}
+
+func (w *fakeWall) read() int64 {
+	return w.now
+}
+
+func TestHLC_Monotonic(t *testing.T) {
+	wall := &fakeWall{now: int64(time.Hour)}
+	c := NewHLC()
+	c.wallTime = wall.read
+
+	t1 := c.Now()
+	t2 := c.Now()
+	if !t2.After(t1) {
+		t.Errorf("Expected %v to be after %v at the same wall time", t2, t1)
+	}
+
+	// NTP steps the wall clock back a minute.
+	wall.now -= int64(time.Minute)
+	t3 := c.Now()
+	if !t3.After(t2) {
+		t.Errorf("Expected %v to be after %v when the wall clock went back", t3, t2)
+	}
+
+	wall.now += int64(2 * time.Minute)
+	t4 := c.Now()
+	if t4.WallTime != wall.now || t4.Logical != 0 {
+		t.Errorf("Expected the clock to follow the wall clock again, got %v", t4)
+	}
+}
+
+func TestHLC_Update(t *testing.T) {
+	wall := &fakeWall{now: int64(time.Hour)}
+	c := NewHLC()
+	c.wallTime = wall.read
+
+	// A remote clock a minute fast.
+	remote := Timestamp{WallTime: wall.now + int64(time.Minute), Logical: 3}
+	c.Update(remote)
+	if next := c.Now(); !next.After(remote) {
+		t.Errorf("Expected %v to be after the witnessed %v", next, remote)
+	}
+
+	// Older remote timestamps do not move the clock back.
+	last := c.Last()
+	c.Update(Timestamp{WallTime: 1})
+	if c.Last().Before(last) {
+		t.Errorf("Clock went back from %v to %v", last, c.Last())
+	}
+}
+
+func TestMembershipList_HLCResolvesSkew(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+
+	// A peer whose wall clock is a minute fast announces the node.
+	fast := NewMembershipList()
+	fast.clock.wallTime = func() int64 { return time.Now().Add(time.Minute).UnixNano() }
+	announced := &Node{Addr: addr, State: Alive}
+	fast.stamp(announced)
+	fast.Add(announced)
+	sent := *announced
+
+	// A member whose wall clock is behind merges it, then updates the
+	// node without changing its state. Its update must still win.
+	ml := NewMembershipList()
+	received := sent
+	ml.Add(&received)
+	ml.update(ml.nodes[addr.String()], ml.stamp)
+	updated, _ := lookup(ml, addr.String())
+	if !updated.supersedes(&sent) {
+		t.Fatalf("Expected version %v to supersede the fast peer's %v", updated.Version, sent.Version)
+	}
+	fast.Merge([]*Node{&updated})
+	if merged, _ := lookup(fast, addr.String()); merged.Version != updated.Version {
+		t.Error("Fast peer rejected the newer update")
+	}
+
+	data, err := json.Marshal(&updated)
+	if err != nil {
+		t.Fatalf("failed to marshal node: %v", err)
+	}
+	var decoded Node
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal node: %v", err)
+	}
+	if decoded.Version != updated.Version {
+		t.Errorf("Expected version %v to survive encoding, got %v", updated.Version, decoded.Version)
+	}
+}
@@ -0,0 +1,33 @@
+package gossip
+
+import "sync/atomic"
+
+// LamportClock is a thread-safe logical clock. Every member advances it on
+// local events and witnesses the times it receives, so that causally later
+// events always carry a higher time.
+type LamportClock struct {
+	counter atomic.Uint64
+}
+
+// Time returns the current time of the clock.
+func (c *LamportClock) Time() uint64 {
+	return c.counter.Load()
+}
+
+// Increment advances the clock and returns the new time.
+func (c *LamportClock) Increment() uint64 {
+	return c.counter.Add(1)
+}
+
+// Witness moves the clock past a time received from another member.
+func (c *LamportClock) Witness(t uint64) {
+	for {
+		cur := c.counter.Load()
+		if t < cur {
+			return
+		}
+		if c.counter.CompareAndSwap(cur, t+1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package gossip
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLamportClock(t *testing.T) {
+	var c LamportClock
+	if c.Time() != 0 {
+		t.Fatalf("Expected a new clock to start at 0, got %d", c.Time())
+	}
+	if got := c.Increment(); got != 1 {
+		t.Errorf("Expected 1 after incrementing, got %d", got)
+	}
+
+	c.Witness(41)
+	if c.Time() != 42 {
+		t.Errorf("Expected the clock to move past 41, got %d", c.Time())
+	}
+	c.Witness(10)
+	if c.Time() != 42 {
+		t.Errorf("Expected an older time to leave the clock at 42, got %d", c.Time())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Increment()
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Time() != 842 {
+		t.Errorf("Expected 842 after concurrent increments, got %d", c.Time())
+	}
+}
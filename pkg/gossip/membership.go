@@ -1,19 +1,46 @@
 package gossip
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
+// tombstone remembers a dead or departed node so that older gossip claiming
+// it is alive can be rejected until the tombstone is reaped.
+type tombstone struct {
+	node  *Node
+	since time.Time
+}
+
 // MembershipList stores the state of all nodes in the cluster.
+//
+// Alive and suspected nodes are members. Dead and departed nodes are moved to
+// a separate set of tombstones, which still take part in merging but are not
+// returned by Get or All.
 type MembershipList struct {
-	mu    sync.RWMutex
-	nodes map[string]*Node
+	mu         sync.RWMutex
+	nodes      map[string]*Node
+	tombstones map[string]*tombstone
+	// suspected records the local time at which each suspected member
+	// entered that state, independent of the sender's clock.
+	suspected map[string]time.Time
+	// clock stamps local updates and witnesses the versions of merged ones.
+	clock *HLC
+	// version is incremented on every change to the list, and changed is
+	// closed and replaced at the same time to wake up waiters.
+	version uint64
+	changed chan struct{}
 }
 
 // NewMembershipList creates a new membership list.
 func NewMembershipList() *MembershipList {
 	return &MembershipList{
-		nodes: make(map[string]*Node),
+		nodes:      make(map[string]*Node),
+		tombstones: make(map[string]*tombstone),
+		suspected:  make(map[string]time.Time),
+		changed:    make(chan struct{}),
+		clock:      NewHLC(),
 	}
 }
 
@@ -33,40 +60,294 @@ func (m *MembershipList) Merge(nodes []*Node) {
 	}
 }
 
-func (m *MembershipList) addOrUpdate(node *Node) {
-	existing, ok := m.nodes[node.Addr.String()]
+// mergeChanged merges nodes like Merge and returns copies of the nodes that
+// changed the local list.
+func (m *MembershipList) mergeChanged(nodes []*Node) []*Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changed []*Node
+	for _, node := range nodes {
+		if m.addOrUpdate(node) {
+			n := *node
+			changed = append(changed, &n)
+		}
+	}
+	return changed
+}
+
+// addOrUpdate merges a single node and reports whether it changed the list.
+func (m *MembershipList) addOrUpdate(node *Node) bool {
+	key := node.Addr.String()
+	if !node.Version.IsZero() {
+		m.clock.Update(node.Version)
+	}
+
+	if ts, ok := m.tombstones[key]; ok {
+		// Gossip older than the tombstone is rejected; a higher
+		// incarnation reclaims the entry.
+		if !node.supersedes(ts.node) {
+			return false
+		}
+		delete(m.tombstones, key)
+		m.file(key, node)
+		return true
+	}
+
+	existing, ok := m.nodes[key]
 	if !ok {
-		m.nodes[node.Addr.String()] = node
-		return
+		m.file(key, node)
+		return true
 	}
 
 	// If the incoming node is older or equally old, ignore it.
-	if !node.LastUpdated.After(existing.LastUpdated) {
-		return
+	if !node.supersedes(existing) {
+		return false
 	}
 
+	if node.Name != "" {
+		existing.Name = node.Name
+	}
 	existing.State = node.State
+	existing.Incarnation = node.Incarnation
+	existing.Version = node.Version
 	existing.LastUpdated = node.LastUpdated
-	if node.Payload != "" {
-		existing.Payload = node.Payload
+	// Metadata is replaced as a whole, so an update that clears it wins.
+	existing.Tags = node.Tags
+	existing.Meta = node.Meta
+	m.refile(key, existing)
+	return true
+}
+
+// stamp marks node as updated now, with a fresh version from the list's
+// clock.
+func (m *MembershipList) stamp(node *Node) {
+	node.Version = m.clock.Now()
+	node.LastUpdated = time.Now()
+}
+
+// bump records a change to the list. It must be called with the write lock
+// held.
+func (m *MembershipList) bump() {
+	m.version++
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// changedSince reports whether the list has changed since version. If it has
+// not, the returned channel is closed on the next change.
+func (m *MembershipList) changedSince(version uint64) (<-chan struct{}, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.changed, m.version > version
+}
+
+// file stores a node that is not currently known under key.
+func (m *MembershipList) file(key string, node *Node) {
+	m.bump()
+	if node.State.isTombstone() {
+		m.tombstones[key] = &tombstone{node: node, since: time.Now()}
+		return
+	}
+	m.nodes[key] = node
+	if node.State == Suspected {
+		m.suspected[key] = time.Now()
+	}
+}
+
+// refile moves a member whose state has changed in place to the set that
+// matches its new state.
+func (m *MembershipList) refile(key string, node *Node) {
+	m.bump()
+	if node.State != Suspected {
+		delete(m.suspected, key)
+	} else if _, ok := m.suspected[key]; !ok {
+		m.suspected[key] = time.Now()
+	}
+	if node.State.isTombstone() {
+		delete(m.nodes, key)
+		m.tombstones[key] = &tombstone{node: node, since: time.Now()}
+	}
+}
+
+// update applies fn to a node held by the list under the write lock, then
+// moves it between members and tombstones if its state changed.
+func (m *MembershipList) update(node *Node, fn func(*Node)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := node.Addr.String()
+	wasTombstone := node.State.isTombstone()
+	fn(node)
+	switch {
+	case wasTombstone && !node.State.isTombstone():
+		delete(m.tombstones, key)
+		m.file(key, node)
+	case wasTombstone:
+		m.bump()
+		m.tombstones[key] = &tombstone{node: node, since: time.Now()}
+	default:
+		m.refile(key, node)
 	}
 }
 
-// Get returns a node from the list.
+// Suspect marks an alive member as suspected at its current incarnation. It
+// returns a copy of the updated node, or nil if the state did not change.
+func (m *MembershipList) Suspect(addr string) *Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[addr]
+	if !ok || node.State != Alive {
+		return nil
+	}
+	node.State = Suspected
+	m.stamp(node)
+	m.refile(addr, node)
+	n := *node
+	return &n
+}
+
+// ExpireSuspects declares members that have been suspected for longer than
+// timeout dead and returns copies of them.
+func (m *MembershipList) ExpireSuspects(timeout time.Duration) []*Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []*Node
+	now := time.Now()
+	for key, since := range m.suspected {
+		if now.Sub(since) < timeout {
+			continue
+		}
+		node := m.nodes[key]
+		node.State = Dead
+		m.stamp(node)
+		m.refile(key, node)
+		n := *node
+		expired = append(expired, &n)
+	}
+	return expired
+}
+
+// Reap garbage-collects tombstones older than retention and returns how many
+// were removed.
+func (m *MembershipList) Reap(retention time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reaped := 0
+	now := time.Now()
+	for key, ts := range m.tombstones {
+		if now.Sub(ts.since) >= retention {
+			delete(m.tombstones, key)
+			reaped++
+		}
+	}
+	if reaped > 0 {
+		m.bump()
+	}
+	return reaped
+}
+
+// Get returns a copy of a node from the list. Modifying it does not affect
+// the list.
 func (m *MembershipList) Get(addr string) (*Node, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	node, ok := m.nodes[addr]
-	return node, ok
+	if !ok {
+		return nil, false
+	}
+	c := node.clone()
+	return &c, true
 }
 
-// All returns all nodes in the list.
+// All returns copies of all nodes in the list. Modifying them does not affect
+// the list.
 func (m *MembershipList) All() []*Node {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	nodes := make([]*Node, 0, len(m.nodes))
 	for _, node := range m.nodes {
-		nodes = append(nodes, node)
+		c := node.clone()
+		nodes = append(nodes, &c)
+	}
+	return nodes
+}
+
+// Tombstones returns the dead and departed nodes that are still retained.
+func (m *MembershipList) Tombstones() []*Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]*Node, 0, len(m.tombstones))
+	for _, ts := range m.tombstones {
+		nodes = append(nodes, ts.node)
+	}
+	return nodes
+}
+
+// deadSince returns copies of the tombstones of members that died, rather
+// than left, within maxAge.
+func (m *MembershipList) deadSince(maxAge time.Duration) []*Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var nodes []*Node
+	now := time.Now()
+	for _, ts := range m.tombstones {
+		if ts.node.State == Dead && now.Sub(ts.since) < maxAge {
+			n := *ts.node
+			nodes = append(nodes, &n)
+		}
+	}
+	return nodes
+}
+
+// tombstoned returns the tombstone for addr, if any.
+func (m *MembershipList) tombstoned(addr string) (*Node, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ts, ok := m.tombstones[addr]
+	if !ok {
+		return nil, false
+	}
+	node := *ts.node
+	return &node, true
+}
+
+// view returns deep copies of the members, or of the tombstones if
+// tombstones is true, sorted by address, together with the version of the
+// list they were taken from.
+func (m *MembershipList) view(tombstones bool) (uint64, []Node) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var nodes []Node
+	if tombstones {
+		nodes = make([]Node, 0, len(m.tombstones))
+		for _, ts := range m.tombstones {
+			nodes = append(nodes, ts.node.clone())
+		}
+	} else {
+		nodes = make([]Node, 0, len(m.nodes))
+		for _, node := range m.nodes {
+			nodes = append(nodes, node.clone())
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Addr.String() < nodes[j].Addr.String()
+	})
+	return m.version, nodes
+}
+
+// snapshot returns copies of every member and tombstone, taken under the read
+// lock, for sending to peers.
+func (m *MembershipList) snapshot() []*Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]*Node, 0, len(m.nodes)+len(m.tombstones))
+	for _, node := range m.nodes {
+		n := *node
+		nodes = append(nodes, &n)
+	}
+	for _, ts := range m.tombstones {
+		n := *ts.node
+		nodes = append(nodes, &n)
 	}
 	return nodes
 }
@@ -13,7 +13,7 @@ func TestMembershipList_Add(t *testing.T) {
 		Addr:        addr,
 		State:       Alive,
 		LastUpdated: time.Now(),
-		Payload:     "test-payload",
+		Meta:        []byte("test-payload"),
 	}
 
 	ml.Add(node)
@@ -25,8 +25,27 @@ func TestMembershipList_Add(t *testing.T) {
 	if retrievedNode.Addr.String() != node.Addr.String() {
 		t.Errorf("Expected address %s, got %s", node.Addr.String(), retrievedNode.Addr.String())
 	}
-	if retrievedNode.Payload != node.Payload {
-		t.Errorf("Expected payload %s, got %s", node.Payload, retrievedNode.Payload)
+	if string(retrievedNode.Meta) != string(node.Meta) {
+		t.Errorf("Expected meta %s, got %s", node.Meta, retrievedNode.Meta)
+	}
+}
+
+func TestMembershipList_GetReturnsCopies(t *testing.T) {
+	ml := NewMembershipList()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	ml.Add(&Node{Addr: addr, State: Alive, Tags: map[string]string{"role": "api"}, Meta: []byte("meta")})
+
+	node, _ := ml.Get(addr.String())
+	node.State = Dead
+	node.Tags["role"] = "db"
+	node.Meta[0] = 'x'
+	for _, n := range ml.All() {
+		n.Tags["role"] = "cache"
+	}
+
+	node, _ = ml.Get(addr.String())
+	if node.State != Alive || node.Tags["role"] != "api" || string(node.Meta) != "meta" {
+		t.Errorf("Expected the list to be unaffected by changes to copies, got %v %v %q", node.State, node.Tags, node.Meta)
 	}
 }
 
@@ -39,7 +58,7 @@ func TestMembershipList_Merge(t *testing.T) {
 		Addr:        addr1,
 		State:       Alive,
 		LastUpdated: time.Now(),
-		Payload:     "payload1",
+		Meta:        []byte("payload1"),
 	}
 	ml.Add(node1)
 
@@ -48,7 +67,7 @@ func TestMembershipList_Merge(t *testing.T) {
 		Addr:        addr1,
 		State:       Alive,
 		LastUpdated: time.Now().Add(1 * time.Second),
-		Payload:     "payload1-updated",
+		Meta:        []byte("payload1-updated"),
 	}
 
 	// Create an older version of node1 (should be ignored)
@@ -56,7 +75,7 @@ func TestMembershipList_Merge(t *testing.T) {
 		Addr:        addr1,
 		State:       Alive,
 		LastUpdated: time.Now().Add(-1 * time.Second),
-		Payload:     "payload1-old",
+		Meta:        []byte("payload1-old"),
 	}
 
 	// Create a new node2
@@ -65,7 +84,7 @@ func TestMembershipList_Merge(t *testing.T) {
 		Addr:        addr2,
 		State:       Alive,
 		LastUpdated: time.Now(),
-		Payload:     "payload2",
+		Meta:        []byte("payload2"),
 	}
 
 	// Test merging: node1Newer should update, node1Older should be ignored, node2 should be added
@@ -80,8 +99,8 @@ func TestMembershipList_Merge(t *testing.T) {
 	if !retrievedNode1.LastUpdated.Equal(node1Newer.LastUpdated) {
 		t.Errorf("Node1 LastUpdated not updated. Expected %v, got %v", node1Newer.LastUpdated, retrievedNode1.LastUpdated)
 	}
-	if retrievedNode1.Payload != node1Newer.Payload {
-		t.Errorf("Node1 Payload not updated. Expected %s, got %s", node1Newer.Payload, retrievedNode1.Payload)
+	if string(retrievedNode1.Meta) != string(node1Newer.Meta) {
+		t.Errorf("Node1 Meta not updated. Expected %s, got %s", node1Newer.Meta, retrievedNode1.Meta)
 	}
 
 	// Verify node2 added
@@ -89,20 +108,133 @@ func TestMembershipList_Merge(t *testing.T) {
 	if !ok {
 		t.Fatal("Node2 not found after merge")
 	}
-	if retrievedNode2.Payload != node2.Payload {
-		t.Errorf("Expected node2 payload %s, got %s", node2.Payload, retrievedNode2.Payload)
+	if string(retrievedNode2.Meta) != string(node2.Meta) {
+		t.Errorf("Expected node2 meta %s, got %s", node2.Meta, retrievedNode2.Meta)
 	}
 
-	// Test merging with empty payload on newer node
-	node1NewerEmptyPayload := &Node{
+	// Test merging with empty metadata on newer node: metadata is replaced
+	// as a whole, so the update clears it.
+	node1NewerEmptyMeta := &Node{
 		Addr:        addr1,
 		State:       Alive,
 		LastUpdated: node1Newer.LastUpdated.Add(1 * time.Second),
-		Payload:     "", // Empty payload
 	}
-	ml.Merge([]*Node{node1NewerEmptyPayload})
+	ml.Merge([]*Node{node1NewerEmptyMeta})
 	retrievedNode1, _ = ml.Get(addr1.String())
-	if retrievedNode1.Payload != node1Newer.Payload {
-		t.Errorf("Expected node1 payload to be preserved as %s, got %s", node1Newer.Payload, retrievedNode1.Payload)
+	if len(retrievedNode1.Meta) != 0 {
+		t.Errorf("Expected node1 meta to be cleared, got %s", retrievedNode1.Meta)
+	}
+}
+
+func TestMembershipList_Tombstones(t *testing.T) {
+	ml := NewMembershipList()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	now := time.Now()
+
+	ml.Add(&Node{Addr: addr, State: Alive, Incarnation: 1, LastUpdated: now})
+	ml.Merge([]*Node{{Addr: addr, State: Dead, Incarnation: 1, LastUpdated: now.Add(-time.Minute)}})
+
+	if _, ok := ml.Get(addr.String()); ok {
+		t.Fatal("Dead node still returned as a member")
+	}
+	if len(ml.Tombstones()) != 1 {
+		t.Fatalf("Expected 1 tombstone, got %d", len(ml.Tombstones()))
+	}
+
+	// Stale gossip claiming the node is alive must not resurrect it, even
+	// with a newer timestamp.
+	ml.Merge([]*Node{{Addr: addr, State: Alive, Incarnation: 1, LastUpdated: now.Add(time.Minute)}})
+	if _, ok := ml.Get(addr.String()); ok {
+		t.Fatal("Stale alive gossip resurrected a dead node")
+	}
+
+	// A higher incarnation reclaims the entry.
+	ml.Merge([]*Node{{Addr: addr, State: Alive, Incarnation: 2, LastUpdated: now}})
+	node, ok := ml.Get(addr.String())
+	if !ok {
+		t.Fatal("Node with higher incarnation did not reclaim its entry")
+	}
+	if node.Incarnation != 2 {
+		t.Errorf("Expected incarnation 2, got %d", node.Incarnation)
+	}
+	if len(ml.Tombstones()) != 0 {
+		t.Errorf("Expected tombstone to be removed on reclaim, got %d", len(ml.Tombstones()))
+	}
+}
+
+func TestMembershipList_Reap(t *testing.T) {
+	ml := NewMembershipList()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+
+	ml.Add(&Node{Addr: addr, State: Left, Incarnation: 3, LastUpdated: time.Now()})
+	if n := ml.Reap(time.Hour); n != 0 {
+		t.Errorf("Expected no tombstones reaped before retention, got %d", n)
+	}
+	if n := ml.Reap(0); n != 1 {
+		t.Errorf("Expected 1 tombstone reaped, got %d", n)
+	}
+
+	// Once reaped, the node can be learned about again from scratch.
+	ml.Add(&Node{Addr: addr, State: Alive, LastUpdated: time.Now()})
+	if _, ok := ml.Get(addr.String()); !ok {
+		t.Error("Node not added after its tombstone was reaped")
+	}
+}
+
+func TestMembershipList_ExpireSuspects(t *testing.T) {
+	ml := NewMembershipList()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	ml.Add(&Node{Addr: addr, State: Alive, LastUpdated: time.Now()})
+
+	if ml.Suspect(addr.String()) == nil {
+		t.Fatal("Expected alive node to become suspected")
+	}
+	if ml.Suspect(addr.String()) != nil {
+		t.Error("Suspecting an already suspected node reported a change")
+	}
+	if expired := ml.ExpireSuspects(time.Hour); len(expired) != 0 {
+		t.Errorf("Expected no expired suspects, got %d", len(expired))
+	}
+	expired := ml.ExpireSuspects(0)
+	if len(expired) != 1 || expired[0].State != Dead {
+		t.Fatalf("Expected one node declared dead, got %v", expired)
+	}
+	if _, ok := ml.Get(addr.String()); ok {
+		t.Error("Expired suspect still returned as a member")
+	}
+}
+
+func TestMembershipList_ViewVersion(t *testing.T) {
+	ml := NewMembershipList()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	now := time.Now()
+	ml.Add(&Node{Addr: addr, State: Alive, LastUpdated: now, Tags: map[string]string{"role": "api"}})
+
+	v1, nodes := ml.view(false)
+	if len(nodes) != 1 {
+		t.Fatalf("Expected 1 member, got %d", len(nodes))
+	}
+
+	// A stale update changes nothing, so the version must not move.
+	ml.Merge([]*Node{{Addr: addr, State: Alive, LastUpdated: now.Add(-time.Second)}})
+	if v, _ := ml.view(false); v != v1 {
+		t.Errorf("Expected version %d after a stale update, got %d", v1, v)
+	}
+
+	ml.Merge([]*Node{{Addr: addr, State: Alive, Incarnation: 1, LastUpdated: now}})
+	v2, _ := ml.view(false)
+	if v2 <= v1 {
+		t.Errorf("Expected version to increase past %d, got %d", v1, v2)
+	}
+
+	// Views are deep copies.
+	nodes[0].Tags["role"] = "mutated"
+	nodes[0].Addr.(*net.UDPAddr).Port = 1
+	if node, _ := ml.Get(addr.String()); node.Addr.(*net.UDPAddr).Port != 8080 {
+		t.Fatal("Mutating a view changed the member's address")
+	}
+	_, nodes = ml.view(false)
+	if nodes[0].Tags != nil {
+		t.Errorf("Expected the update to clear the tags, got %v", nodes[0].Tags)
 	}
 }
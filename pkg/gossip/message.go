@@ -10,12 +10,85 @@ const (
 	Ping MessageType = iota
 	// Sync is a message sent to a node to synchronize membership lists.
 	Sync
+	// Ack is the reply to a Ping, proving that the pinged node is alive.
+	Ack
+	// PushPull sends the full membership list and asks the receiver to
+	// answer with its own.
+	PushPull
+	// PushPullReply answers a PushPull with the receiver's membership list.
+	PushPullReply
+	// Compound bundles several encoded messages, such as queued broadcasts,
+	// into one packet.
+	Compound
+	// User carries an application message from a Delegate.
+	User
+	// UserBroadcast carries a message sent with Gossiper.Broadcast.
+	UserBroadcast
+	// Event carries a UserEvent.
+	Event
+	// Query asks the members matching its filters for a response.
+	Query
+	// QueryReply carries an ack or response to a Query back to its
+	// originator.
+	QueryReply
+	// Relay asks the receiver to forward a QueryReply to its originator.
+	Relay
+	// Direct carries a message sent to a single member with SendTo or
+	// SendReliable.
+	Direct
+	// Digest starts an anti-entropy round with a summary of the sender's
+	// membership list.
+	Digest
+	// DigestReply answers a Digest with the records the sender is missing
+	// and a request for the ones it holds newer versions of. The requested
+	// records are sent back in a Sync message.
+	DigestReply
 )
 
 // Message is the message that is sent between nodes.
 type Message struct {
 	Type    MessageType `json:"type"`
 	Payload []byte      `json:"payload"`
+	// Label is the cluster label of the sender. It travels inside the
+	// encrypted envelope when a SecureTransport is used, so it is
+	// authenticated along with the rest of the message.
+	Label string `json:"label,omitempty"`
+}
+
+// ping is the payload of a Ping message.
+type ping struct {
+	// Seq identifies the probe so that the Ack can be matched to it.
+	Seq uint32 `json:"seq"`
+	// From is the advertised address of the sender, where the Ack is sent.
+	From string `json:"from"`
+}
+
+// ack is the payload of an Ack message.
+type ack struct {
+	Seq uint32 `json:"seq"`
+	// From is the advertised address of the sender, which must be the
+	// address the acknowledged message was sent to.
+	From string `json:"from,omitempty"`
+	// Time is the wall time of the sender in nanoseconds since the Unix
+	// epoch when it answered a Ping, for clock skew estimation.
+	Time int64 `json:"time,omitempty"`
+}
+
+// pushPull is the payload of PushPull and PushPullReply messages.
+type pushPull struct {
+	Seq uint32 `json:"seq"`
+	// From is the advertised address of the sender: where a request is
+	// answered, and the address a reply must come from.
+	From  string  `json:"from,omitempty"`
+	Nodes []*Node `json:"nodes"`
+	// State is the application state of the sender's Delegate, if any.
+	State []byte `json:"state,omitempty"`
+	// Join is set when the exchange is part of joining the cluster.
+	Join bool `json:"join,omitempty"`
+	// EventLTime is the time of the sender's event clock.
+	EventLTime uint64 `json:"event_ltime,omitempty"`
+	// Events replays the sender's recent user events to a joining member.
+	Events []UserEvent `json:"events,omitempty"`
 }
 
 // Encode encodes a message to JSON.
@@ -17,6 +17,8 @@ const (
 	Suspected
 	// Dead is the state of a node that is confirmed to be dead.
 	Dead
+	// Left is the state of a node that has left the cluster voluntarily.
+	Left
 )
 
 func (s State) String() string {
@@ -27,41 +29,145 @@ func (s State) String() string {
 		return "suspected"
 	case Dead:
 		return "dead"
+	case Left:
+		return "left"
 	default:
 		return "unknown"
 	}
 }
 
+// isTombstone reports whether a node in this state is no longer a member and
+// is only remembered so that stale gossip about it can be rejected.
+func (s State) isTombstone() bool {
+	return s == Dead || s == Left
+}
+
 // Node represents a single member in the cluster.
 type Node struct {
+	// Name is the name the node was created with. It identifies the node to
+	// applications; the address identifies it to the protocol.
+	Name string
 	// Addr is the network address of the node.
 	Addr net.Addr
 	// State is the current state of the node.
 	State State
-	// LastUpdated is the time when the node's state was last updated.
+	// Incarnation is bumped by the node itself whenever it refutes a
+	// suspicion or rejoins, so that its own claims override older gossip.
+	Incarnation uint64
+	// Version is the hybrid logical clock timestamp of the last update. It
+	// orders updates within an incarnation independent of wall clock skew.
+	Version Timestamp
+	// LastUpdated is the wall time of the last update, as seen by whoever
+	// made it. It is for display only; Version orders updates.
 	LastUpdated time.Time
-	// Payload is a custom payload associated with the node.
-	Payload string
+	// ClockOffset is the estimated offset of the node's wall clock from the
+	// local one, positive if the node's clock is ahead, measured from probe
+	// round trips. ClockUncertainty bounds its error. Both are local
+	// observations and are not gossiped; they are zero until measured.
+	ClockOffset      time.Duration
+	ClockUncertainty time.Duration
+	// Tags is structured metadata about the node, such as its role, zone or
+	// version. It is replaced as a whole on every update and must not be
+	// modified in place.
+	Tags map[string]string
+	// Meta is opaque metadata for applications that use their own encoding.
+	// Like Tags, it is replaced as a whole on every update.
+	Meta []byte
 }
 
 func (n *Node) String() string {
-	return fmt.Sprintf("Node{Addr: %s, State: %s, Payload: %s, LastUpdated: %v}", n.Addr, n.State, n.Payload, n.LastUpdated)
+	return fmt.Sprintf("Node{Name: %s, Addr: %s, State: %s, Incarnation: %d, Tags: %v, Meta: %d bytes, LastUpdated: %v}", n.Name, n.Addr, n.State, n.Incarnation, n.Tags, len(n.Meta), n.LastUpdated)
+}
+
+// Tag returns the value of the tag with the given key.
+func (n *Node) Tag(key string) (string, bool) {
+	v, ok := n.Tags[key]
+	return v, ok
+}
+
+// HasTag reports whether the node has the tag key set to value.
+func (n *Node) HasTag(key, value string) bool {
+	v, ok := n.Tags[key]
+	return ok && v == value
+}
+
+// MetadataSize returns the number of bytes of metadata the node carries: the
+// length of every tag key and value plus the length of Meta.
+func (n *Node) MetadataSize() int {
+	return metadataSize(n.Tags, n.Meta)
+}
+
+func metadataSize(tags map[string]string, meta []byte) int {
+	size := len(meta)
+	for k, v := range tags {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// clone returns a deep copy of n that shares no memory with it.
+func (n *Node) clone() Node {
+	c := *n
+	if addr, ok := n.Addr.(*net.UDPAddr); ok {
+		a := *addr
+		a.IP = append(net.IP(nil), addr.IP...)
+		c.Addr = &a
+	}
+	if n.Tags != nil {
+		c.Tags = make(map[string]string, len(n.Tags))
+		for k, v := range n.Tags {
+			c.Tags[k] = v
+		}
+	}
+	if n.Meta != nil {
+		c.Meta = append([]byte(nil), n.Meta...)
+	}
+	return c
+}
+
+// supersedes reports whether n carries newer information about a node than
+// existing. A higher incarnation always wins. Within an incarnation, a more
+// severe state (alive < suspected < dead < left) wins, and only then the more
+// recent update by version. Wall time is only compared for entries from older
+// versions that carry no hybrid timestamp.
+func (n *Node) supersedes(existing *Node) bool {
+	if n.Incarnation != existing.Incarnation {
+		return n.Incarnation > existing.Incarnation
+	}
+	if n.State != existing.State {
+		return n.State > existing.State
+	}
+	if !n.Version.IsZero() && !existing.Version.IsZero() {
+		return n.Version.After(existing.Version)
+	}
+	return n.LastUpdated.After(existing.LastUpdated)
 }
 
 type nodeJSON struct {
-	Addr        string    `json:"addr"`
-	State       State     `json:"state"`
-	LastUpdated time.Time `json:"last_updated"`
-	Payload     string    `json:"payload"`
+	Name        string            `json:"name,omitempty"`
+	Addr        string            `json:"addr"`
+	State       State             `json:"state"`
+	Incarnation uint64            `json:"incarnation"`
+	Version     Timestamp         `json:"version,omitzero"`
+	LastUpdated time.Time         `json:"last_updated"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Meta        []byte            `json:"meta,omitempty"`
+	// Payload is the metadata field of older versions. It is still read so
+	// that mixed-version clusters keep their metadata.
+	Payload string `json:"payload,omitempty"`
 }
 
 // MarshalJSON implements the json.Marshaler interface.
 func (n *Node) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&nodeJSON{
+		Name:        n.Name,
 		Addr:        n.Addr.String(),
 		State:       n.State,
+		Incarnation: n.Incarnation,
+		Version:     n.Version,
 		LastUpdated: n.LastUpdated,
-		Payload:     n.Payload,
+		Tags:        n.Tags,
+		Meta:        n.Meta,
 	})
 }
 
@@ -72,15 +178,22 @@ func (n *Node) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", obj.Addr)
+	addr, err := resolveAddr(obj.Addr)
 	if err != nil {
 		return err
 	}
 
+	n.Name = obj.Name
 	n.Addr = addr
 	n.State = obj.State
+	n.Incarnation = obj.Incarnation
+	n.Version = obj.Version
 	n.LastUpdated = obj.LastUpdated
-	n.Payload = obj.Payload
+	n.Tags = obj.Tags
+	n.Meta = obj.Meta
+	if n.Meta == nil && obj.Payload != "" {
+		n.Meta = []byte(obj.Payload)
+	}
 
 	return nil
 }
@@ -0,0 +1,63 @@
+package gossip
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNode_JSONIPv6(t *testing.T) {
+	for _, addr := range []string{"[2001:db8::1]:7946", "[fe80::1%eth0]:7946", "10.0.0.1:7946"} {
+		udpAddr, err := resolveAddr(addr)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %v", addr, err)
+		}
+		node := &Node{Addr: udpAddr, State: Alive, LastUpdated: time.Now()}
+
+		data, err := json.Marshal(node)
+		if err != nil {
+			t.Fatalf("failed to marshal node: %v", err)
+		}
+
+		var decoded Node
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("failed to unmarshal %s: %v", data, err)
+		}
+		if decoded.Addr.String() != addr {
+			t.Errorf("Expected address %s after round trip, got %s", addr, decoded.Addr)
+		}
+		if _, ok := decoded.Addr.(*net.UDPAddr); !ok {
+			t.Errorf("Expected *net.UDPAddr, got %T", decoded.Addr)
+		}
+	}
+}
+
+func TestNode_JSONMetadata(t *testing.T) {
+	addr, _ := resolveAddr("10.0.0.1:7946")
+	node := &Node{Addr: addr, Tags: map[string]string{"role": "db"}, Meta: []byte{0, 1, 2}}
+
+	data, err := json.Marshal(node)
+	if err != nil {
+		t.Fatalf("failed to marshal node: %v", err)
+	}
+	var decoded Node
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal node: %v", err)
+	}
+	if !decoded.HasTag("role", "db") {
+		t.Errorf("Expected role tag to survive round trip, got %v", decoded.Tags)
+	}
+	if string(decoded.Meta) != string(node.Meta) {
+		t.Errorf("Expected meta %v, got %v", node.Meta, decoded.Meta)
+	}
+
+	// Nodes running older versions send a payload string instead.
+	legacy := []byte(`{"addr":"10.0.0.2:7946","state":0,"payload":"legacy"}`)
+	if err := json.Unmarshal(legacy, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal legacy node: %v", err)
+	}
+	if string(decoded.Meta) != "legacy" {
+		t.Errorf("Expected legacy payload as meta, got %q", decoded.Meta)
+	}
+}
@@ -0,0 +1,114 @@
+package gossip
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// probe pings a random member and waits up to the probe timeout for its Ack.
+// A member that does not answer is marked as suspected.
+func (g *Gossiper) probe() {
+	node := g.randomPeer()
+	if node == nil {
+		return
+	}
+	addr := node.Addr.String()
+
+	seq, acked, done := g.expectReply(addr)
+	defer done()
+
+	payload, err := json.Marshal(&ping{Seq: seq, From: g.self.Addr.String()})
+	if err != nil {
+		return
+	}
+	msg := &Message{
+		Type:    Ping,
+		Payload: payload,
+	}
+
+	// Send the message.
+	sent := time.Now()
+	if err := g.send(msg, addr); err != nil {
+		// Log.Printf("[%s] failed to send message to %s: %v", g.name, addr, err)
+	}
+
+	timer := time.NewTimer(g.probeTimeout)
+	defer timer.Stop()
+	select {
+	case data := <-acked:
+		var a ack
+		if err := json.Unmarshal(data, &a); err == nil && a.Time != 0 {
+			g.observeSkew(addr, sent, time.Now(), a.Time)
+		}
+	case <-timer.C:
+		if node := g.members.Suspect(addr); node != nil {
+			g.broadcastNode(node, 0)
+		}
+	case <-g.stop:
+	}
+}
+
+// expire declares long-suspected members dead and reaps old tombstones.
+func (g *Gossiper) expire() {
+	for _, node := range g.members.ExpireSuspects(g.suspicionTimeout) {
+		g.broadcastNode(node, 0)
+	}
+	g.members.Reap(g.tombstoneRetention)
+}
+
+func (g *Gossiper) handlePing(payload []byte) {
+	// Pings from older nodes carry no payload and expect no Ack.
+	if len(payload) == 0 {
+		return
+	}
+	var p ping
+	if err := json.Unmarshal(payload, &p); err != nil || p.From == "" {
+		return
+	}
+
+	data, err := json.Marshal(&ack{Seq: p.Seq, From: g.self.Addr.String(), Time: time.Now().UnixNano()})
+	if err != nil {
+		return
+	}
+	g.send(&Message{Type: Ack, Payload: data}, p.From)
+
+	// A node we consider dead is evidently running again. Tell it about
+	// its tombstone so it can refute it with a higher incarnation.
+	if ts, ok := g.members.tombstoned(p.From); ok {
+		g.sendNodes([]*Node{ts}, p.From)
+	}
+}
+
+func (g *Gossiper) handleAck(payload []byte) {
+	var a ack
+	if err := json.Unmarshal(payload, &a); err != nil {
+		return
+	}
+	g.deliverReply(a.Seq, a.From, payload)
+}
+
+// refute handles gossip about the local node. Nobody else may change our
+// state, so claims that we are suspected or dead, or that we hold a higher
+// incarnation than we do, are answered by bumping our incarnation past them.
+func (g *Gossiper) refute(claim *Node) {
+	var refuted *Node
+	g.members.update(g.self, func(self *Node) {
+		if self.State == Left {
+			return
+		}
+		if claim.Incarnation < self.Incarnation {
+			return
+		}
+		if claim.Incarnation == self.Incarnation && claim.State == Alive {
+			return
+		}
+		self.Incarnation = claim.Incarnation + 1
+		self.State = Alive
+		g.members.stamp(self)
+		n := *self
+		refuted = &n
+	})
+	if refuted != nil {
+		g.broadcastNode(refuted, 0)
+	}
+}
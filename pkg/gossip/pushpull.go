@@ -0,0 +1,158 @@
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// pushPullScaleThreshold is the cluster size up to which the configured
+// push-pull interval is used as is.
+const pushPullScaleThreshold = 32
+
+// errPushPullTimeout is returned when a push-pull peer does not answer in
+// time.
+var errPushPullTimeout = errors.New("push-pull timed out")
+
+// pushPull sends our full membership list and application state to addr and
+// merges what it answers with. It waits at most timeout for the answer. join
+// is passed on to the delegates on both sides.
+func (g *Gossiper) pushPull(addr string, timeout time.Duration, join bool) error {
+	// A seed may advertise another address than the one it is known by,
+	// so replies to a join are accepted from any address.
+	expect := addr
+	if join {
+		expect = ""
+	}
+	seq, reply, done := g.expectReply(expect)
+	defer done()
+
+	payload, err := json.Marshal(&pushPull{
+		Seq:        seq,
+		From:       g.self.Addr.String(),
+		Nodes:      g.members.snapshot(),
+		State:      g.localState(join),
+		Join:       join,
+		EventLTime: g.eventClock.Time(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := g.send(&Message{Type: PushPull, Payload: payload}, addr); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case data := <-reply:
+		var p pushPull
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		g.mergeRemote(p.Nodes)
+		g.mergeRemoteState(p.State, join)
+		g.replayEvents(p.EventLTime, p.Events)
+		return nil
+	case <-timer.C:
+		return errPushPullTimeout
+	case <-g.stop:
+		return errPushPullTimeout
+	}
+}
+
+// handlePushPull merges the requester's list and answers with ours. The
+// answer is built after merging, so it already contains any refutation the
+// request provoked. A joining requester also receives the recent user events.
+func (g *Gossiper) handlePushPull(payload []byte) {
+	var req pushPull
+	if err := json.Unmarshal(payload, &req); err != nil || req.From == "" {
+		return
+	}
+	g.mergeRemote(req.Nodes)
+	g.mergeRemoteState(req.State, req.Join)
+	g.replayEvents(req.EventLTime, nil)
+
+	reply := &pushPull{
+		Seq:        req.Seq,
+		From:       g.self.Addr.String(),
+		Nodes:      g.members.snapshot(),
+		State:      g.localState(req.Join),
+		EventLTime: g.eventClock.Time(),
+	}
+	if req.Join {
+		reply.Events = g.events.recent()
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	g.send(&Message{Type: PushPullReply, Payload: data}, req.From)
+}
+
+// pushPullScale returns the push-pull interval for a cluster of n members:
+// the base interval up to pushPullScaleThreshold members, and one more
+// interval each time the cluster doubles beyond that. Every exchange carries
+// the full list, so without scaling the cluster-wide traffic would grow with
+// the square of its size.
+func pushPullScale(interval time.Duration, n int) time.Duration {
+	if n <= pushPullScaleThreshold {
+		return interval
+	}
+	mult := math.Ceil(math.Log2(float64(n))-math.Log2(pushPullScaleThreshold)) + 1
+	return time.Duration(mult) * interval
+}
+
+// pushPullLoop periodically runs a push-pull exchange with a random member.
+// The first exchange is delayed by a random fraction of the interval so that
+// members started together do not exchange in lockstep.
+func (g *Gossiper) pushPullLoop() {
+	defer g.wg.Done()
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(g.pushPullInterval))))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if node := g.randomPeer(); node != nil {
+				if err := g.pushPull(node.Addr.String(), g.pushPullTimeout, false); err != nil {
+					// Log.Printf("[%s] failed to push-pull with %s: %v", g.name, node.Addr.String(), err)
+				}
+			}
+			timer.Reset(pushPullScale(g.pushPullInterval, len(g.members.All())))
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// reconnectLoop periodically gossips to a recently dead member. When a
+// partition heals, this is how the two sides find each other again, since
+// neither probes members it considers dead.
+func (g *Gossiper) reconnectLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.reconnect()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *Gossiper) reconnect() {
+	dead := g.members.deadSince(g.reconnectMaxAge)
+	if len(dead) == 0 {
+		return
+	}
+	node := dead[rand.Intn(len(dead))]
+	if err := g.pushPull(node.Addr.String(), g.reconnectTimeout, false); err != nil {
+		// Log.Printf("[%s] failed to reconnect to %s: %v", g.name, node.Addr.String(), err)
+	}
+}
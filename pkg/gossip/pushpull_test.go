@@ -0,0 +1,62 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushPullScale(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 30 * time.Second},
+		{32, 30 * time.Second},
+		{33, 60 * time.Second},
+		{64, 60 * time.Second},
+		{65, 90 * time.Second},
+		{1000, 6 * 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := pushPullScale(30*time.Second, tt.n); got != tt.want {
+			t.Errorf("pushPullScale(30s, %d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestGossiper_PeriodicPushPull(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7093", "127.0.0.1:7094"}
+
+	// Probing is effectively off, so only push-pull can carry state.
+	opts := []Option{
+		WithProbeInterval(time.Hour),
+		WithPushPull(50*time.Millisecond, 20*time.Millisecond),
+	}
+	var gossipers []*Gossiper
+	for _, addr := range addrs {
+		g, err := NewGossiper(addr, addr, nil, network.Transport(addr), opts...)
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		gossipers = append(gossipers, g)
+	}
+	if err := gossipers[1].SetTags(map[string]string{"role": "db"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+
+	// Only the first node knows of the second, so only it can start an
+	// exchange; the second must learn of the first from the request, and the
+	// first of the second's tags from the answer.
+	addMember(gossipers[0], 7094)
+	for _, g := range gossipers {
+		g.Start()
+		defer g.Stop()
+	}
+
+	waitFor(t, 2*time.Second, "both sides to merge each other's state", func() bool {
+		n1, ok1 := lookup(gossipers[0].members, addrs[1])
+		_, ok2 := lookup(gossipers[1].members, addrs[0])
+		return ok1 && ok2 && n1.HasTag("role", "db")
+	})
+}
@@ -0,0 +1,410 @@
+package gossip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueryHandler answers a query received from the cluster. It returns the
+// response to send back to the originator and whether to respond at all. It is
+// called from the gossiper's receive goroutine, so it should return quickly.
+type QueryHandler func(name string, payload []byte) (response []byte, ok bool)
+
+// QueryParam restricts and tunes a query. The zero value queries every member
+// with the default timeout.
+type QueryParam struct {
+	// FilterNodes limits the query to the members with these names or
+	// advertised addresses. Empty means every member.
+	FilterNodes []string
+	// FilterTags limits the query to the members that have every one of these
+	// tags set to the given value.
+	FilterTags map[string]string
+	// RequestAck asks every matching member to acknowledge the query as soon
+	// as it receives it, before running its handler.
+	RequestAck bool
+	// RelayFactor is the number of other members each response and ack is
+	// additionally sent through, so that it survives a lost direct path.
+	RelayFactor int
+	// Timeout bounds how long responses are collected. Zero derives it from
+	// the cluster size.
+	Timeout time.Duration
+}
+
+// NodeResponse is a response to a query from one member.
+type NodeResponse struct {
+	// From is the advertised address of the responding member.
+	From    string
+	Payload []byte
+}
+
+// QueryResponse collects the acks and responses to a query until its
+// deadline. Each member's ack and response are delivered at most once.
+type QueryResponse struct {
+	deadline time.Time
+	ackCh    chan string
+	respCh   chan NodeResponse
+	// dropped counts the acks and responses lost to full channels.
+	dropped *atomic.Uint64
+
+	mu        sync.Mutex
+	closed    bool
+	acks      map[string]struct{}
+	responses map[string]struct{}
+}
+
+// AckCh returns the channel on which the addresses of acknowledging members
+// are delivered. It is nil unless the query requested acks, and is closed
+// when the query finishes.
+func (r *QueryResponse) AckCh() <-chan string {
+	return r.ackCh
+}
+
+// ResponseCh returns the channel on which responses are delivered. It is
+// closed when the query finishes.
+func (r *QueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.respCh
+}
+
+// Deadline returns the time at which the query finishes.
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Finished reports whether the query has finished collecting responses.
+func (r *QueryResponse) Finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Close stops collecting responses and closes the channels. It is called
+// automatically at the deadline.
+func (r *QueryResponse) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.ackCh != nil {
+		close(r.ackCh)
+	}
+	close(r.respCh)
+}
+
+// deliver passes an ack or response from a member on. Channels are buffered
+// for the members known when the query was issued, so a reader that is not
+// keeping up loses the excess, such as replies from members that joined since,
+// rather than blocking the gossiper. Lost replies are counted in Stats.
+func (r *QueryResponse) deliver(reply *queryReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if reply.Ack {
+		if _, ok := r.acks[reply.From]; ok || r.ackCh == nil {
+			return
+		}
+		r.acks[reply.From] = struct{}{}
+		select {
+		case r.ackCh <- reply.From:
+		default:
+			r.dropped.Add(1)
+		}
+		return
+	}
+	if _, ok := r.responses[reply.From]; ok {
+		return
+	}
+	r.responses[reply.From] = struct{}{}
+	select {
+	case r.respCh <- NodeResponse{From: reply.From, Payload: reply.Payload}:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// query is the payload of a Query message.
+type query struct {
+	ID          string            `json:"id"`
+	From        string            `json:"from"`
+	Name        string            `json:"name"`
+	Payload     []byte            `json:"payload,omitempty"`
+	FilterNodes []string          `json:"filter_nodes,omitempty"`
+	FilterTags  map[string]string `json:"filter_tags,omitempty"`
+	RequestAck  bool              `json:"ack,omitempty"`
+	RelayFactor int               `json:"relay,omitempty"`
+}
+
+// queryReply is the payload of a QueryReply message, carrying either an ack
+// or a response.
+type queryReply struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	Ack     bool   `json:"ack,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// relay is the payload of a Relay message: an encoded message for the
+// receiver to forward to Dest.
+type relay struct {
+	Dest string `json:"dest"`
+	Msg  []byte `json:"msg"`
+}
+
+// Query gossips a query to the members matching params, the local node
+// included, and returns a QueryResponse that collects their acks and
+// responses until the timeout expires or ctx is done. params may be nil.
+func (g *Gossiper) Query(ctx context.Context, name string, payload []byte, params *QueryParam) (*QueryResponse, error) {
+	if params == nil {
+		params = &QueryParam{}
+	}
+	if size := len(name) + len(payload); size > g.maxBroadcastSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrBroadcastTooLarge, size, g.maxBroadcastSize)
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	q := &query{
+		ID:          hex.EncodeToString(id[:]),
+		From:        g.self.Addr.String(),
+		Name:        name,
+		Payload:     payload,
+		FilterNodes: params.FilterNodes,
+		FilterTags:  params.FilterTags,
+		RequestAck:  params.RequestAck,
+		RelayFactor: params.RelayFactor,
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = g.defaultQueryTimeout()
+	}
+	n := len(g.members.All())
+	resp := &QueryResponse{
+		deadline:  time.Now().Add(timeout),
+		respCh:    make(chan NodeResponse, n),
+		dropped:   &g.queryDropped,
+		acks:      make(map[string]struct{}),
+		responses: make(map[string]struct{}),
+	}
+	if params.RequestAck {
+		resp.ackCh = make(chan string, n)
+	}
+
+	g.queriesMu.Lock()
+	g.queries[q.ID] = resp
+	g.queriesMu.Unlock()
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		case <-g.stop:
+		}
+		g.queriesMu.Lock()
+		delete(g.queries, q.ID)
+		g.queriesMu.Unlock()
+		resp.Close()
+	}()
+
+	g.seenQueries.add(q.ID)
+	if err := g.queueQuery(q); err != nil {
+		resp.Close()
+		return nil, err
+	}
+	g.answerQuery(q)
+	return resp, nil
+}
+
+// defaultQueryTimeout is the time a query takes to reach every member with
+// high probability: a multiple of the gossip interval that grows
+// logarithmically with the cluster size.
+func (g *Gossiper) defaultQueryTimeout() time.Duration {
+	n := len(g.members.All())
+	scale := math.Ceil(math.Log10(float64(n + 1)))
+	return time.Duration(float64(g.queryTimeoutMult) * scale * float64(g.gossipInterval))
+}
+
+func (g *Gossiper) queueQuery(q *query) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	msg, err := (&Message{Type: Query, Payload: data}).Encode()
+	if err != nil {
+		return err
+	}
+	g.broadcasts.queue(&broadcast{
+		key:    "query:" + q.ID,
+		msg:    msg,
+		sentTo: make(map[string]struct{}),
+	})
+	g.kickGossip()
+	return nil
+}
+
+// handleQuery passes on a query seen for the first time and answers it if the
+// local node matches its filters.
+func (g *Gossiper) handleQuery(payload []byte) {
+	var q query
+	if err := json.Unmarshal(payload, &q); err != nil || q.ID == "" || q.From == "" {
+		g.malformed.Add(1)
+		return
+	}
+	if len(q.Name)+len(q.Payload) > g.maxBroadcastSize {
+		g.malformed.Add(1)
+		return
+	}
+	if !g.seenQueries.add(q.ID) {
+		return
+	}
+	g.queueQuery(&q)
+	g.answerQuery(&q)
+}
+
+// answerQuery acks and answers q if the local node matches its filters.
+func (g *Gossiper) answerQuery(q *query) {
+	if !g.matchesQuery(q) {
+		return
+	}
+	if q.RequestAck {
+		g.replyQuery(q, &queryReply{ID: q.ID, From: g.self.Addr.String(), Ack: true})
+	}
+	if g.queryHandler == nil {
+		return
+	}
+	response, ok := g.queryHandler(q.Name, q.Payload)
+	if !ok {
+		return
+	}
+	if len(response) > g.maxBroadcastSize {
+		// Log.Printf("[%s] dropping query response of %d bytes", g.name, len(response))
+		return
+	}
+	g.replyQuery(q, &queryReply{ID: q.ID, From: g.self.Addr.String(), Payload: response})
+}
+
+// matchesQuery reports whether the local node passes the filters of q.
+func (g *Gossiper) matchesQuery(q *query) bool {
+	self := g.self.Addr.String()
+	if len(q.FilterNodes) > 0 {
+		found := false
+		for _, n := range q.FilterNodes {
+			if n == g.name || n == self {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(q.FilterTags) > 0 {
+		tags := g.Tags()
+		for k, v := range q.FilterTags {
+			if t, ok := tags[k]; !ok || t != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// replyQuery sends an ack or response to the originator of q, directly and
+// through RelayFactor other members. Replies to the local node are delivered
+// in place.
+func (g *Gossiper) replyQuery(q *query, reply *queryReply) {
+	if q.From == g.self.Addr.String() {
+		g.deliverQueryReply(reply)
+		return
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	msg := &Message{Type: QueryReply, Payload: data}
+	if err := g.send(msg, q.From); err != nil {
+		// Log.Printf("[%s] failed to send query reply to %s: %v", g.name, q.From, err)
+	}
+	if q.RelayFactor <= 0 {
+		return
+	}
+
+	// msg was labeled and encoded by send, so relays forward it as is.
+	encoded, err := msg.Encode()
+	if err != nil {
+		return
+	}
+	data, err = json.Marshal(&relay{Dest: q.From, Msg: encoded})
+	if err != nil {
+		return
+	}
+	self := g.self.Addr.String()
+	nodes := g.members.All()
+	relays := 0
+	for _, i := range mathrand.Perm(len(nodes)) {
+		if relays == q.RelayFactor {
+			break
+		}
+		addr := nodes[i].Addr.String()
+		if addr == self || addr == q.From || nodes[i].State != Alive {
+			continue
+		}
+		relays++
+		g.send(&Message{Type: Relay, Payload: data}, addr)
+	}
+}
+
+// handleQueryReply delivers an ack or response to the pending query.
+func (g *Gossiper) handleQueryReply(payload []byte) {
+	var reply queryReply
+	if err := json.Unmarshal(payload, &reply); err != nil || reply.ID == "" {
+		g.malformed.Add(1)
+		return
+	}
+	g.deliverQueryReply(&reply)
+}
+
+func (g *Gossiper) deliverQueryReply(reply *queryReply) {
+	g.queriesMu.Lock()
+	resp, ok := g.queries[reply.ID]
+	g.queriesMu.Unlock()
+	if ok {
+		resp.deliver(reply)
+	}
+}
+
+// handleRelay forwards a query reply on behalf of another member. Only
+// replies to known members are forwarded, so relays cannot be used to reach
+// arbitrary addresses.
+func (g *Gossiper) handleRelay(payload []byte) {
+	var r relay
+	if err := json.Unmarshal(payload, &r); err != nil {
+		g.malformed.Add(1)
+		return
+	}
+	if msg, err := Decode(r.Msg); err != nil || msg.Type != QueryReply {
+		g.malformed.Add(1)
+		return
+	}
+	if _, ok := g.members.Get(r.Dest); !ok {
+		return
+	}
+	if err := g.transport.Write(r.Msg, r.Dest); err != nil {
+		// Log.Printf("[%s] failed to relay message to %s: %v", g.name, r.Dest, err)
+	}
+}
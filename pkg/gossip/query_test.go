@@ -0,0 +1,199 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startQueryCluster starts gossipers at addrs whose query handlers answer
+// "name" queries with their own address, tagged with the given tags.
+func startQueryCluster(t *testing.T, network *mockNetwork, addrs []string, tags []map[string]string) []*Gossiper {
+	t.Helper()
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		addr := addr
+		handler := func(name string, payload []byte) ([]byte, bool) {
+			if name != "name" {
+				return nil, false
+			}
+			return []byte(addr), true
+		}
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), WithQueryHandler(handler))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		if err := g.SetTags(tags[i]); err != nil {
+			t.Fatalf("failed to set tags: %v", err)
+		}
+		g.Start()
+		t.Cleanup(g.Stop)
+		gossipers = append(gossipers, g)
+	}
+	return gossipers
+}
+
+// collect drains a query's channels until it finishes.
+func collect(resp *QueryResponse) (acks, responses []string) {
+	ackCh := resp.AckCh()
+	respCh := resp.ResponseCh()
+	for ackCh != nil || respCh != nil {
+		select {
+		case a, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			acks = append(acks, a)
+		case r, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				continue
+			}
+			responses = append(responses, string(r.Payload))
+		}
+	}
+	sort.Strings(acks)
+	sort.Strings(responses)
+	return acks, responses
+}
+
+func TestGossiper_Query(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7061", "127.0.0.1:7062", "127.0.0.1:7063", "127.0.0.1:7064"}
+	tags := []map[string]string{
+		{"cache": "x"},
+		{"cache": "x"},
+		{"cache": "y"},
+		{"cache": "x"},
+	}
+	gossipers := startQueryCluster(t, network, addrs, tags)
+
+	resp, err := gossipers[0].Query(context.Background(), "name", nil, &QueryParam{
+		FilterTags: map[string]string{"cache": "x"},
+		RequestAck: true,
+		Timeout:    500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	acks, responses := collect(resp)
+
+	want := []string{addrs[0], addrs[1], addrs[3]}
+	if len(responses) != len(want) {
+		t.Fatalf("Expected responses from %v, got %v", want, responses)
+	}
+	for i := range want {
+		if responses[i] != want[i] || acks[i] != want[i] {
+			t.Errorf("Expected acks and responses from %v, got acks %v and responses %v", want, acks, responses)
+			break
+		}
+	}
+	if !resp.Finished() {
+		t.Error("Expected the query to be finished after its channels closed")
+	}
+}
+
+func TestGossiper_QueryFilterNodes(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7065", "127.0.0.1:7066", "127.0.0.1:7067"}
+	gossipers := startQueryCluster(t, network, addrs, make([]map[string]string, len(addrs)))
+
+	resp, err := gossipers[0].Query(context.Background(), "name", nil, &QueryParam{
+		FilterNodes: []string{addrs[2]},
+		Timeout:     300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, responses := collect(resp); len(responses) != 1 || responses[0] != addrs[2] {
+		t.Errorf("Expected a response from %s only, got %v", addrs[2], responses)
+	}
+}
+
+func TestGossiper_QueryRelay(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7068", "127.0.0.1:7069", "127.0.0.1:7070"}
+	gossipers := startQueryCluster(t, network, addrs, []map[string]string{nil, {"role": "target"}, nil})
+
+	// The target can receive from the originator but not answer it
+	// directly, so its response must arrive through the third node.
+	network.SetLinkDown(addrs[1], addrs[0], true)
+	resp, err := gossipers[0].Query(context.Background(), "name", nil, &QueryParam{
+		FilterTags:  map[string]string{"role": "target"},
+		RelayFactor: 1,
+		Timeout:     500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, responses := collect(resp); len(responses) != 1 || responses[0] != addrs[1] {
+		t.Errorf("Expected a relayed response from %s, got %v", addrs[1], responses)
+	}
+}
+
+func TestGossiper_QueryCancel(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport())
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	if d := g.defaultQueryTimeout(); d != time.Duration(DefaultQueryTimeoutMult)*DefaultGossipInterval {
+		t.Errorf("Expected a default timeout of %v for a single node, got %v", time.Duration(DefaultQueryTimeoutMult)*DefaultGossipInterval, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := g.Query(ctx, "name", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	cancel()
+	select {
+	case _, ok := <-resp.ResponseCh():
+		if ok {
+			t.Error("Expected no responses without a query handler")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the canceled query to finish")
+	}
+}
+
+// TestGossiper_QueryDropped checks that responses from members that joined
+// after the query was issued, beyond what its channels can hold, are counted
+// rather than lost silently.
+func TestGossiper_QueryDropped(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport())
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	resp, err := g.Query(context.Background(), "name", nil, &QueryParam{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	var id string
+	g.queriesMu.Lock()
+	for id = range g.queries {
+	}
+	g.queriesMu.Unlock()
+
+	// Three members join and answer while nobody reads the responses.
+	for port := 7947; port < 7950; port++ {
+		addMember(g, port)
+		payload, err := json.Marshal(&queryReply{ID: id, From: fmt.Sprintf("127.0.0.1:%d", port), Payload: []byte("x")})
+		if err != nil {
+			t.Fatalf("failed to marshal reply: %v", err)
+		}
+		g.handleQueryReply(payload)
+	}
+
+	_, responses := collect(resp)
+	if len(responses) != 1 {
+		t.Errorf("Expected the single buffered response, got %d", len(responses))
+	}
+	if got := g.Stats().QueryDropped; got != 2 {
+		t.Errorf("Expected 2 dropped responses, got %d", got)
+	}
+}
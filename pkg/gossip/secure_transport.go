@@ -4,18 +4,92 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDecryptWorkers is the number of goroutines decrypting inbound
+	// packets when no WithDecryptWorkers option is given.
+	DefaultDecryptWorkers = 1
+	// DefaultSecureQueueSize is the capacity of the decrypted packet queue
+	// when no WithSecureQueueSize option is given.
+	DefaultSecureQueueSize = 64
 )
 
 // SecureTransport is a transport that encrypts and decrypts messages.
+//
+// Inbound packets are decrypted by a fixed pool of workers started by
+// NewSecureTransport and delivered on a single channel, so every call to Read
+// observes the same stream of packets. When the consumer falls behind, the
+// workers stop pulling from the underlying transport (backpressure), or, if a
+// delivery timeout is configured, discard the packet and count it as dropped.
 type SecureTransport struct {
 	transport Transport
 	aead      cipher.AEAD
+
+	workers         int
+	queueSize       int
+	deliveryTimeout time.Duration
+
+	out      chan []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	received atomic.Uint64
+	rejected atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// SecureTransportOption configures a SecureTransport.
+type SecureTransportOption func(*SecureTransport)
+
+// WithDecryptWorkers sets the number of goroutines that decrypt inbound
+// packets in parallel. Values below one are ignored.
+func WithDecryptWorkers(n int) SecureTransportOption {
+	return func(t *SecureTransport) {
+		if n > 0 {
+			t.workers = n
+		}
+	}
+}
+
+// WithSecureQueueSize sets how many decrypted packets may wait for the
+// consumer before the workers apply backpressure. Negative values are ignored.
+func WithSecureQueueSize(n int) SecureTransportOption {
+	return func(t *SecureTransport) {
+		if n >= 0 {
+			t.queueSize = n
+		}
+	}
 }
 
-// NewSecureTransport creates a new secure transport.
-func NewSecureTransport(transport Transport, key []byte) (*SecureTransport, error) {
+// WithDeliveryTimeout bounds how long a worker waits for a slow consumer
+// before dropping a decrypted packet. Zero, the default, waits indefinitely.
+func WithDeliveryTimeout(d time.Duration) SecureTransportOption {
+	return func(t *SecureTransport) {
+		t.deliveryTimeout = d
+	}
+}
+
+// SecureTransportStats holds packet counters for a SecureTransport.
+type SecureTransportStats struct {
+	// Received is the number of packets successfully decrypted.
+	Received uint64
+	// Rejected is the number of packets that were too short or failed
+	// authentication.
+	Rejected uint64
+	// Dropped is the number of decrypted packets discarded because the
+	// consumer did not read them within the delivery timeout.
+	Dropped uint64
+}
+
+// NewSecureTransport creates a new secure transport and starts its decrypt
+// pipeline.
+func NewSecureTransport(transport Transport, key []byte, opts ...SecureTransportOption) (*SecureTransport, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -26,11 +100,29 @@ func NewSecureTransport(transport Transport, key []byte) (*SecureTransport, erro
 		return nil, err
 	}
 
-	return &SecureTransport{
+	t := &SecureTransport{
 		transport: transport,
 		aead:      aead,
-	},
-	nil
+		workers:   DefaultDecryptWorkers,
+		queueSize: DefaultSecureQueueSize,
+		stop:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.out = make(chan []byte, t.queueSize)
+
+	in := transport.Read()
+	t.wg.Add(t.workers)
+	for i := 0; i < t.workers; i++ {
+		go t.decryptLoop(in)
+	}
+	go func() {
+		t.wg.Wait()
+		close(t.out)
+	}()
+
+	return t, nil
 }
 
 // Write encrypts and sends a message.
@@ -44,31 +136,102 @@ func (t *SecureTransport) Write(data []byte, addr string) error {
 	return t.transport.Write(ciphertext, addr)
 }
 
-// Read receives and decrypts a message.
+// WriteBatch encrypts and sends several messages, passing them to the
+// underlying transport in a single batch.
+func (t *SecureTransport) WriteBatch(packets []Packet) (int, error) {
+	sealed := make([]Packet, len(packets))
+	for i, p := range packets {
+		nonce := make([]byte, t.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return 0, err
+		}
+		sealed[i] = Packet{Data: t.aead.Seal(nonce, nonce, p.Data, nil), Addr: p.Addr}
+	}
+	return WriteBatch(t.transport, sealed)
+}
+
+// Read returns the channel of decrypted messages. Every call returns the same
+// channel, which is closed once the transport is stopped.
 func (t *SecureTransport) Read() <-chan []byte {
-	out := make(chan []byte)
-	go func() {
-		for data := range t.transport.Read() {
-			nonceSize := t.aead.NonceSize()
-			if len(data) < nonceSize {
-				fmt.Printf("ciphertext too short: %d\n", len(data))
-				continue
-			}
+	return t.out
+}
+
+// Stop stops the decrypt pipeline and the underlying transport.
+func (t *SecureTransport) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		t.transport.Stop()
+	})
+	t.wg.Wait()
+}
 
-		nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-		plaintext, err := t.aead.Open(nil, nonce, ciphertext, nil)
-			if err != nil {
-				fmt.Printf("failed to decrypt message: %v\n", err)
+// Stats returns a snapshot of the transport's packet counters.
+func (t *SecureTransport) Stats() SecureTransportStats {
+	return SecureTransportStats{
+		Received: t.received.Load(),
+		Rejected: t.rejected.Load(),
+		Dropped:  t.dropped.Load(),
+	}
+}
+
+func (t *SecureTransport) decryptLoop(in <-chan []byte) {
+	defer t.wg.Done()
+	for {
+		select {
+		case data, ok := <-in:
+			if !ok {
+				return
+			}
+			plaintext, ok := t.open(data)
+			if !ok {
+				t.rejected.Add(1)
 				continue
 			}
-			out <- plaintext
+			t.received.Add(1)
+			if !t.deliver(plaintext) {
+				return
+			}
+		case <-t.stop:
+			return
 		}
-		close(out)
-	}()
-	return out
+	}
 }
 
-// Stop stops the underlying transport.
-func (t *SecureTransport) Stop() {
-	t.transport.Stop()
+func (t *SecureTransport) open(data []byte) ([]byte, bool) {
+	nonceSize := t.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, false
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := t.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, false
+	}
+	return plaintext, true
+}
+
+// deliver hands a decrypted packet to the consumer. It reports false once the
+// transport has been stopped.
+func (t *SecureTransport) deliver(plaintext []byte) bool {
+	if t.deliveryTimeout <= 0 {
+		select {
+		case t.out <- plaintext:
+			return true
+		case <-t.stop:
+			return false
+		}
+	}
+
+	timer := time.NewTimer(t.deliveryTimeout)
+	defer timer.Stop()
+	select {
+	case t.out <- plaintext:
+		return true
+	case <-timer.C:
+		t.dropped.Add(1)
+		return true
+	case <-t.stop:
+		return false
+	}
 }
@@ -160,6 +160,120 @@ func TestSecureTransport_MismatchedKeys(t *testing.T) {
 	case <-secureTr2.Read():
 		t.Error("Received a message with mismatched keys, expected decryption failure")
 	case <-time.After(500 * time.Millisecond):
-		// Expected timeout or decryption error logged, not a successful read
+		// Expected timeout, not a successful read
+	}
+
+	if stats := secureTr2.Stats(); stats.Rejected != 1 {
+		t.Errorf("Expected 1 rejected packet, got %d", stats.Rejected)
+	}
+}
+
+func TestSecureTransport_ReadReturnsSameChannel(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	mockTr1 := NewMockTransport()
+	mockTr2 := NewMockTransport()
+	mockTr1.Connect(mockTr2)
+
+	secureTr1, err := NewSecureTransport(mockTr1, key)
+	if err != nil {
+		t.Fatalf("failed to create secure transport 1: %v", err)
+	}
+	defer secureTr1.Stop()
+
+	secureTr2, err := NewSecureTransport(mockTr2, key, WithDecryptWorkers(4))
+	if err != nil {
+		t.Fatalf("failed to create secure transport 2: %v", err)
+	}
+	defer secureTr2.Stop()
+
+	if secureTr2.Read() != secureTr2.Read() {
+		t.Fatal("Read returned different channels on successive calls")
+	}
+
+	numMsgs := 50
+	for i := 0; i < numMsgs; i++ {
+		if err := secureTr1.Write([]byte(fmt.Sprintf("message-%d", i)), "127.0.0.1:8080"); err != nil {
+			t.Fatalf("secureTr1 failed to write: %v", err)
+		}
+	}
+
+	received := make(map[string]bool)
+	for len(received) < numMsgs {
+		select {
+		case msg := <-secureTr2.Read():
+			received[string(msg)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for messages. Received %d of %d", len(received), numMsgs)
+		}
+	}
+
+	if stats := secureTr2.Stats(); stats.Received != uint64(numMsgs) {
+		t.Errorf("Expected %d received packets, got %d", numMsgs, stats.Received)
+	}
+}
+
+func TestSecureTransport_SlowConsumerDrops(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	mockTr1 := NewMockTransport()
+	mockTr2 := NewMockTransport()
+	mockTr1.Connect(mockTr2)
+
+	secureTr1, err := NewSecureTransport(mockTr1, key)
+	if err != nil {
+		t.Fatalf("failed to create secure transport 1: %v", err)
+	}
+	defer secureTr1.Stop()
+
+	secureTr2, err := NewSecureTransport(mockTr2, key, WithSecureQueueSize(1), WithDeliveryTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create secure transport 2: %v", err)
+	}
+	defer secureTr2.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := secureTr1.Write([]byte(fmt.Sprintf("message-%d", i)), "127.0.0.1:8080"); err != nil {
+			t.Fatalf("secureTr1 failed to write: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for secureTr2.Stats().Dropped < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 dropped packets, got %+v", secureTr2.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case msg := <-secureTr2.Read():
+		if string(msg) != "message-0" {
+			t.Errorf("Expected queued message-0, got %s", msg)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Timeout waiting for queued message")
+	}
+}
+
+func TestSecureTransport_StopClosesRead(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	secureTr, err := NewSecureTransport(NewMockTransport(), key, WithDecryptWorkers(2))
+	if err != nil {
+		t.Fatalf("failed to create secure transport: %v", err)
+	}
+	secureTr.Stop()
+
+	select {
+	case _, ok := <-secureTr.Read():
+		if ok {
+			t.Error("Read channel is still open after stop")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Timeout waiting for read channel to close")
 	}
 }
@@ -0,0 +1,106 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+)
+
+// skewSmoothing is the weight of a new sample in the smoothed clock offset
+// and uncertainty of a member.
+const skewSmoothing = 0.25
+
+// SkewWarningHandler is called when the estimated clock offset of a member
+// exceeds the configured threshold, and not again until it has dropped below
+// it. node carries the estimate in ClockOffset and ClockUncertainty.
+type SkewWarningHandler func(node Node)
+
+// skewWarnings remembers which members are currently over the threshold, so
+// that each excursion is reported once.
+type skewWarnings struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// set records whether addr is over the threshold and reports whether it has
+// just crossed it.
+func (w *skewWarnings) set(addr string, over bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.warned == nil {
+		w.warned = make(map[string]bool)
+	}
+	crossed := over && !w.warned[addr]
+	if over {
+		w.warned[addr] = true
+	} else {
+		delete(w.warned, addr)
+	}
+	return crossed
+}
+
+// observeSkew updates the clock offset estimate of a member from one ping
+// round trip: the ping was sent at sent and its ack received at received,
+// both local times, and the member stamped the ack with remote. Assuming
+// symmetric delays, the member read its clock halfway through the round trip,
+// give or take half the round trip.
+func (g *Gossiper) observeSkew(addr string, sent, received time.Time, remote int64) {
+	rtt := received.Sub(sent)
+	midpoint := sent.Add(rtt / 2)
+	offset := time.Unix(0, remote).Sub(midpoint)
+
+	node, ok := g.members.observeSkew(addr, offset, rtt/2)
+	if !ok {
+		return
+	}
+
+	abs := node.ClockOffset
+	if abs < 0 {
+		abs = -abs
+	}
+	// Only warn when the offset exceeds the threshold beyond doubt.
+	over := g.skewThreshold > 0 && abs-node.ClockUncertainty > g.skewThreshold
+	if !g.skewWarned.set(addr, over) {
+		return
+	}
+	g.skewWarningCount.Add(1)
+	if g.skewHandler != nil {
+		g.skewHandler(node)
+	}
+}
+
+// observeSkew folds a clock offset sample into the estimate of the member at
+// addr and returns a copy of the member.
+func (m *MembershipList) observeSkew(addr string, offset, uncertainty time.Duration) (Node, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[addr]
+	if !ok {
+		return Node{}, false
+	}
+	if node.ClockUncertainty == 0 && node.ClockOffset == 0 {
+		node.ClockOffset = offset
+		node.ClockUncertainty = uncertainty
+	} else {
+		node.ClockOffset += time.Duration(skewSmoothing * float64(offset-node.ClockOffset))
+		node.ClockUncertainty += time.Duration(skewSmoothing * float64(uncertainty-node.ClockUncertainty))
+	}
+	return node.clone(), true
+}
+
+// maxClockOffset returns the largest absolute estimated clock offset among
+// the members.
+func (m *MembershipList) maxClockOffset() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var max time.Duration
+	for _, node := range m.nodes {
+		abs := node.ClockOffset
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs > max {
+			max = abs
+		}
+	}
+	return max
+}
@@ -0,0 +1,97 @@
+package gossip
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGossiper_ClockSkewFromProbe(t *testing.T) {
+	tr := NewMockTransport()
+	var warnings []Node
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, tr,
+		WithClockSkewThreshold(time.Second),
+		WithSkewWarningHandler(func(n Node) { warnings = append(warnings, n) }))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	// Answer the probe's ping with an ack from a clock five seconds ahead.
+	done := make(chan struct{})
+	go func() {
+		g.probe()
+		close(done)
+	}()
+	msg, err := Decode(<-tr.writeCh)
+	if err != nil || msg.Type != Ping {
+		t.Fatalf("Expected a ping, got %v (%v)", msg, err)
+	}
+	var p ping
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		t.Fatalf("failed to decode ping: %v", err)
+	}
+	payload, err := json.Marshal(&ack{Seq: p.Seq, Time: time.Now().Add(5 * time.Second).UnixNano()})
+	if err != nil {
+		t.Fatalf("failed to marshal ack: %v", err)
+	}
+	data, err := (&Message{Type: Ack, Payload: payload}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode ack: %v", err)
+	}
+	g.handleMessage(data)
+	<-done
+
+	var peer Node
+	for _, n := range g.Members() {
+		if n.Addr.String() == "127.0.0.1:7947" {
+			peer = n
+		}
+	}
+	if d := peer.ClockOffset - 5*time.Second; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("Expected an offset of about 5s, got %v ± %v", peer.ClockOffset, peer.ClockUncertainty)
+	}
+	if len(warnings) != 1 || warnings[0].Addr.String() != "127.0.0.1:7947" {
+		t.Errorf("Expected one warning for 127.0.0.1:7947, got %v", warnings)
+	}
+	if stats := g.Stats(); stats.SkewWarnings != 1 || stats.MaxClockOffset != peer.ClockOffset {
+		t.Errorf("Expected 1 warning and a maximum offset of %v, got %+v", peer.ClockOffset, stats)
+	}
+}
+
+func TestGossiper_ClockSkewWarnsOnce(t *testing.T) {
+	warnings := 0
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, NewMockTransport(),
+		WithClockSkewThreshold(time.Second),
+		WithSkewWarningHandler(func(Node) { warnings++ }))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	sample := func(offset time.Duration) {
+		sent := time.Now()
+		received := sent.Add(2 * time.Millisecond)
+		g.observeSkew("127.0.0.1:7947", sent, received, sent.Add(time.Millisecond+offset).UnixNano())
+	}
+
+	for i := 0; i < 5; i++ {
+		sample(3 * time.Second)
+	}
+	if warnings != 1 {
+		t.Fatalf("Expected a single warning while over the threshold, got %d", warnings)
+	}
+
+	// The offset is smoothed, so it takes a few samples to recover.
+	for i := 0; i < 20; i++ {
+		sample(0)
+	}
+	sample(3 * time.Second)
+	if warnings != 1 {
+		t.Errorf("Expected no warning while the smoothed offset recovers, got %d", warnings)
+	}
+	for i := 0; i < 20; i++ {
+		sample(3 * time.Second)
+	}
+	if warnings != 2 {
+		t.Errorf("Expected a second warning after crossing the threshold again, got %d", warnings)
+	}
+}
@@ -1,5 +1,15 @@
 package gossip
 
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errBatchUnsupported is returned when batched socket I/O is not available on
+// the current platform.
+var errBatchUnsupported = errors.New("batched I/O not supported on this platform")
+
 // Transport is an interface for sending and receiving messages.
 type Transport interface {
 	// Write sends a message to the given address.
@@ -9,3 +19,41 @@ type Transport interface {
 	// Stop stops the transport.
 	Stop()
 }
+
+// StreamTransport is implemented by transports that can also open
+// connection-oriented streams to other members, for messages that must
+// arrive whole and be acknowledged, such as those of SendReliable.
+type StreamTransport interface {
+	// DialStream opens a stream to the member at addr.
+	DialStream(ctx context.Context, addr string) (net.Conn, error)
+	// Streams returns a channel of the streams opened by other members.
+	Streams() <-chan net.Conn
+}
+
+// Packet is a message and the address it is sent to.
+type Packet struct {
+	Data []byte
+	Addr string
+}
+
+// BatchWriter is implemented by transports that can send several messages in
+// one call, amortising per-packet system call overhead.
+type BatchWriter interface {
+	// WriteBatch sends the packets and returns how many were sent.
+	WriteBatch([]Packet) (int, error)
+}
+
+// WriteBatch sends packets through t, using its WriteBatch method when t
+// implements BatchWriter and falling back to one Write per packet otherwise.
+// It returns the number of packets sent.
+func WriteBatch(t Transport, packets []Packet) (int, error) {
+	if bw, ok := t.(BatchWriter); ok {
+		return bw.WriteBatch(packets)
+	}
+	for i, p := range packets {
+		if err := t.Write(p.Data, p.Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,194 @@
+//go:build linux && (amd64 || arm64)
+
+package gossip
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h> on 64-bit Linux.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// batchConn moves several datagrams per system call using recvmmsg(2) and
+// sendmmsg(2).
+type batchConn struct {
+	rc     syscall.RawConn
+	family int
+
+	// Read state, owned by the single read loop.
+	msgs []mmsghdr
+	iovs []syscall.Iovec
+	bufs [][]byte
+}
+
+func newBatchConn(conn *net.UDPConn, size, bufSize int) (*batchConn, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sa     syscall.Sockaddr
+		sysErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		sa, sysErr = syscall.Getsockname(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if sysErr != nil {
+		return nil, sysErr
+	}
+
+	b := &batchConn{
+		rc:   rc,
+		msgs: make([]mmsghdr, size),
+		iovs: make([]syscall.Iovec, size),
+		bufs: make([][]byte, size),
+	}
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		b.family = syscall.AF_INET
+	case *syscall.SockaddrInet6:
+		b.family = syscall.AF_INET6
+	default:
+		return nil, errBatchUnsupported
+	}
+
+	for i := range b.msgs {
+		b.bufs[i] = make([]byte, bufSize)
+		b.iovs[i].Base = &b.bufs[i][0]
+		b.iovs[i].SetLen(bufSize)
+		b.msgs[i].hdr.Iov = &b.iovs[i]
+		b.msgs[i].hdr.Iovlen = 1
+	}
+	return b, nil
+}
+
+// readBatch blocks until at least one datagram is available and returns the
+// received datagrams. The returned slices alias internal buffers and are only
+// valid until the next call.
+func (b *batchConn) readBatch() ([][]byte, error) {
+	var (
+		n      int
+		sysErr error
+	)
+	err := b.rc.Read(func(fd uintptr) bool {
+		r, _, errno := syscall.Syscall6(sysRecvmmsg, fd,
+			uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(len(b.msgs)),
+			syscall.MSG_DONTWAIT, 0, 0)
+		if errno == syscall.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			sysErr = errno
+		}
+		n = int(r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sysErr != nil {
+		return nil, sysErr
+	}
+
+	packets := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		packets[i] = b.bufs[i][:b.msgs[i].len]
+	}
+	return packets, nil
+}
+
+// writeBatch sends packets with as few sendmmsg calls as possible and returns
+// the number of packets sent.
+func (b *batchConn) writeBatch(packets []Packet) (int, error) {
+	msgs := make([]mmsghdr, len(packets))
+	iovs := make([]syscall.Iovec, len(packets))
+	names := make([]syscall.RawSockaddrInet6, len(packets))
+	for i, p := range packets {
+		addr, err := resolveAddr(p.Addr)
+		if err != nil {
+			return 0, err
+		}
+		namelen, err := b.sockaddr(addr, &names[i])
+		if err != nil {
+			return 0, err
+		}
+		if len(p.Data) > 0 {
+			iovs[i].Base = &p.Data[0]
+		}
+		iovs[i].SetLen(len(p.Data))
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Namelen = namelen
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		var sysErr error
+		err := b.rc.Write(func(fd uintptr) bool {
+			r, _, errno := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent),
+				syscall.MSG_DONTWAIT, 0, 0)
+			if errno == syscall.EAGAIN {
+				return false
+			}
+			if errno != 0 {
+				sysErr = errno
+				return true
+			}
+			sent += int(r)
+			return true
+		})
+		if err != nil {
+			return sent, err
+		}
+		if sysErr != nil {
+			return sent, sysErr
+		}
+	}
+	return sent, nil
+}
+
+// sockaddr encodes addr into raw in the socket's address family. raw is large
+// enough for either family.
+func (b *batchConn) sockaddr(addr *net.UDPAddr, raw *syscall.RawSockaddrInet6) (uint32, error) {
+	port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+	port[0] = byte(addr.Port >> 8)
+	port[1] = byte(addr.Port)
+
+	if b.family == syscall.AF_INET {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			return 0, &net.AddrError{Err: "IPv6 destination on IPv4 socket", Addr: addr.String()}
+		}
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		sa.Family = syscall.AF_INET
+		copy(sa.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	raw.Family = syscall.AF_INET6
+	copy(raw.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if index, err := strconv.Atoi(addr.Zone); err == nil {
+			raw.Scope_id = uint32(index)
+		} else {
+			ifi, err := net.InterfaceByName(addr.Zone)
+			if err != nil {
+				return 0, err
+			}
+			raw.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6, nil
+}
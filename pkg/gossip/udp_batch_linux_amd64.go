@@ -0,0 +1,7 @@
+package gossip
+
+// The syscall package does not define SYS_SENDMMSG on linux/amd64.
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
@@ -0,0 +1,6 @@
+package gossip
+
+const (
+	sysRecvmmsg = 243
+	sysSendmmsg = 269
+)
@@ -0,0 +1,21 @@
+//go:build !(linux && (amd64 || arm64))
+
+package gossip
+
+import "net"
+
+// batchConn is unavailable on this platform; UDPTransport falls back to one
+// packet per system call.
+type batchConn struct{}
+
+func newBatchConn(conn *net.UDPConn, size, bufSize int) (*batchConn, error) {
+	return nil, errBatchUnsupported
+}
+
+func (b *batchConn) readBatch() ([][]byte, error) {
+	return nil, errBatchUnsupported
+}
+
+func (b *batchConn) writeBatch(packets []Packet) (int, error) {
+	return 0, errBatchUnsupported
+}
@@ -0,0 +1,104 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUDPTransport_WriteBatch(t *testing.T) {
+	for _, batchSize := range []int{1, DefaultBatchSize} {
+		t.Run(fmt.Sprintf("batch-%d", batchSize), func(t *testing.T) {
+			tr, err := NewUDPTransport("127.0.0.1:9010", WithBatchSize(batchSize))
+			if err != nil {
+				t.Fatalf("failed to create transport: %v", err)
+			}
+			defer tr.Stop()
+
+			numMsgs := 20
+			packets := make([]Packet, numMsgs)
+			expected := make(map[string]bool)
+			for i := range packets {
+				packets[i] = Packet{Data: []byte(fmt.Sprintf("message-%d", i)), Addr: "127.0.0.1:9010"}
+				expected[string(packets[i].Data)] = false
+			}
+
+			n, err := WriteBatch(tr, packets)
+			if err != nil {
+				t.Fatalf("failed to write batch: %v", err)
+			}
+			if n != numMsgs {
+				t.Fatalf("Expected %d packets sent, got %d", numMsgs, n)
+			}
+
+			for received := 0; received < numMsgs; received++ {
+				select {
+				case msg := <-tr.Read():
+					if _, ok := expected[string(msg)]; !ok {
+						t.Errorf("Received unexpected message: %s", msg)
+					}
+					expected[string(msg)] = true
+				case <-time.After(time.Second):
+					t.Fatalf("Timeout waiting for messages. Received %d of %d", received, numMsgs)
+				}
+			}
+			for msg, received := range expected {
+				if !received {
+					t.Errorf("Message %s was not received", msg)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkUDPTransport sends b.N packets to a receiving transport in groups
+// of batchSize, either with one Write per packet or with WriteBatch.
+func benchmarkUDPTransport(b *testing.B, batchSize int, batched bool) {
+	rx, err := NewUDPTransport("127.0.0.1:9011", WithBatchSize(batchSize), WithReadQueueSize(4096), WithSocketBuffers(4<<20, 0))
+	if err != nil {
+		b.Fatalf("failed to create receiver: %v", err)
+	}
+	defer rx.Stop()
+	tx, err := NewUDPTransport("127.0.0.1:9012", WithBatchSize(batchSize), WithSocketBuffers(0, 4<<20))
+	if err != nil {
+		b.Fatalf("failed to create sender: %v", err)
+	}
+	defer tx.Stop()
+
+	packets := make([]Packet, batchSize)
+	for i := range packets {
+		packets[i] = Packet{Data: make([]byte, 512), Addr: "127.0.0.1:9011"}
+	}
+
+	b.SetBytes(512)
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += batchSize {
+		group := packets[:min(batchSize, b.N-sent)]
+		if batched {
+			if _, err := tx.WriteBatch(group); err != nil {
+				b.Fatalf("failed to write batch: %v", err)
+			}
+		} else {
+			for _, p := range group {
+				if err := tx.Write(p.Data, p.Addr); err != nil {
+					b.Fatalf("failed to write: %v", err)
+				}
+			}
+		}
+		for range group {
+			select {
+			case <-rx.Read():
+			case <-time.After(time.Second):
+				b.Fatalf("Timeout waiting for packet, receiver stats %+v", rx.Stats())
+			}
+		}
+	}
+}
+
+func BenchmarkUDPTransport_Single(b *testing.B) {
+	benchmarkUDPTransport(b, 1, false)
+}
+
+func BenchmarkUDPTransport_Batch(b *testing.B) {
+	benchmarkUDPTransport(b, 32, true)
+}
@@ -1,42 +1,206 @@
 package gossip
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
+const (
+	// DefaultReadQueueSize is the number of received packets buffered for the
+	// consumer when no WithReadQueueSize option is given.
+	DefaultReadQueueSize = 256
+	// DefaultMaxPacketSize is the size of the socket read buffer when no
+	// WithMaxPacketSize option is given. It fits any UDP datagram.
+	DefaultMaxPacketSize = 65535
+	// DefaultBatchSize is the number of datagrams moved per system call when
+	// no WithBatchSize option is given and batching is supported.
+	DefaultBatchSize = 8
+)
+
+// DropPolicy selects which packet is discarded when a receive queue is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards the packet that has just arrived.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the longest-queued packet to make room for the new
+	// one.
+	DropOldest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	default:
+		return "unknown"
+	}
+}
+
 // UDPTransport is a transport that uses UDP for communication.
+//
+// Received packets are placed on a bounded queue. The socket goroutine never
+// blocks on a slow consumer: when the queue is full a packet is discarded
+// according to the drop policy and counted in Stats.
+//
+// On Linux the transport reads and writes several datagrams per system call
+// with recvmmsg and sendmmsg. Elsewhere, or with a batch size of one, it falls
+// back to one datagram per call.
+//
+// The transport also listens for TCP streams on the same address, and
+// implements StreamTransport.
 type UDPTransport struct {
-	conn    *net.UDPConn
-	readCh  chan []byte
-	stop    chan struct{}
+	conn     *net.UDPConn
+	listener *net.TCPListener
+	readCh   chan []byte
+	streamCh chan net.Conn
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	queueSize     int
+	dropPolicy    DropPolicy
+	maxPacketSize int
+	recvBuffer    int
+	sendBuffer    int
+	batchSize     int
+	batch         *batchConn
+
+	received atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// UDPTransportOption configures a UDPTransport.
+type UDPTransportOption func(*UDPTransport)
+
+// WithReadQueueSize sets how many received packets are buffered for the
+// consumer before the drop policy applies. Values below one are ignored.
+func WithReadQueueSize(n int) UDPTransportOption {
+	return func(t *UDPTransport) {
+		if n > 0 {
+			t.queueSize = n
+		}
+	}
+}
+
+// WithDropPolicy sets which packet is discarded when the receive queue is
+// full. The default is DropNewest.
+func WithDropPolicy(p DropPolicy) UDPTransportOption {
+	return func(t *UDPTransport) {
+		t.dropPolicy = p
+	}
+}
+
+// WithMaxPacketSize sets the size of the socket read buffer. Datagrams larger
+// than this are truncated by the kernel, so it should be at least the path
+// MTU. Values below one are ignored.
+func WithMaxPacketSize(n int) UDPTransportOption {
+	return func(t *UDPTransport) {
+		if n > 0 {
+			t.maxPacketSize = n
+		}
+	}
+}
+
+// WithSocketBuffers sets the kernel receive and send buffer sizes of the
+// socket in bytes. Zero leaves the operating system default in place.
+func WithSocketBuffers(recv, send int) UDPTransportOption {
+	return func(t *UDPTransport) {
+		t.recvBuffer = recv
+		t.sendBuffer = send
+	}
+}
+
+// WithBatchSize sets the maximum number of datagrams read or written per
+// system call. One disables batching. Values below one are ignored.
+func WithBatchSize(n int) UDPTransportOption {
+	return func(t *UDPTransport) {
+		if n > 0 {
+			t.batchSize = n
+		}
+	}
+}
+
+// UDPTransportStats holds packet counters for a UDPTransport.
+type UDPTransportStats struct {
+	// Received is the number of packets read from the socket.
+	Received uint64
+	// Dropped is the number of packets discarded because the receive queue
+	// was full.
+	Dropped uint64
 }
 
-// NewUDPTransport creates a new UDP transport.
-func NewUDPTransport(addr string) (*UDPTransport, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+// NewUDPTransport creates a new UDP transport bound to addr. Binding to a
+// wildcard address such as 0.0.0.0 or [::] listens on both IPv4 and IPv6
+// where the operating system supports dual-stack sockets.
+func NewUDPTransport(addr string, opts ...UDPTransportOption) (*UDPTransport, error) {
+	udpAddr, err := resolveAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
+	t := &UDPTransport{
+		stop:          make(chan struct{}),
+		queueSize:     DefaultReadQueueSize,
+		dropPolicy:    DropNewest,
+		maxPacketSize: DefaultMaxPacketSize,
+		batchSize:     DefaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
 	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		return nil, err
 	}
+	if t.recvBuffer > 0 {
+		if err := conn.SetReadBuffer(t.recvBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if t.sendBuffer > 0 {
+		if err := conn.SetWriteBuffer(t.sendBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// The stream listener takes the port the datagram socket was given, so
+	// that both are reached at the member's advertised address.
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localAddr.IP, Port: localAddr.Port, Zone: localAddr.Zone})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	t := &UDPTransport{
-		conn:   conn,
-		readCh: make(chan []byte),
-		stop:   make(chan struct{}),
+	t.conn = conn
+	t.listener = listener
+	t.streamCh = make(chan net.Conn)
+	if t.batchSize > 1 {
+		// Batching is an optimisation; keep the portable path if the
+		// platform or socket does not support it.
+		if batch, err := newBatchConn(conn, t.batchSize, t.maxPacketSize); err == nil {
+			t.batch = batch
+		}
 	}
+	t.readCh = make(chan []byte, t.queueSize)
 
 	go t.readLoop()
+	go t.acceptLoop()
 
 	return t, nil
 }
 
 // Write sends a message to the given address.
 func (t *UDPTransport) Write(data []byte, addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := resolveAddr(addr)
 	if err != nil {
 		return err
 	}
@@ -45,32 +209,152 @@ func (t *UDPTransport) Write(data []byte, addr string) error {
 	return err
 }
 
+// WriteBatch sends several messages, using a single sendmmsg call per batch
+// where supported. It returns the number of messages sent.
+func (t *UDPTransport) WriteBatch(packets []Packet) (int, error) {
+	if t.batch == nil {
+		for i, p := range packets {
+			if err := t.Write(p.Data, p.Addr); err != nil {
+				return i, err
+			}
+		}
+		return len(packets), nil
+	}
+	return t.batch.writeBatch(packets)
+}
+
 // Read returns a channel that can be used to receive messages.
 func (t *UDPTransport) Read() <-chan []byte {
 	return t.readCh
 }
 
+// DialStream opens a TCP stream to addr.
+func (t *UDPTransport) DialStream(ctx context.Context, addr string) (net.Conn, error) {
+	tcpAddr, err := resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", tcpAddr.String())
+}
+
+// Streams returns a channel of the TCP streams opened by other members. The
+// receiver must close them.
+func (t *UDPTransport) Streams() <-chan net.Conn {
+	return t.streamCh
+}
+
 // Stop stops the transport.
 func (t *UDPTransport) Stop() {
-	close(t.stop)
-	t.conn.Close()
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		t.conn.Close()
+		t.listener.Close()
+	})
+}
+
+// Stats returns a snapshot of the transport's packet counters.
+func (t *UDPTransport) Stats() UDPTransportStats {
+	return UDPTransportStats{
+		Received: t.received.Load(),
+		Dropped:  t.dropped.Load(),
+	}
 }
 
 func (t *UDPTransport) readLoop() {
 	defer close(t.readCh)
-	buf := make([]byte, 1024)
+	if t.batch != nil {
+		t.readBatchLoop()
+		return
+	}
+
+	buf := make([]byte, t.maxPacketSize)
+	for {
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-t.stop:
+				return
+			default:
+				continue
+			}
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		t.received.Add(1)
+		t.enqueue(data)
+	}
+}
+
+func (t *UDPTransport) readBatchLoop() {
 	for {
+		packets, err := t.batch.readBatch()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-t.stop:
+				return
+			default:
+				continue
+			}
+		}
+		for _, p := range packets {
+			data := make([]byte, len(p))
+			copy(data, p)
+			t.received.Add(1)
+			t.enqueue(data)
+		}
+	}
+}
+
+// acceptLoop hands the accepted streams to the consumer until the transport
+// is stopped.
+func (t *UDPTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-t.stop:
+				return
+			default:
+				continue
+			}
+		}
 		select {
+		case t.streamCh <- conn:
 		case <-t.stop:
+			conn.Close()
 			return
+		}
+	}
+}
+
+// enqueue places a packet on the receive queue without blocking, applying the
+// drop policy when the queue is full.
+func (t *UDPTransport) enqueue(data []byte) {
+	select {
+	case t.readCh <- data:
+		return
+	default:
+	}
+
+	if t.dropPolicy == DropOldest {
+		select {
+		case <-t.readCh:
+		default:
+		}
+		select {
+		case t.readCh <- data:
 		default:
-			n, _, err := t.conn.ReadFromUDP(buf)
-			if err != nil {
-				continue
-			}
-			data := make([]byte, n)
-			copy(data, buf[:n])
-			t.readCh <- data
 		}
 	}
+	t.dropped.Add(1)
 }
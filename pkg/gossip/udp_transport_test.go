@@ -129,3 +129,77 @@ endRead:
 		}
 	}
 }
+
+func TestUDPTransport_DropPolicy(t *testing.T) {
+	tests := []struct {
+		policy   DropPolicy
+		addr     string
+		expected []string
+	}{
+		{DropNewest, "127.0.0.1:9006", []string{"message-0", "message-1"}},
+		{DropOldest, "127.0.0.1:9007", []string{"message-3", "message-4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			tr, err := NewUDPTransport(tt.addr, WithReadQueueSize(2), WithDropPolicy(tt.policy))
+			if err != nil {
+				t.Fatalf("failed to create transport: %v", err)
+			}
+			defer tr.Stop()
+
+			for i := 0; i < 5; i++ {
+				if err := tr.Write([]byte(fmt.Sprintf("message-%d", i)), tt.addr); err != nil {
+					t.Fatalf("failed to write message %d: %v", i, err)
+				}
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for tr.Stats().Received < 5 {
+				if time.Now().After(deadline) {
+					t.Fatalf("Timeout waiting for packets, stats %+v", tr.Stats())
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if dropped := tr.Stats().Dropped; dropped != 3 {
+				t.Errorf("Expected 3 dropped packets, got %d", dropped)
+			}
+
+			for _, want := range tt.expected {
+				select {
+				case msg := <-tr.Read():
+					if string(msg) != want {
+						t.Errorf("Expected %s, got %s", want, msg)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("Timeout waiting for queued message")
+				}
+			}
+		})
+	}
+}
+
+func TestUDPTransport_LargePacket(t *testing.T) {
+	tr, err := NewUDPTransport("127.0.0.1:9008", WithSocketBuffers(1<<20, 1<<20))
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Stop()
+
+	msg := make([]byte, 8192)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if err := tr.Write(msg, "127.0.0.1:9008"); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	select {
+	case received := <-tr.Read():
+		if len(received) != len(msg) {
+			t.Errorf("Expected %d bytes, got %d", len(msg), len(received))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}
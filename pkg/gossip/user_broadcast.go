@@ -0,0 +1,149 @@
+package gossip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// broadcastDedupWindow is how long the IDs of delivered user broadcasts,
+// queries and reliable messages are remembered. It comfortably exceeds the
+// time a broadcast keeps circulating or a message is retried.
+const broadcastDedupWindow = time.Minute
+
+// BroadcastHandler is called with the name and payload of every user
+// broadcast received from the cluster. It is called from the gossiper's
+// receive goroutine, so it should return quickly, and must not retain
+// payload after returning.
+type BroadcastHandler func(name string, payload []byte)
+
+// userBroadcast is the payload of a UserBroadcast message.
+type userBroadcast struct {
+	// ID identifies the broadcast across the cluster, for de-duplication.
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Payload []byte `json:"payload,omitempty"`
+	// Key, if set, lets a newer broadcast with the same key replace this
+	// one in every member's queue. Order is the sender's clock reading, so
+	// that a relay never replaces a newer broadcast with an older one.
+	Key   string `json:"key,omitempty"`
+	Order uint64 `json:"order,omitempty"`
+}
+
+// seenSet remembers recently delivered broadcast IDs.
+type seenSet struct {
+	mu        sync.Mutex
+	ids       map[string]time.Time
+	lastPrune time.Time
+}
+
+// add records id and reports whether it was new.
+func (s *seenSet) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.ids == nil {
+		s.ids = make(map[string]time.Time)
+	}
+	if now.Sub(s.lastPrune) >= broadcastDedupWindow {
+		for k, at := range s.ids {
+			if now.Sub(at) >= broadcastDedupWindow {
+				delete(s.ids, k)
+			}
+		}
+		s.lastPrune = now
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = now
+	return true
+}
+
+// Broadcast disseminates a user message to every other member through the
+// same piggybacked gossip as membership updates. Each member passes it to its
+// BroadcastHandler at most once; the sender does not receive its own
+// broadcast. It fails with ErrBroadcastTooLarge if name and payload together
+// exceed the configured limit.
+func (g *Gossiper) Broadcast(name string, payload []byte) error {
+	return g.broadcast(name, "", payload)
+}
+
+// BroadcastKey is like Broadcast, but a newer broadcast with the same key
+// replaces this one wherever it is still waiting to be gossiped, so that a
+// sender of periodic updates keeps at most one of them in every member's
+// queue. Keys are shared by the whole cluster; a sender should include its
+// node name in the keys it uses.
+func (g *Gossiper) BroadcastKey(name, key string, payload []byte) error {
+	return g.broadcast(name, key, payload)
+}
+
+func (g *Gossiper) broadcast(name, key string, payload []byte) error {
+	if size := len(name) + len(payload); size > g.maxBroadcastSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBroadcastTooLarge, size, g.maxBroadcastSize)
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	b := &userBroadcast{
+		ID:      hex.EncodeToString(id[:]),
+		Name:    name,
+		Payload: payload,
+	}
+	if key != "" {
+		b.Key = key
+		b.Order = uint64(g.members.clock.Now().WallTime)
+	}
+	g.seenBroadcasts.add(b.ID)
+	return g.queueUserBroadcast(b)
+}
+
+func (g *Gossiper) queueUserBroadcast(b *userBroadcast) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	msg, err := (&Message{Type: UserBroadcast, Payload: data}).Encode()
+	if err != nil {
+		return err
+	}
+	key := "user:" + b.ID
+	if b.Key != "" {
+		key = "user-key:" + b.Key
+	}
+	g.broadcasts.queue(&broadcast{
+		key:    key,
+		order:  b.Order,
+		msg:    msg,
+		sentTo: make(map[string]struct{}),
+	})
+	g.kickGossip()
+	return nil
+}
+
+// handleUserBroadcast delivers a user broadcast seen for the first time and
+// passes it on.
+func (g *Gossiper) handleUserBroadcast(payload []byte) {
+	var b userBroadcast
+	if err := json.Unmarshal(payload, &b); err != nil || b.ID == "" {
+		g.malformed.Add(1)
+		return
+	}
+	if len(b.Name)+len(b.Payload) > g.maxBroadcastSize {
+		g.malformed.Add(1)
+		return
+	}
+	if !g.seenBroadcasts.add(b.ID) {
+		return
+	}
+
+	g.queueUserBroadcast(&b)
+	if g.broadcastHandler != nil {
+		g.broadcastHandler(b.Name, b.Payload)
+	}
+}
@@ -0,0 +1,209 @@
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// broadcastRecorder counts the user broadcasts delivered to a handler.
+type broadcastRecorder struct {
+	mu       sync.Mutex
+	received map[string]int
+}
+
+func (r *broadcastRecorder) handle(name string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.received == nil {
+		r.received = make(map[string]int)
+	}
+	r.received[name+"="+string(payload)]++
+}
+
+func (r *broadcastRecorder) count(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received[key]
+}
+
+func TestGossiper_Broadcast(t *testing.T) {
+	network := newMockNetwork()
+	addrs := []string{"127.0.0.1:7041", "127.0.0.1:7042", "127.0.0.1:7043", "127.0.0.1:7044"}
+
+	recorders := make([]*broadcastRecorder, len(addrs))
+	var gossipers []*Gossiper
+	for i, addr := range addrs {
+		recorders[i] = &broadcastRecorder{}
+		g, err := NewGossiper(addr, addr, addrs, network.Transport(addr), WithBroadcastHandler(recorders[i].handle))
+		if err != nil {
+			t.Fatalf("failed to create gossiper: %v", err)
+		}
+		g.Start()
+		defer g.Stop()
+		gossipers = append(gossipers, g)
+	}
+
+	if err := gossipers[0].Broadcast("invalidate", []byte("users/42")); err != nil {
+		t.Fatalf("failed to broadcast: %v", err)
+	}
+	waitFor(t, 2*time.Second, "the broadcast to reach every member", func() bool {
+		for _, r := range recorders[1:] {
+			if r.count("invalidate=users/42") == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Let the broadcast finish circulating, then check that nobody saw it
+	// twice and that the sender did not deliver it to itself.
+	time.Sleep(500 * time.Millisecond)
+	for i, r := range recorders[1:] {
+		if n := r.count("invalidate=users/42"); n != 1 {
+			t.Errorf("Member %d received the broadcast %d times", i+1, n)
+		}
+	}
+	if n := recorders[0].count("invalidate=users/42"); n != 0 {
+		t.Errorf("Sender received its own broadcast %d times", n)
+	}
+}
+
+func TestGossiper_BroadcastDedup(t *testing.T) {
+	r := &broadcastRecorder{}
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithBroadcastHandler(r.handle), WithMaxBroadcastSize(16))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	msg, err := (&Message{Type: UserBroadcast, Payload: []byte(`{"id":"abc","name":"config","payload":"djI="}`)}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	g.handleMessage(msg)
+	g.handleMessage(msg)
+	if n := r.count("config=v2"); n != 1 {
+		t.Errorf("Expected the broadcast to be delivered once, got %d", n)
+	}
+	if n := g.broadcasts.len(); n != 1 {
+		t.Errorf("Expected the broadcast to be queued for relaying once, got %d", n)
+	}
+
+	err = g.Broadcast("config", []byte(strings.Repeat("x", 16)))
+	if !errors.Is(err, ErrBroadcastTooLarge) {
+		t.Errorf("Expected ErrBroadcastTooLarge, got %v", err)
+	}
+}
+
+func TestGossiper_BroadcastKey(t *testing.T) {
+	r := &broadcastRecorder{}
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithBroadcastHandler(r.handle))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := g.BroadcastKey("load", "load:node1", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to broadcast: %v", err)
+		}
+	}
+	if n := g.Stats().QueuedBroadcasts; n != 1 {
+		t.Errorf("Expected keyed broadcasts to replace each other, got %d queued", n)
+	}
+
+	// A relay keeps the newer of two broadcasts with the same key, whichever
+	// arrives first.
+	for _, p := range []string{
+		`{"id":"b","name":"load","payload":"djI=","key":"load:node2","order":2}`,
+		`{"id":"a","name":"load","payload":"djE=","key":"load:node2","order":1}`,
+	} {
+		msg, err := (&Message{Type: UserBroadcast, Payload: []byte(p)}).Encode()
+		if err != nil {
+			t.Fatalf("failed to encode message: %v", err)
+		}
+		g.handleMessage(msg)
+	}
+	if n := g.Stats().QueuedBroadcasts; n != 2 {
+		t.Fatalf("Expected one queued broadcast per key, got %d", n)
+	}
+	for _, b := range g.broadcasts.items {
+		if b.key == "user-key:load:node2" && b.order != 2 {
+			t.Errorf("Expected the newer broadcast to stay queued, got order %d", b.order)
+		}
+	}
+}
+
+// TestGossiper_PacketSize checks that gossip packets stay within the packet
+// size once encoded, with every layer of base64 counted, for queued
+// broadcasts and delegate messages alike.
+func TestGossiper_PacketSize(t *testing.T) {
+	tr := NewMockTransport()
+	d := &testDelegate{}
+	for i := 0; i < 50; i++ {
+		d.broadcasts = append(d.broadcasts, []byte(strings.Repeat("d", 100)))
+	}
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947"}, tr,
+		WithDelegate(d), WithClusterLabel("prod"), WithGossip(time.Second, 1))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := g.Broadcast("config", []byte(strings.Repeat("b", 100))); err != nil {
+			t.Fatalf("failed to broadcast: %v", err)
+		}
+	}
+
+	parts, largest := 0, 0
+	for round := 0; round < 1000 && (g.broadcasts.len() > 0 || len(d.broadcasts) > 0); round++ {
+		g.gossip()
+		for len(tr.writeCh) > 0 {
+			data := <-tr.writeCh
+			if len(data) > DefaultGossipPacketSize {
+				t.Fatalf("Expected packets of at most %d bytes, got %d", DefaultGossipPacketSize, len(data))
+			}
+			largest = max(largest, len(data))
+			msg, err := Decode(data)
+			if err != nil || msg.Type != Compound {
+				t.Fatalf("Expected a compound message, got %v (%v)", msg, err)
+			}
+			var msgs [][]byte
+			if err := json.Unmarshal(msg.Payload, &msgs); err != nil {
+				t.Fatalf("failed to decode compound payload: %v", err)
+			}
+			parts += len(msgs)
+		}
+	}
+	if len(d.broadcasts) > 0 || parts < 100 {
+		t.Errorf("Expected every message to be sent, got %d parts and %d delegate messages left", parts, len(d.broadcasts))
+	}
+	if largest < DefaultGossipPacketSize*3/4 {
+		t.Errorf("Expected packets to be filled, the largest was %d bytes", largest)
+	}
+}
+
+// TestGossiper_QueueDrains checks that broadcasts retire once they have
+// reached every peer of a cluster smaller than the retransmit limit.
+func TestGossiper_QueueDrains(t *testing.T) {
+	tr := NewMockTransport()
+	g, err := NewGossiper("node1", "127.0.0.1:7946", []string{"127.0.0.1:7947", "127.0.0.1:7948"}, tr)
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := g.Broadcast("config", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to broadcast: %v", err)
+		}
+	}
+
+	for round := 0; round < 1000 && g.broadcasts.len() > 0; round++ {
+		g.gossip()
+		for len(tr.writeCh) > 0 {
+			<-tr.writeCh
+		}
+	}
+	if n := g.broadcasts.len(); n != 0 {
+		t.Errorf("Expected the queue to drain, got %d broadcasts left", n)
+	}
+}
@@ -0,0 +1,75 @@
+package gossip
+
+import (
+	"context"
+	"time"
+)
+
+// WaitForChange blocks until the membership list has changed past
+// sinceVersion and returns the new view, whose Version is the index to pass
+// to the next call. Changes arriving within the coalescing window after the
+// first one are folded into the same view. Passing zero returns the current
+// view immediately.
+//
+// It returns ctx.Err() if ctx is done first, or ErrStopped if the gossiper is
+// stopped.
+func (g *Gossiper) WaitForChange(ctx context.Context, sinceVersion uint64) (View, error) {
+	for {
+		changed, ok := g.members.changedSince(sinceVersion)
+		if ok {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return View{}, ctx.Err()
+		case <-g.stop:
+			return View{}, ErrStopped
+		}
+
+		if g.watchCoalesce > 0 {
+			timer := time.NewTimer(g.watchCoalesce)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return View{}, ctx.Err()
+			case <-g.stop:
+				timer.Stop()
+				return View{}, ErrStopped
+			}
+		}
+	}
+	return g.View(), nil
+}
+
+// Watch sends the current view on the returned channel and then a new view
+// after every change, coalesced like WaitForChange. A consumer that falls
+// behind only receives the latest view. The channel is closed when ctx is done
+// or the gossiper is stopped.
+func (g *Gossiper) Watch(ctx context.Context) <-chan View {
+	ch := make(chan View, 1)
+	go func() {
+		defer close(ch)
+		view := g.View()
+		for {
+			select {
+			case ch <- view:
+			default:
+				// Replace the view the consumer has not picked up yet.
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- view
+			}
+
+			var err error
+			view, err = g.WaitForChange(ctx, view.Version)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
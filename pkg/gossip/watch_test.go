@@ -0,0 +1,121 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func addMember(g *Gossiper, port int) {
+	g.members.Add(&Node{Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}, State: Alive, LastUpdated: time.Now()})
+}
+
+func TestGossiper_WaitForChange(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithWatchCoalesce(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	view, err := g.WaitForChange(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("failed to get the initial view: %v", err)
+	}
+	if len(view.Members) != 1 {
+		t.Fatalf("Expected only the local node, got %v", view.Members)
+	}
+
+	// A burst of changes within the window is returned as one view.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		addMember(g, 7947)
+		time.Sleep(10 * time.Millisecond)
+		addMember(g, 7948)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	next, err := g.WaitForChange(ctx, view.Version)
+	if err != nil {
+		t.Fatalf("failed to wait for a change: %v", err)
+	}
+	if next.Version <= view.Version {
+		t.Errorf("Expected version to increase past %d, got %d", view.Version, next.Version)
+	}
+	if len(next.Members) != 3 {
+		t.Errorf("Expected the burst to be coalesced into one view of 3 members, got %d", len(next.Members))
+	}
+
+	// Nothing changes after that, so the call must time out.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := g.WaitForChange(ctx, next.Version); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	g.Stop()
+	if _, err := g.WaitForChange(context.Background(), next.Version); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+}
+
+func TestGossiper_Watch(t *testing.T) {
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, NewMockTransport(), WithWatchCoalesce(0))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	views := g.Watch(ctx)
+
+	initial := <-views
+	if len(initial.Members) != 1 {
+		t.Fatalf("Expected only the local node, got %v", initial.Members)
+	}
+
+	addMember(g, 7947)
+	select {
+	case view := <-views:
+		if view.Version <= initial.Version || len(view.Members) != 2 {
+			t.Errorf("Expected a newer view with 2 members, got version %d with %d", view.Version, len(view.Members))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for a view")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-views:
+		if ok {
+			// A view may have been queued before the cancel; the
+			// channel must still be closed afterwards.
+			if _, ok := <-views; ok {
+				t.Error("Expected the channel to be closed")
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the channel to close")
+	}
+}
+
+// TestGossiper_SyncKeepsVersion checks that the periodic sync leaves the view
+// alone when nothing changed, so that watchers are not woken every tick.
+func TestGossiper_SyncKeepsVersion(t *testing.T) {
+	tr := NewMockTransport()
+	g, err := NewGossiper("node1", "127.0.0.1:7946", nil, tr, WithDelegate(&testDelegate{meta: []byte("meta")}))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	addMember(g, 7947)
+
+	version := g.View().Version
+	for i := 0; i < 5; i++ {
+		g.sendSync()
+	}
+	if got := g.View().Version; got != version {
+		t.Errorf("Expected version %d to be unchanged by sync ticks, got %d", version, got)
+	}
+	if len(tr.writeCh) != 5 {
+		t.Errorf("Expected a digest per tick, got %d messages", len(tr.writeCh))
+	}
+}
@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+	"github.com/princetheprogrammer/go-gossip/pkg/merkle"
+)
+
+// Entry is one version of a key: a last-writer-wins register holding either
+// a value or, once the key is deleted, a tombstone.
+type Entry struct {
+	Key   string `json:"k"`
+	Value []byte `json:"v,omitempty"`
+	// Timestamp is the hybrid logical clock time of the write. The write
+	// with the newest timestamp wins.
+	Timestamp gossip.Timestamp `json:"ts"`
+	// Node names the store that made the write. It breaks ties between
+	// writes made at the same timestamp on different nodes.
+	Node string `json:"n"`
+	// Deleted marks a tombstone.
+	Deleted bool `json:"d,omitempty"`
+}
+
+// newer reports whether e supersedes o. Writes are ordered by timestamp, then
+// by node name, then deletes before puts and finally by value, so that every
+// replica picks the same winner whatever order the writes arrive in.
+func (e Entry) newer(o Entry) bool {
+	if c := e.Timestamp.Compare(o.Timestamp); c != 0 {
+		return c > 0
+	}
+	if c := strings.Compare(e.Node, o.Node); c != 0 {
+		return c > 0
+	}
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+	return bytes.Compare(e.Value, o.Value) > 0
+}
+
+// size returns the number of bytes of the entry that count against the entry
+// size limit.
+func (e Entry) size() int {
+	return len(e.Key) + len(e.Value)
+}
+
+// digest returns the version digest of e for the store's merkle tree. Two
+// replicas holding the same version of a key produce the same digest.
+func (e Entry) digest() uint64 {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0
+	}
+	return merkle.Digest(data)
+}
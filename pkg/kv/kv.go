@@ -0,0 +1,533 @@
+// Package kv is an eventually consistent key-value store replicated over the
+// gossip protocol.
+//
+// Every key is a last-writer-wins register ordered by hybrid logical clock
+// timestamps. Writes are disseminated as gossip broadcasts, and replicas
+// reconcile their contents, tombstones included, in the gossiper's push-pull
+// exchanges using merkle anti-entropy, so they converge even when broadcasts
+// are lost, duplicated or reordered, and only the keys that differ cross the
+// network. A Store plugs into a Gossiper as its Delegate and message handler,
+// and Run lends it the gossiper to send through:
+//
+//	clock := gossip.NewHLC()
+//	store := kv.New("node1", kv.WithClock(clock))
+//	g, err := gossip.NewGossiper("node1", addr, peers, transport,
+//		gossip.WithClock(clock),
+//		gossip.WithDelegate(store),
+//		gossip.WithMessageHandler(func(from string, payload []byte) {
+//			store.HandleMessage(from, payload)
+//		}))
+//	go store.Run(ctx, g)
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+	"github.com/princetheprogrammer/go-gossip/pkg/merkle"
+)
+
+const (
+	// DefaultTombstoneTTL is how long deleted keys are remembered when no
+	// WithTombstoneTTL option is given.
+	DefaultTombstoneTTL = 24 * time.Hour
+	// DefaultRetransmits is the number of gossip rounds a write is
+	// piggybacked on when no WithRetransmits option is given.
+	DefaultRetransmits = 8
+	// DefaultMaxEntrySize is the maximum size of a key and its value in
+	// bytes when no WithMaxEntrySize option is given.
+	DefaultMaxEntrySize = 512
+	// DefaultGCInterval is how often Run collects expired tombstones when
+	// no WithGCInterval option is given.
+	DefaultGCInterval = time.Minute
+)
+
+// watchBuffer is the number of changes a watcher can fall behind by before
+// further changes are dropped.
+const watchBuffer = 64
+
+// packetMessageSize is the size above which anti-entropy messages go reliably
+// over the transport's streams rather than in single packets. A direct
+// message grows to about 16/9 of its payload once encoded, so this keeps the
+// packets within a 1500-byte MTU.
+const packetMessageSize = 768
+
+// bulkBuffer is the number of anti-entropy messages waiting to be sent over
+// streams before further ones are dropped, to be sent again by a later
+// exchange.
+const bulkBuffer = 64
+
+// ErrEmptyKey is returned when writing the empty key.
+var ErrEmptyKey = errors.New("empty key")
+
+// ErrEntryTooLarge is returned when a key and its value exceed the configured
+// size limit.
+var ErrEntryTooLarge = errors.New("entry too large")
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithTombstoneTTL sets how long deleted keys are kept as tombstones before
+// they are garbage-collected. A replica that missed the delete and is still
+// holding the old value when the tombstone is collected brings the value
+// back, so the TTL must exceed the longest partition the cluster should
+// survive.
+func WithTombstoneTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.tombstoneTTL = d
+	}
+}
+
+// WithRetransmits sets the number of gossip rounds each write is piggybacked
+// on. Writes that still miss a replica reach it through anti-entropy.
+func WithRetransmits(n int) Option {
+	return func(s *Store) {
+		s.retransmits = n
+	}
+}
+
+// WithMaxEntrySize sets the maximum size of a key and its value in bytes.
+// Every write travels in a single gossip packet, so it should stay small.
+func WithMaxEntrySize(n int) Option {
+	return func(s *Store) {
+		s.maxEntrySize = n
+	}
+}
+
+// WithClock sets the hybrid logical clock that timestamps writes. Sharing the
+// gossiper's clock, as set with gossip.WithClock, keeps the store's writes
+// ordered consistently with the versions the rest of the cluster has seen.
+// By default the store has a clock of its own.
+func WithClock(c *gossip.HLC) Option {
+	return func(s *Store) {
+		s.clock = c
+	}
+}
+
+// WithGCInterval sets how often Run collects the tombstones older than the
+// TTL.
+func WithGCInterval(d time.Duration) Option {
+	return func(s *Store) {
+		s.gcInterval = d
+	}
+}
+
+// update is a write waiting to be piggybacked on gossip.
+type update struct {
+	msg       []byte
+	transmits int
+}
+
+// bulkMessage is an anti-entropy message waiting to be sent reliably.
+type bulkMessage struct {
+	peer string
+	msg  []byte
+}
+
+// watcher receives the changes to keys under a prefix.
+type watcher struct {
+	prefix string
+	ch     chan Entry
+}
+
+// Cluster is the part of a Gossiper a Store uses for anti-entropy: direct
+// messages for the merkle descent, and reliable ones, which the gossiper
+// sends over its transport's streams, for the batches too large for a packet.
+type Cluster interface {
+	SendTo(node string, payload []byte) error
+	SendReliable(ctx context.Context, node string, payload []byte) error
+}
+
+// Store is a replicated key-value store. It implements gossip.Delegate, and
+// merkle.Replica for its anti-entropy.
+type Store struct {
+	node   string
+	clock  *gossip.HLC
+	tree   *merkle.Tree
+	syncer *merkle.Syncer
+
+	tombstoneTTL time.Duration
+	retransmits  int
+	maxEntrySize int
+	gcInterval   time.Duration
+
+	// bulk queues the messages sendBulk hands to Run.
+	bulk chan bulkMessage
+
+	mu       sync.Mutex
+	cluster  Cluster
+	entries  map[string]Entry
+	pending  map[string]*update
+	watchers map[*watcher]struct{}
+}
+
+var (
+	_ gossip.Delegate = (*Store)(nil)
+	_ merkle.Replica  = (*Store)(nil)
+)
+
+// New creates an empty store. node names the local replica and must be the
+// gossiper's node name, as peers reach the store by it.
+func New(node string, opts ...Option) *Store {
+	s := &Store{
+		node:         node,
+		clock:        gossip.NewHLC(),
+		tombstoneTTL: DefaultTombstoneTTL,
+		retransmits:  DefaultRetransmits,
+		maxEntrySize: DefaultMaxEntrySize,
+		gcInterval:   DefaultGCInterval,
+		tree:         merkle.NewTree(0),
+		entries:      make(map[string]Entry),
+		pending:      make(map[string]*update),
+		bulk:         make(chan bulkMessage, bulkBuffer),
+		watchers:     make(map[*watcher]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.syncer = merkle.NewSyncer(s.tree, s, s.send,
+		merkle.WithMaxMessageSize(packetMessageSize),
+		merkle.WithBulkSend(s.sendBulk, merkle.DefaultMaxMessageSize))
+	return s
+}
+
+// Get returns the value of key and whether it is set.
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+	return append([]byte(nil), e.Value...), true
+}
+
+// Put sets key to value and gossips the write to the other replicas. It fails
+// with ErrEntryTooLarge if the key and value exceed the configured size limit.
+func (s *Store) Put(key string, value []byte) error {
+	return s.write(Entry{Key: key, Value: append([]byte(nil), value...)})
+}
+
+// Delete removes key, leaving a tombstone that gossips the delete to the
+// other replicas. Deleting a key that is not set is not an error.
+func (s *Store) Delete(key string) error {
+	return s.write(Entry{Key: key, Deleted: true})
+}
+
+func (s *Store) write(e Entry) error {
+	if e.Key == "" {
+		return ErrEmptyKey
+	}
+	if size := e.size(); size > s.maxEntrySize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrEntryTooLarge, size, s.maxEntrySize)
+	}
+	e.Timestamp = s.clock.Now()
+	e.Node = s.node
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.apply(e) {
+		s.queue(e)
+	}
+	return nil
+}
+
+// List returns the entries whose keys start with prefix, sorted by key.
+// Deleted keys are left out.
+func (s *Store) List(prefix string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for key, e := range s.entries {
+		if e.Deleted || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		e.Value = append([]byte(nil), e.Value...)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// Watch returns a channel on which every change to a key starting with prefix
+// is delivered, local writes and merged remote ones alike. Deletes are
+// delivered as entries with Deleted set. A consumer that falls more than a
+// few dozen changes behind misses changes, and should List the prefix to
+// catch up. The channel is closed when ctx is done.
+func (s *Store) Watch(ctx context.Context, prefix string) <-chan Entry {
+	w := &watcher{prefix: prefix, ch: make(chan Entry, watchBuffer)}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+		close(w.ch)
+	}()
+	return w.ch
+}
+
+// apply merges e and reports whether it superseded the local version of its
+// key. The caller must hold s.mu.
+func (s *Store) apply(e Entry) bool {
+	if cur, ok := s.entries[e.Key]; ok && !e.newer(cur) {
+		return false
+	}
+	s.entries[e.Key] = e
+	s.tree.Set(e.Key, e.digest())
+	for w := range s.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+		}
+	}
+	return true
+}
+
+// merge applies entries received from another replica and returns those that
+// were new.
+func (s *Store) merge(entries []Entry) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var changed []Entry
+	for _, e := range entries {
+		if e.Key == "" || e.size() > s.maxEntrySize || s.expired(e, now) {
+			continue
+		}
+		s.clock.Update(e.Timestamp)
+		if s.apply(e) {
+			changed = append(changed, e)
+		}
+	}
+	return changed
+}
+
+// queue schedules e to be gossiped, replacing any older write of the same
+// key that has not finished spreading. The caller must hold s.mu.
+func (s *Store) queue(e Entry) {
+	msg, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+	s.pending[e.Key] = &update{msg: msg}
+}
+
+// gc drops the tombstones older than the TTL. The caller must hold s.mu.
+func (s *Store) gc(now time.Time) {
+	for key, e := range s.entries {
+		if s.expired(e, now) {
+			delete(s.entries, key)
+			s.tree.Delete(key)
+		}
+	}
+}
+
+// expired reports whether e is a tombstone older than the TTL. Expired
+// tombstones are neither kept nor merged, so that a replica that has not
+// collected one yet cannot hand it back.
+func (s *Store) expired(e Entry, now time.Time) bool {
+	return e.Deleted && now.Sub(e.Timestamp.Time()) > s.tombstoneTTL
+}
+
+// Run lends the store c to send its anti-entropy messages through, and
+// collects expired tombstones every GC interval, until ctx is done. Messages
+// from peers must be passed to HandleMessage. Until Run is called, the store
+// takes part in push-pull exchanges but sends nothing.
+func (s *Store) Run(ctx context.Context, c Cluster) {
+	s.mu.Lock()
+	s.cluster = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cluster = nil
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-s.bulk:
+			if err := c.SendReliable(ctx, m.peer, m.msg); err != nil {
+				// Log.Printf("[%s] failed to send anti-entropy entries to %s: %v", s.node, m.peer, err)
+			}
+		case <-ticker.C:
+			s.mu.Lock()
+			s.gc(time.Now())
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send sends a merkle descent message through the cluster given to Run.
+func (s *Store) send(peer string, msg []byte) error {
+	s.mu.Lock()
+	c := s.cluster
+	s.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.SendTo(peer, msg)
+}
+
+// sendBulk queues the anti-entropy messages too large for a packet for Run to
+// send reliably, one at a time. It is called from HandleMessage, on the
+// gossiper's receive goroutine, which must stay free to deliver the peer's
+// messages meanwhile. Messages that find the queue full are dropped; the
+// protocol is stateless, so a later exchange sends them again.
+func (s *Store) sendBulk(peer string, msg []byte) error {
+	s.mu.Lock()
+	running := s.cluster != nil
+	s.mu.Unlock()
+	if !running {
+		return nil
+	}
+	select {
+	case s.bulk <- bulkMessage{peer: peer, msg: msg}:
+	default:
+	}
+	return nil
+}
+
+// HandleMessage handles an anti-entropy message sent by the node from, and
+// reports whether msg was one. Other messages are left to the caller, so it
+// can be called first from the gossiper's message handler.
+func (s *Store) HandleMessage(from string, msg []byte) bool {
+	return s.syncer.HandleMessage(from, msg)
+}
+
+// Export implements merkle.Replica. It encodes the entries of keys, tombstones
+// included.
+func (s *Store) Export(keys []string) []byte {
+	s.mu.Lock()
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		if e, ok := s.entries[key]; ok {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Import implements merkle.Replica. It merges entries exported by another
+// replica.
+func (s *Store) Import(data []byte) {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+	s.merge(entries)
+}
+
+// NodeMeta implements gossip.Delegate. The store advertises no metadata.
+func (s *Store) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg implements gossip.Delegate. It merges a write gossiped by another
+// replica and gossips it on if it was new.
+func (s *Store) NotifyMsg(msg []byte) {
+	var e Entry
+	if err := json.Unmarshal(msg, &e); err != nil {
+		return
+	}
+	changed := s.merge([]Entry{e})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range changed {
+		s.queue(e)
+	}
+}
+
+// GetBroadcasts implements gossip.Delegate. It returns the pending writes
+// that fit within limit, least transmitted first, and forgets those that have
+// been sent the configured number of times.
+func (s *Store) GetBroadcasts(overhead, limit int) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.pending))
+	for key := range s.pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.pending[keys[i]].transmits < s.pending[keys[j]].transmits
+	})
+
+	var msgs [][]byte
+	for _, key := range keys {
+		u := s.pending[key]
+		if overhead+len(u.msg) > limit {
+			continue
+		}
+		limit -= overhead + len(u.msg)
+		msgs = append(msgs, u.msg)
+		u.transmits++
+		if u.transmits >= s.retransmits {
+			delete(s.pending, key)
+		}
+	}
+	return msgs
+}
+
+// syncState is the store's part of a push-pull exchange: the root of its
+// merkle tree, and the node to reconcile with if the roots differ.
+type syncState struct {
+	Node string `json:"node"`
+	Root uint64 `json:"root"`
+}
+
+// LocalState implements gossip.Delegate. Rather than the store's contents,
+// which would not fit a packet beyond a small store, it sends the root of the
+// merkle tree, so that the exchange finds out whether the replicas differ.
+func (s *Store) LocalState(join bool) []byte {
+	data, err := json.Marshal(&syncState{Node: s.node, Root: s.tree.Root()})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// MergeRemoteState implements gossip.Delegate. If the peer's root differs
+// from the local one, it starts a merkle reconciliation with the peer. Both
+// sides of an exchange see each other's root, so only the one whose node name
+// sorts first starts it, and not while the entries of an earlier one are still
+// queued, which would only send them again.
+func (s *Store) MergeRemoteState(buf []byte, join bool) {
+	var st syncState
+	if err := json.Unmarshal(buf, &st); err != nil || st.Node == "" || st.Node == s.node {
+		return
+	}
+	if st.Root == s.tree.Root() || s.node > st.Node || len(s.bulk) > 0 {
+		return
+	}
+	if err := s.syncer.Sync(st.Node); err != nil {
+		// Log.Printf("[%s] failed to sync with %s: %v", s.node, st.Node, err)
+	}
+}
@@ -0,0 +1,301 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/internal/testutil"
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+func TestStore_PutGetDelete(t *testing.T) {
+	s := New("node1", WithMaxEntrySize(16))
+
+	if err := s.Put("a", []byte("1")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if v, ok := s.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("Expected a=1, got %q, %v", v, ok)
+	}
+	if err := s.Put("a", []byte("2")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if v, _ := s.Get("a"); string(v) != "2" {
+		t.Errorf("Expected the later write to win, got %q", v)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, ok := s.Get("a"); ok {
+		t.Errorf("Expected a to be deleted")
+	}
+
+	if err := s.Put("", nil); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if err := s.Put("big", []byte(strings.Repeat("x", 16))); !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("Expected ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestStore_List(t *testing.T) {
+	s := New("node1")
+	for _, key := range []string{"config/b", "config/a", "other", "config/c"} {
+		s.Put(key, []byte(key))
+	}
+	s.Delete("config/c")
+
+	entries := s.List("config/")
+	if len(entries) != 2 || entries[0].Key != "config/a" || entries[1].Key != "config/b" {
+		t.Errorf("Expected config/a and config/b in order, got %v", entries)
+	}
+	if len(s.List("")) != 3 {
+		t.Errorf("Expected the empty prefix to list every live key, got %v", s.List(""))
+	}
+}
+
+func TestStore_Watch(t *testing.T) {
+	s := New("node1")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.Watch(ctx, "config/")
+
+	s.Put("other", []byte("x"))
+	s.Put("config/a", []byte("1"))
+	// A remote write that loses to the local one is not a change.
+	s.NotifyMsg([]byte(`{"k":"config/a","v":"MA==","ts":{"wall":1},"n":"node2"}`))
+	s.Delete("config/a")
+
+	if e := <-ch; e.Key != "config/a" || string(e.Value) != "1" {
+		t.Errorf("Expected the put of config/a, got %v", e)
+	}
+	if e := <-ch; e.Key != "config/a" || !e.Deleted {
+		t.Errorf("Expected the delete of config/a, got %v", e)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("Expected no further changes, got %v", e)
+	default:
+	}
+
+	cancel()
+	testutil.WaitFor(t, time.Second, "the watch channel to close", func() bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		default:
+			return false
+		}
+	})
+}
+
+func TestStore_TombstoneGC(t *testing.T) {
+	s := New("node1", WithTombstoneTTL(time.Minute))
+	s.Put("a", []byte("1"))
+	s.Delete("a")
+	s.Put("b", []byte("2"))
+
+	s.mu.Lock()
+	s.gc(time.Now())
+	_, kept := s.entries["a"]
+	s.gc(time.Now().Add(2 * time.Minute))
+	_, collected := s.entries["a"]
+	_, live := s.entries["b"]
+	s.mu.Unlock()
+
+	if !kept {
+		t.Errorf("Expected the tombstone to be kept within its TTL")
+	}
+	if collected {
+		t.Errorf("Expected the tombstone to be collected after its TTL")
+	}
+	if !live {
+		t.Errorf("Expected live keys never to be collected")
+	}
+}
+
+func TestStore_Clock(t *testing.T) {
+	clock := gossip.NewHLC()
+	g, err := gossip.NewGossiper("node1", "127.0.0.1:7946", nil, nil, gossip.WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to create gossiper: %v", err)
+	}
+	s := New("node1", WithClock(g.Clock()))
+
+	// A version the gossiper witnessed orders the store's next write.
+	seen := gossip.Timestamp{WallTime: time.Now().Add(time.Hour).UnixNano()}
+	g.Clock().Update(seen)
+	s.Put("a", []byte("1"))
+	if e := s.List("")[0]; e.Timestamp.Compare(seen) <= 0 {
+		t.Errorf("Expected the write to be newer than %v, got %v", seen, e.Timestamp)
+	}
+}
+
+func TestStore_Retransmits(t *testing.T) {
+	s := New("node1", WithRetransmits(2))
+	s.Put("a", []byte("1"))
+
+	for i := 0; i < 2; i++ {
+		if msgs := s.GetBroadcasts(2, 1400); len(msgs) != 1 {
+			t.Fatalf("Expected the write in round %d, got %d messages", i, len(msgs))
+		}
+	}
+	if msgs := s.GetBroadcasts(2, 1400); len(msgs) != 0 {
+		t.Errorf("Expected the write to be dropped after 2 rounds, got %d messages", len(msgs))
+	}
+	if msgs := s.GetBroadcasts(2, 10); len(msgs) != 0 {
+		t.Errorf("Expected nothing to fit in 10 bytes, got %d messages", len(msgs))
+	}
+}
+
+// recordingCluster records the peers a store sends anti-entropy messages to.
+type recordingCluster struct {
+	mu    sync.Mutex
+	peers []string
+}
+
+func (c *recordingCluster) SendTo(node string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers = append(c.peers, node)
+	return nil
+}
+
+func (c *recordingCluster) SendReliable(ctx context.Context, node string, payload []byte) error {
+	return c.SendTo(node, payload)
+}
+
+func (c *recordingCluster) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.peers...)
+}
+
+// TestStore_PushPullState checks that a push-pull exchange between differing
+// replicas starts one reconciliation, from the side whose name sorts first.
+func TestStore_PushPullState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b := New("a"), New("b")
+	clusters := []*recordingCluster{{}, {}}
+	go a.Run(ctx, clusters[0])
+	go b.Run(ctx, clusters[1])
+	testutil.WaitFor(t, time.Second, "Run to start", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return a.cluster != nil && b.cluster != nil
+	})
+
+	a.MergeRemoteState(b.LocalState(false), false)
+	if sent := clusters[0].get(); len(sent) != 0 {
+		t.Errorf("Expected no reconciliation between identical replicas, got %v", sent)
+	}
+
+	b.Put("k", []byte("v"))
+	a.MergeRemoteState(b.LocalState(false), false)
+	b.MergeRemoteState(a.LocalState(false), false)
+	if sent := clusters[0].get(); len(sent) != 1 || sent[0] != "b" {
+		t.Errorf("Expected a to start a reconciliation with b, got %v", sent)
+	}
+	if sent := clusters[1].get(); len(sent) != 0 {
+		t.Errorf("Expected b to leave the reconciliation to a, got %v", sent)
+	}
+}
+
+func TestStore_Gossip(t *testing.T) {
+	addrs := []string{"127.0.0.1:7095", "127.0.0.1:7096"}
+	stores := []*Store{New(addrs[0]), New(addrs[1])}
+	testutil.Start(testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithDelegate(stores[i]),
+			gossip.WithGossip(20*time.Millisecond, 3),
+		}
+	}))
+
+	// Wait for the join so that the write has somewhere to go.
+	if err := stores[1].Put("joined", nil); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	testutil.WaitFor(t, 5*time.Second, "the join", func() bool {
+		_, ok := stores[0].Get("joined")
+		return ok
+	})
+
+	if err := stores[0].Put("config/a", []byte("1")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	testutil.WaitFor(t, 5*time.Second, "the put to replicate", func() bool {
+		v, ok := stores[1].Get("config/a")
+		return ok && string(v) == "1"
+	})
+	if err := stores[1].Delete("config/a"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	testutil.WaitFor(t, 5*time.Second, "the delete to replicate", func() bool {
+		_, ok := stores[0].Get("config/a")
+		return !ok
+	})
+}
+
+// TestStore_SyncLargeStore checks that a member joining a store far larger
+// than a UDP datagram catches up through the anti-entropy of push-pull
+// exchanges alone.
+func TestStore_SyncLargeStore(t *testing.T) {
+	addrs := []string{"127.0.0.1:7108", "127.0.0.1:7109"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stores []*Store
+	for i, addr := range addrs {
+		s := New(addr, WithRetransmits(1))
+		stores = append(stores, s)
+		if i == 0 {
+			value := []byte(strings.Repeat("x", 400))
+			for k := 0; k < 1000; k++ {
+				if err := s.Put(fmt.Sprintf("key-%04d", k), value); err != nil {
+					t.Fatalf("failed to put: %v", err)
+				}
+			}
+			// Retire the writes, so that only anti-entropy can carry them.
+			for len(s.GetBroadcasts(0, 1<<20)) > 0 {
+			}
+			if size := len(s.Export(keysOf(s.List("")))); size < 65535 {
+				t.Fatalf("Expected the store to exceed a datagram, got %d bytes", size)
+			}
+		}
+	}
+	gossipers := testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithDelegate(stores[i]),
+			gossip.WithMessageHandler(func(from string, payload []byte) {
+				stores[i].HandleMessage(from, payload)
+			}),
+			gossip.WithPushPull(100*time.Millisecond, time.Second),
+		}
+	})
+	for i, g := range gossipers {
+		go stores[i].Run(ctx, g)
+	}
+	testutil.Start(gossipers)
+
+	testutil.WaitFor(t, 10*time.Second, "the joining store to catch up", func() bool {
+		return len(stores[1].List("")) == 1000
+	})
+	if stores[0].tree.Root() != stores[1].tree.Root() {
+		t.Errorf("Expected the replicas to be identical")
+	}
+}
+
+func keysOf(entries []Entry) []string {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
@@ -0,0 +1,213 @@
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// randomEntries returns n writes over a small key space, with timestamps that
+// often collide so that the tie-breakers are exercised. Timestamps are recent,
+// so that tombstones stay clear of garbage collection.
+func randomEntries(r *rand.Rand, n int) []Entry {
+	now := time.Now().UnixNano()
+	entries := make([]Entry, n)
+	for i := range entries {
+		e := Entry{
+			Key:       fmt.Sprintf("key-%d", r.Intn(5)),
+			Timestamp: gossip.Timestamp{WallTime: now + int64(r.Intn(4)), Logical: uint32(r.Intn(2))},
+			Node:      fmt.Sprintf("node-%d", r.Intn(3)),
+		}
+		if r.Intn(4) == 0 {
+			e.Deleted = true
+		} else {
+			e.Value = []byte(fmt.Sprintf("value-%d", r.Intn(3)))
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+// fromEntries returns a store holding the merge of entries.
+func fromEntries(entries []Entry) *Store {
+	s := New("test")
+	s.merge(entries)
+	return s
+}
+
+// mergeStores merges every entry of from into to, as a full anti-entropy
+// exchange does.
+func mergeStores(to, from *Store) {
+	var keys []string
+	for key := range contents(from) {
+		keys = append(keys, key)
+	}
+	if data := from.Export(keys); data != nil {
+		to.Import(data)
+	}
+}
+
+func contents(s *Store) map[string]Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(map[string]Entry, len(s.entries))
+	for k, e := range s.entries {
+		c[k] = e
+	}
+	return c
+}
+
+func TestMerge_Commutative(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		a, b := randomEntries(r, 10), randomEntries(r, 10)
+
+		ab := fromEntries(a)
+		mergeStores(ab, fromEntries(b))
+		ba := fromEntries(b)
+		mergeStores(ba, fromEntries(a))
+		if !reflect.DeepEqual(contents(ab), contents(ba)) {
+			t.Fatalf("a⊔b != b⊔a:\n%v\n%v", contents(ab), contents(ba))
+		}
+
+		// The order of individual writes does not matter either.
+		shuffled := append(append([]Entry(nil), a...), b...)
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if got := contents(fromEntries(shuffled)); !reflect.DeepEqual(got, contents(ab)) {
+			t.Fatalf("merging shuffled writes gave %v, want %v", got, contents(ab))
+		}
+	}
+}
+
+func TestMerge_Associative(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		a, b, c := randomEntries(r, 10), randomEntries(r, 10), randomEntries(r, 10)
+
+		// (a⊔b)⊔c
+		left := fromEntries(a)
+		mergeStores(left, fromEntries(b))
+		mergeStores(left, fromEntries(c))
+
+		// a⊔(b⊔c)
+		bc := fromEntries(b)
+		mergeStores(bc, fromEntries(c))
+		right := fromEntries(a)
+		mergeStores(right, bc)
+
+		if !reflect.DeepEqual(contents(left), contents(right)) {
+			t.Fatalf("(a⊔b)⊔c != a⊔(b⊔c):\n%v\n%v", contents(left), contents(right))
+		}
+	}
+}
+
+func TestMerge_Idempotent(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 200; i++ {
+		a := fromEntries(randomEntries(r, 10))
+		before := contents(a)
+
+		mergeStores(a, a)
+		if changed := a.merge(randomOrder(r, before)); len(changed) != 0 {
+			t.Fatalf("re-merging its own entries changed %v", changed)
+		}
+		if !reflect.DeepEqual(contents(a), before) {
+			t.Fatalf("a⊔a != a:\n%v\n%v", contents(a), before)
+		}
+	}
+}
+
+func randomOrder(r *rand.Rand, m map[string]Entry) []Entry {
+	entries := make([]Entry, 0, len(m))
+	for _, e := range m {
+		entries = append(entries, e)
+	}
+	r.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	return entries
+}
+
+// TestStore_ConvergesUnderLossAndDuplication runs replicas that exchange
+// writes over a network that drops, duplicates and reorders messages, with
+// occasional full state synchronization, and checks that they end up
+// identical.
+func TestStore_ConvergesUnderLossAndDuplication(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	stores := make([]*Store, 5)
+	for i := range stores {
+		stores[i] = New(fmt.Sprintf("node-%d", i), WithRetransmits(3))
+	}
+
+	type packet struct {
+		to  int
+		msg []byte
+	}
+	var inflight []packet
+	deliver := func() {
+		r.Shuffle(len(inflight), func(i, j int) { inflight[i], inflight[j] = inflight[j], inflight[i] })
+		for _, p := range inflight {
+			stores[p.to].NotifyMsg(p.msg)
+		}
+		inflight = nil
+	}
+
+	for round := 0; round < 300; round++ {
+		s := stores[r.Intn(len(stores))]
+		key := fmt.Sprintf("key-%d", r.Intn(20))
+		if r.Intn(4) == 0 {
+			s.Delete(key)
+		} else {
+			s.Put(key, []byte(fmt.Sprintf("value-%d", round)))
+		}
+
+		// Gossip a round: half the packets are lost, a fifth duplicated.
+		for i, s := range stores {
+			for _, msg := range s.GetBroadcasts(0, 1400) {
+				to := (i + 1 + r.Intn(len(stores)-1)) % len(stores)
+				if r.Intn(2) == 0 {
+					continue
+				}
+				inflight = append(inflight, packet{to, msg})
+				if r.Intn(5) == 0 {
+					inflight = append(inflight, packet{to, msg})
+				}
+			}
+		}
+		deliver()
+
+		// Anti-entropy now and then, itself subject to loss.
+		if round%10 == 0 && r.Intn(2) == 0 {
+			a, b := r.Intn(len(stores)), r.Intn(len(stores))
+			mergeStores(stores[a], stores[b])
+		}
+	}
+
+	// Once writes stop, lossy sync rounds between random pairs make every
+	// replica identical.
+	converged := func() bool {
+		want := contents(stores[0])
+		for _, s := range stores[1:] {
+			if !reflect.DeepEqual(contents(s), want) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; !converged(); i++ {
+		if i == 1000 {
+			t.Fatalf("replicas did not converge after %d sync rounds", i)
+		}
+		if r.Intn(2) == 0 {
+			continue
+		}
+		mergeStores(stores[r.Intn(len(stores))], stores[r.Intn(len(stores))])
+	}
+	for _, s := range stores[1:] {
+		if s.tree.Root() != stores[0].tree.Root() {
+			t.Errorf("Expected identical replicas to have the same merkle root")
+		}
+	}
+}
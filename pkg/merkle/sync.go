@@ -0,0 +1,285 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+const (
+	// DefaultBatchSize is the largest number of tree nodes, leaves or keys
+	// carried per message when no WithBatchSize option is given. Batches
+	// are split further to respect the message size limit.
+	DefaultBatchSize = 32
+	// DefaultMaxMessageSize is the size in bytes above which a message is
+	// split into smaller batches when no WithMaxMessageSize option is given.
+	// It matches the default payload limit of Gossiper.SendTo.
+	DefaultMaxMessageSize = 16 * 1024
+)
+
+// magic prefixes every message of the protocol, so that HandleMessage can
+// tell them apart from the application's own messages.
+var magic = []byte("MRKL")
+
+// Replica is the replicated store a Syncer reconciles. Its Tree must be kept
+// up to date with every change, local or merged.
+type Replica interface {
+	// Export encodes the current versions of keys, including tombstones,
+	// for a peer. Keys the replica does not hold are left out.
+	Export(keys []string) []byte
+	// Import merges versions exported by a peer.
+	Import(data []byte)
+}
+
+// SendFunc sends a protocol message to a peer, for example Gossiper.SendTo.
+type SendFunc func(peer string, msg []byte) error
+
+// Option configures a Syncer.
+type Option func(*Syncer)
+
+// WithBatchSize sets the largest number of tree nodes, leaves or keys carried
+// per message. Larger batches mean fewer messages but larger packets.
+func WithBatchSize(n int) Option {
+	return func(s *Syncer) {
+		s.batchSize = n
+	}
+}
+
+// WithMaxMessageSize sets the size in bytes above which a message is split
+// into smaller batches. It must not exceed what the SendFunc can carry. A
+// single leaf or key exported alone is still sent whatever its size, and
+// left to the SendFunc to refuse.
+func WithMaxMessageSize(n int) Option {
+	return func(s *Syncer) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithBulkSend sets the SendFunc that carries the batches too large for
+// WithMaxMessageSize, such as ranges of many leaves or entries, and the size
+// in bytes above which those are split in turn. A function calling
+// Gossiper.SendReliable sends them over the transport's streams, where they
+// are acknowledged and not bounded by a datagram, while the small messages
+// that make up most of a descent stay single packets. send is called from
+// HandleMessage, so it must not wait for the peer to answer.
+func WithBulkSend(send SendFunc, maxMessageSize int) Option {
+	return func(s *Syncer) {
+		s.bulkSend = send
+		s.bulkMessageSize = maxMessageSize
+	}
+}
+
+// Syncer runs the reconciliation protocol for one replica. The protocol is
+// stateless: every message carries what the receiver needs to take the next
+// step, so a lost message only ends that branch of the descent, and the next
+// Sync picks it up again.
+type Syncer struct {
+	tree           *Tree
+	replica        Replica
+	send           SendFunc
+	batchSize      int
+	maxMessageSize int
+	// bulkSend, if set, carries the batches larger than maxMessageSize, up
+	// to bulkMessageSize.
+	bulkSend        SendFunc
+	bulkMessageSize int
+}
+
+// NewSyncer creates a Syncer that reconciles replica, summarized by tree, and
+// sends its messages with send. Messages from peers must be passed to
+// HandleMessage.
+func NewSyncer(tree *Tree, replica Replica, send SendFunc, opts ...Option) *Syncer {
+	s := &Syncer{
+		tree:           tree,
+		replica:        replica,
+		send:           send,
+		batchSize:      DefaultBatchSize,
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// node is the hash of one tree node.
+type node struct {
+	Index int    `json:"i"`
+	Hash  uint64 `json:"h"`
+}
+
+// leaf is the contents of one leaf.
+type leaf struct {
+	Index int               `json:"i"`
+	Items map[string]uint64 `json:"items,omitempty"`
+}
+
+// message is a protocol message. Exactly one of its parts is set.
+type message struct {
+	// Depth is the depth of the sender's tree.
+	Depth int `json:"depth"`
+	// Level and Nodes carry node hashes for the receiver to compare.
+	Level int    `json:"level,omitempty"`
+	Nodes []node `json:"nodes,omitempty"`
+	// Leaves carry leaf contents for the receiver to diff.
+	Leaves []leaf `json:"leaves,omitempty"`
+	// Entries carries exported versions, and Want the keys the sender asks
+	// the receiver to export.
+	Entries []byte   `json:"entries,omitempty"`
+	Want    []string `json:"want,omitempty"`
+}
+
+// Sync starts a reconciliation with peer by sending it the root hash. The
+// exchange continues through HandleMessage on both sides and ends once both
+// replicas hold the newest versions of every key either of them had.
+func (s *Syncer) Sync(peer string) error {
+	return s.sendMessage(peer, &message{
+		Nodes: []node{{Index: 0, Hash: s.tree.Root()}},
+	})
+}
+
+// HandleMessage processes msg if it belongs to the protocol and reports
+// whether it did. Messages of other protocols are left to the caller.
+func (s *Syncer) HandleMessage(from string, msg []byte) bool {
+	if !bytes.HasPrefix(msg, magic) {
+		return false
+	}
+	var m message
+	if err := json.Unmarshal(msg[len(magic):], &m); err != nil || m.Depth != s.tree.Depth() {
+		return true
+	}
+	switch {
+	case len(m.Nodes) > 0:
+		s.compareNodes(from, m.Level, m.Nodes)
+	case len(m.Leaves) > 0:
+		s.compareLeaves(from, m.Leaves)
+	default:
+		if len(m.Entries) > 0 {
+			s.replica.Import(m.Entries)
+		}
+		s.sendEntries(from, m.Want, nil)
+	}
+	return true
+}
+
+// compareNodes answers the nodes that differ from the local tree: with the
+// children hashes of differing inner nodes, to descend a level, or with the
+// contents of differing leaves.
+func (s *Syncer) compareNodes(from string, level int, nodes []node) {
+	depth := s.tree.Depth()
+	var children []node
+	var leaves []leaf
+	for _, n := range nodes {
+		if !s.tree.valid(level, n.Index) || s.tree.Hash(level, n.Index) == n.Hash {
+			continue
+		}
+		if level == depth {
+			leaves = append(leaves, leaf{Index: n.Index, Items: s.tree.Leaf(n.Index)})
+			continue
+		}
+		for c := 0; c < Fanout; c++ {
+			i := n.Index*Fanout + c
+			children = append(children, node{Index: i, Hash: s.tree.Hash(level+1, i)})
+		}
+	}
+
+	s.sendBatches(from, len(children), func(i, j int) *message {
+		return &message{Level: level + 1, Nodes: children[i:j]}
+	})
+	s.sendBatches(from, len(leaves), func(i, j int) *message {
+		return &message{Leaves: leaves[i:j]}
+	})
+}
+
+// compareLeaves diffs the peer's leaves with the local ones, sends the local
+// versions of the keys that differ and asks for the peer's.
+func (s *Syncer) compareLeaves(from string, leaves []leaf) {
+	var push, want []string
+	for _, l := range leaves {
+		if !s.tree.valid(s.tree.Depth(), l.Index) {
+			continue
+		}
+		local := s.tree.Leaf(l.Index)
+		for key, d := range local {
+			if remote, ok := l.Items[key]; !ok || remote != d {
+				push = append(push, key)
+			}
+		}
+		for key, d := range l.Items {
+			if ld, ok := local[key]; !ok || ld != d {
+				want = append(want, key)
+			}
+		}
+	}
+	sort.Strings(push)
+	sort.Strings(want)
+	s.sendEntries(from, push, want)
+}
+
+// sendEntries sends the local versions of push, and the request for want, in
+// batches.
+func (s *Syncer) sendEntries(to string, push, want []string) {
+	s.sendBatches(to, len(push), func(i, j int) *message {
+		entries := s.replica.Export(push[i:j])
+		if len(entries) == 0 {
+			return nil
+		}
+		return &message{Entries: entries}
+	})
+	s.sendBatches(to, len(want), func(i, j int) *message {
+		return &message{Want: want[i:j]}
+	})
+}
+
+// sendBatches sends n items in messages built by batch, which returns the
+// message carrying items i to j, or nil if there is nothing to send. Batches
+// hold up to batchSize items and are halved until they encode within
+// maxMessageSize, or within bulkMessageSize to be sent with bulkSend if it is
+// set.
+func (s *Syncer) sendBatches(to string, n int, batch func(i, j int) *message) {
+	for i := 0; i < n; {
+		size := min(s.batchSize, n-i)
+		for {
+			m := batch(i, i+size)
+			if m == nil {
+				break
+			}
+			data, err := s.encode(m)
+			if err != nil {
+				return
+			}
+			if len(data) <= s.maxMessageSize {
+				s.send(to, data)
+				break
+			}
+			if s.bulkSend != nil && (len(data) <= s.bulkMessageSize || size == 1) {
+				s.bulkSend(to, data)
+				break
+			}
+			if size == 1 {
+				s.send(to, data)
+				break
+			}
+			size /= 2
+		}
+		i += size
+	}
+}
+
+func (s *Syncer) sendMessage(to string, m *message) error {
+	data, err := s.encode(m)
+	if err != nil {
+		return err
+	}
+	return s.send(to, data)
+}
+
+// encode encodes m with the magic prefix.
+func (s *Syncer) encode(m *message) ([]byte, error) {
+	m.Depth = s.tree.Depth()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), magic...), data...), nil
+}
@@ -0,0 +1,342 @@
+package merkle
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/internal/testutil"
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// versioned is a value with a version; the higher version wins.
+type versioned struct {
+	Value   string `json:"v"`
+	Version uint64 `json:"n"`
+}
+
+// mapReplica is a last-writer-wins map that keeps its tree up to date.
+type mapReplica struct {
+	tree *Tree
+
+	mu   sync.Mutex
+	data map[string]versioned
+}
+
+func newMapReplica(depth int) *mapReplica {
+	return &mapReplica{tree: NewTree(depth), data: make(map[string]versioned)}
+}
+
+func (r *mapReplica) put(key string, v versioned) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, ok := r.data[key]; ok && cur.Version >= v.Version {
+		return
+	}
+	r.data[key] = v
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v.Version)
+	r.tree.Set(key, Digest(buf[:]))
+}
+
+func (r *mapReplica) Export(keys []string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]versioned, len(keys))
+	for _, k := range keys {
+		if v, ok := r.data[k]; ok {
+			out[k] = v
+		}
+	}
+	data, _ := json.Marshal(out)
+	return data
+}
+
+func (r *mapReplica) Import(data []byte) {
+	var in map[string]versioned
+	if err := json.Unmarshal(data, &in); err != nil {
+		return
+	}
+	for k, v := range in {
+		r.put(k, v)
+	}
+}
+
+func (r *mapReplica) contents() map[string]versioned {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := make(map[string]versioned, len(r.data))
+	for k, v := range r.data {
+		c[k] = v
+	}
+	return c
+}
+
+// network delivers messages between syncers in rounds, so that the number of
+// round trips of an exchange can be counted.
+type network struct {
+	r       *rand.Rand
+	loss    float64
+	syncers map[string]*Syncer
+	queue   []delivery
+	bytes   int
+	msgs    int
+}
+
+type delivery struct {
+	from, to string
+	msg      []byte
+}
+
+func (n *network) sender(from string) SendFunc {
+	return func(to string, msg []byte) error {
+		n.msgs++
+		n.bytes += len(msg)
+		if n.r.Float64() < n.loss {
+			return nil
+		}
+		n.queue = append(n.queue, delivery{from, to, msg})
+		return nil
+	}
+}
+
+// run delivers messages until none are left and returns the number of
+// rounds it took.
+func (n *network) run() int {
+	rounds := 0
+	for len(n.queue) > 0 {
+		rounds++
+		queue := n.queue
+		n.queue = nil
+		for _, d := range queue {
+			n.syncers[d.to].HandleMessage(d.from, d.msg)
+		}
+	}
+	return rounds
+}
+
+// pair returns two replicas holding the same keys, of which changed differ.
+func pair(keys, changed int) (*mapReplica, *mapReplica) {
+	a, b := newMapReplica(DefaultDepth), newMapReplica(DefaultDepth)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		a.put(key, versioned{Value: "v1", Version: 1})
+		b.put(key, versioned{Value: "v1", Version: 1})
+	}
+	for i := 0; i < changed; i++ {
+		// Newer on either side, or missing on one.
+		switch i % 3 {
+		case 0:
+			a.put(fmt.Sprintf("key-%d", i*7), versioned{Value: "v2", Version: 2})
+		case 1:
+			b.put(fmt.Sprintf("key-%d", i*7), versioned{Value: "v2", Version: 2})
+		default:
+			b.put(fmt.Sprintf("new-%d", i), versioned{Value: "v1", Version: 1})
+		}
+	}
+	return a, b
+}
+
+func TestSyncer_Reconciles(t *testing.T) {
+	a, b := pair(20000, 10)
+	n := &network{r: rand.New(rand.NewSource(1)), syncers: make(map[string]*Syncer)}
+	n.syncers["a"] = NewSyncer(a.tree, a, n.sender("a"))
+	n.syncers["b"] = NewSyncer(b.tree, b, n.sender("b"))
+
+	if err := n.syncers["a"].Sync("b"); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	rounds := n.run()
+
+	if !reflect.DeepEqual(a.contents(), b.contents()) {
+		t.Fatalf("Expected the replicas to be identical after one exchange")
+	}
+	if a.tree.Root() != b.tree.Root() {
+		t.Errorf("Expected equal roots after the exchange")
+	}
+	// Descending the tree takes one round per level, plus the leaves, the
+	// entries and the requested entries.
+	if max := DefaultDepth + 4; rounds > max {
+		t.Errorf("Expected at most %d rounds, took %d", max, rounds)
+	}
+	full := len(a.Export(keysOf(a.contents())))
+	if n.bytes*10 > full {
+		t.Errorf("Expected far less than the %d bytes of a full exchange, sent %d", full, n.bytes)
+	}
+	t.Logf("%d rounds, %d messages, %d bytes (full state: %d bytes)", rounds, n.msgs, n.bytes, full)
+
+	// In sync, an exchange is a single message.
+	n.msgs = 0
+	n.syncers["a"].Sync("b")
+	n.run()
+	if n.msgs != 1 {
+		t.Errorf("Expected only the root hash once in sync, sent %d messages", n.msgs)
+	}
+}
+
+func TestSyncer_ConvergesUnderLoss(t *testing.T) {
+	a, b := pair(5000, 100)
+	n := &network{r: rand.New(rand.NewSource(2)), loss: 0.2, syncers: make(map[string]*Syncer)}
+	n.syncers["a"] = NewSyncer(a.tree, a, n.sender("a"), WithBatchSize(8))
+	n.syncers["b"] = NewSyncer(b.tree, b, n.sender("b"), WithBatchSize(8))
+
+	for i := 0; a.tree.Root() != b.tree.Root(); i++ {
+		if i == 50 {
+			t.Fatalf("replicas did not converge after %d exchanges", i)
+		}
+		if i%2 == 0 {
+			n.syncers["a"].Sync("b")
+		} else {
+			n.syncers["b"].Sync("a")
+		}
+		n.run()
+	}
+	if !reflect.DeepEqual(a.contents(), b.contents()) {
+		t.Fatalf("Expected equal roots to mean identical replicas")
+	}
+}
+
+// TestSyncer_MessageSize checks that batches of large values are split to fit
+// the message size limit.
+func TestSyncer_MessageSize(t *testing.T) {
+	a, b := pair(1000, 0)
+	value := strings.Repeat("x", 200)
+	for i := 0; i < 2000; i++ {
+		a.put(fmt.Sprintf("big-%d", i), versioned{Value: value, Version: 1})
+	}
+	const limit = 1000
+	n := &network{r: rand.New(rand.NewSource(3)), syncers: make(map[string]*Syncer)}
+	largest := 0
+	for _, name := range []string{"a", "b"} {
+		send := n.sender(name)
+		sizeOf := func(to string, msg []byte) error {
+			largest = max(largest, len(msg))
+			return send(to, msg)
+		}
+		r := map[string]*mapReplica{"a": a, "b": b}[name]
+		n.syncers[name] = NewSyncer(r.tree, r, sizeOf, WithMaxMessageSize(limit))
+	}
+
+	n.syncers["b"].Sync("a")
+	n.run()
+	if a.tree.Root() != b.tree.Root() {
+		t.Fatalf("replicas did not converge")
+	}
+	if largest > limit {
+		t.Errorf("Expected messages of at most %d bytes, got %d", limit, largest)
+	}
+}
+
+// TestSyncer_BulkSend checks that batches too large for the message size limit
+// go through the bulk SendFunc, within its own limit, rather than being split,
+// while the rest keep to the regular one.
+func TestSyncer_BulkSend(t *testing.T) {
+	a, b := pair(1000, 0)
+	value := strings.Repeat("x", 200)
+	for i := 0; i < 2000; i++ {
+		a.put(fmt.Sprintf("big-%d", i), versioned{Value: value, Version: 1})
+	}
+	const limit, bulkLimit = 1000, 64 * 1024
+	n := &network{r: rand.New(rand.NewSource(4)), syncers: make(map[string]*Syncer)}
+	largest, largestBulk := 0, 0
+	for _, name := range []string{"a", "b"} {
+		send := n.sender(name)
+		regular := func(to string, msg []byte) error {
+			largest = max(largest, len(msg))
+			return send(to, msg)
+		}
+		bulk := func(to string, msg []byte) error {
+			largestBulk = max(largestBulk, len(msg))
+			return send(to, msg)
+		}
+		r := map[string]*mapReplica{"a": a, "b": b}[name]
+		n.syncers[name] = NewSyncer(r.tree, r, regular, WithMaxMessageSize(limit), WithBulkSend(bulk, bulkLimit))
+	}
+
+	n.syncers["b"].Sync("a")
+	n.run()
+	if a.tree.Root() != b.tree.Root() {
+		t.Fatalf("replicas did not converge")
+	}
+	if largest > limit {
+		t.Errorf("Expected regular messages of at most %d bytes, got %d", limit, largest)
+	}
+	if largestBulk <= limit || largestBulk > bulkLimit {
+		t.Errorf("Expected bulk messages above %d and up to %d bytes, got %d", limit, bulkLimit, largestBulk)
+	}
+}
+
+func TestSyncer_IgnoresOtherMessages(t *testing.T) {
+	r := newMapReplica(2)
+	s := NewSyncer(r.tree, r, func(string, []byte) error { return nil })
+	if s.HandleMessage("b", []byte("hello")) {
+		t.Errorf("Expected a foreign message to be left to the caller")
+	}
+	other := newMapReplica(3)
+	msg := []byte(`MRKL{"depth":3,"nodes":[{"i":0,"h":1}]}`)
+	sent := false
+	s = NewSyncer(other.tree, other, func(string, []byte) error { sent = true; return nil })
+	if !s.HandleMessage("b", msg) || !sent {
+		t.Errorf("Expected a message for a tree of the same depth to be answered")
+	}
+	sent = false
+	s = NewSyncer(r.tree, r, func(string, []byte) error { sent = true; return nil })
+	if !s.HandleMessage("b", msg) || sent {
+		t.Errorf("Expected a message for a tree of another depth to be dropped")
+	}
+}
+
+func keysOf(m map[string]versioned) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// TestSyncer_OverGossip reconciles replicas whose difference is far larger
+// than a datagram, with the bulk of the exchange going over streams through
+// SendReliable.
+func TestSyncer_OverGossip(t *testing.T) {
+	addrs := []string{"127.0.0.1:7097", "127.0.0.1:7098"}
+	a, b := pair(2000, 20)
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 500; i++ {
+		b.put(fmt.Sprintf("big-%d", i), versioned{Value: value, Version: 1})
+	}
+	replicas := []*mapReplica{a, b}
+	const bulkLimit = 256 * 1024
+	syncers := make([]*Syncer, len(addrs))
+	gossipers := testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithMessageHandler(func(from string, payload []byte) {
+				syncers[i].HandleMessage(from, payload)
+			}),
+			gossip.WithMaxDirectSize(bulkLimit),
+		}
+	})
+	for i, g := range gossipers {
+		bulk := func(peer string, msg []byte) error {
+			go g.SendReliable(context.Background(), peer, msg)
+			return nil
+		}
+		syncers[i] = NewSyncer(replicas[i].tree, replicas[i], g.SendTo, WithBulkSend(bulk, bulkLimit))
+	}
+	testutil.Start(gossipers)
+
+	testutil.WaitFor(t, 5*time.Second, "the join", func() bool {
+		return len(gossipers[1].AliveMembers()) == 2 && len(gossipers[0].AliveMembers()) == 2
+	})
+	testutil.WaitFor(t, 5*time.Second, "the replicas to converge", func() bool {
+		syncers[0].Sync(addrs[1])
+		time.Sleep(50 * time.Millisecond)
+		return a.tree.Root() == b.tree.Root()
+	})
+}
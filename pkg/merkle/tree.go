@@ -0,0 +1,233 @@
+// Package merkle reconciles large replicated datasets with a range-hash tree.
+//
+// A Tree summarizes a replica's keys and versions: every key hashes to one of
+// the tree's leaves, each leaf hashes the versions of its keys, and each inner
+// node hashes its children. Two replicas with equal roots hold the same data;
+// otherwise a Syncer descends only into the subtrees whose hashes differ and
+// exchanges just the keys of the differing leaves, which takes a number of
+// round trips logarithmic in the number of keys.
+//
+// The protocol runs over any best-effort messaging, such as a Gossiper's
+// direct messages:
+//
+//	var syncer *merkle.Syncer
+//	g, err := gossip.NewGossiper(name, addr, peers, transport,
+//		gossip.WithMessageHandler(func(from string, payload []byte) {
+//			syncer.HandleMessage(from, payload)
+//		}))
+//	syncer = merkle.NewSyncer(tree, replica, g.SendTo)
+//
+// and the application calls Sync with a random member now and then.
+package merkle
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// Fanout is the number of children of every inner node.
+const Fanout = 16
+
+const (
+	// DefaultDepth is the depth of a tree created with a depth of zero. Its
+	// 65536 leaves keep leaves small up to a few hundred thousand keys.
+	DefaultDepth = 4
+	// MaxDepth is the deepest tree supported.
+	MaxDepth = 5
+)
+
+// Digest hashes b into a version digest suitable for Tree.Set.
+func Digest(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// Tree is a range-hash tree over a set of keys and their version digests. It
+// is safe for concurrent use.
+type Tree struct {
+	depth int
+
+	mu sync.Mutex
+	// leaves holds the keys of each non-empty leaf with their digests.
+	leaves map[int]map[string]uint64
+	// hashes holds the hash of every node per level, the leaves last.
+	hashes [][]uint64
+	// dirty marks the inner nodes whose hash must be recomputed.
+	dirty [][]bool
+}
+
+// NewTree creates an empty tree of the given depth, between 1 and MaxDepth,
+// with Fanout^depth leaves. Zero selects DefaultDepth. Replicas can only be
+// reconciled with trees of the same depth.
+func NewTree(depth int) *Tree {
+	if depth <= 0 {
+		depth = DefaultDepth
+	}
+	if depth > MaxDepth {
+		depth = MaxDepth
+	}
+	t := &Tree{
+		depth:  depth,
+		leaves: make(map[int]map[string]uint64),
+		hashes: make([][]uint64, depth+1),
+		dirty:  make([][]bool, depth),
+	}
+	width := 1
+	for level := 0; level <= depth; level++ {
+		t.hashes[level] = make([]uint64, width)
+		if level < depth {
+			t.dirty[level] = make([]bool, width)
+		}
+		width *= Fanout
+	}
+	// Inner hashes of the empty tree are computed like any other.
+	for level := range t.dirty {
+		for i := range t.dirty[level] {
+			t.dirty[level][i] = true
+		}
+	}
+	return t
+}
+
+// Depth returns the depth of the tree.
+func (t *Tree) Depth() int {
+	return t.depth
+}
+
+// Set records the version digest of key, replacing any previous one.
+func (t *Tree) Set(key string, digest uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	leaf := t.leafOf(key)
+	items := t.leaves[leaf]
+	if items == nil {
+		items = make(map[string]uint64)
+		t.leaves[leaf] = items
+	}
+	if old, ok := items[key]; ok {
+		if old == digest {
+			return
+		}
+		t.hashes[t.depth][leaf] ^= itemHash(key, old)
+	}
+	items[key] = digest
+	t.hashes[t.depth][leaf] ^= itemHash(key, digest)
+	t.invalidate(leaf)
+}
+
+// Delete removes key from the tree.
+func (t *Tree) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	leaf := t.leafOf(key)
+	old, ok := t.leaves[leaf][key]
+	if !ok {
+		return
+	}
+	delete(t.leaves[leaf], key)
+	if len(t.leaves[leaf]) == 0 {
+		delete(t.leaves, leaf)
+	}
+	t.hashes[t.depth][leaf] ^= itemHash(key, old)
+	t.invalidate(leaf)
+}
+
+// Len returns the number of keys in the tree.
+func (t *Tree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, items := range t.leaves {
+		n += len(items)
+	}
+	return n
+}
+
+// Root returns the hash of the whole tree.
+func (t *Tree) Root() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hash(0, 0)
+}
+
+// Hash returns the hash of the node at index on level, where level 0 is the
+// root and level Depth holds the leaves.
+func (t *Tree) Hash(level, index int) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hash(level, index)
+}
+
+// Leaf returns a copy of the keys of the leaf at index with their digests.
+func (t *Tree) Leaf(index int) map[string]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	items := make(map[string]uint64, len(t.leaves[index]))
+	for k, d := range t.leaves[index] {
+		items[k] = d
+	}
+	return items
+}
+
+// valid reports whether index names a node on level.
+func (t *Tree) valid(level, index int) bool {
+	return level >= 0 && level <= t.depth && index >= 0 && index < len(t.hashes[level])
+}
+
+// leafOf returns the index of the leaf key belongs to: the top bits of its
+// hash, so that neighbouring leaves share their ancestors. The FNV hash is
+// mixed first, since its top bits barely differ between short keys that
+// differ only in their last characters.
+func (t *Tree) leafOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(mix(h.Sum64()) >> (64 - 4*t.depth))
+}
+
+// mix is the finalizer of MurmurHash3, which spreads every input bit over
+// every output bit.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// invalidate marks the ancestors of leaf for recomputation. The caller must
+// hold t.mu.
+func (t *Tree) invalidate(leaf int) {
+	for level := t.depth - 1; level >= 0; level-- {
+		leaf /= Fanout
+		t.dirty[level][leaf] = true
+	}
+}
+
+// hash returns the hash of a node, recomputing it if it is dirty. The caller
+// must hold t.mu.
+func (t *Tree) hash(level, index int) uint64 {
+	if level == t.depth || !t.dirty[level][index] {
+		return t.hashes[level][index]
+	}
+	var buf [8 * Fanout]byte
+	for c := 0; c < Fanout; c++ {
+		binary.BigEndian.PutUint64(buf[8*c:], t.hash(level+1, index*Fanout+c))
+	}
+	t.hashes[level][index] = Digest(buf[:])
+	t.dirty[level][index] = false
+	return t.hashes[level][index]
+}
+
+// itemHash combines a key and its digest into the value XORed into its leaf,
+// so that a leaf's hash does not depend on the order its keys were added in.
+func itemHash(key string, digest uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], digest)
+	h.Write(buf[:])
+	return h.Sum64()
+}
@@ -0,0 +1,71 @@
+package merkle
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTree_OrderIndependent(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	a, b := NewTree(3), NewTree(3)
+	for i, k := range keys {
+		a.Set(k, uint64(i))
+	}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(keys)) {
+		b.Set(keys[i], uint64(i))
+	}
+	if a.Root() != b.Root() {
+		t.Errorf("Expected equal roots regardless of insertion order")
+	}
+	if a.Len() != len(keys) {
+		t.Errorf("Expected %d keys, got %d", len(keys), a.Len())
+	}
+}
+
+func TestTree_SetDelete(t *testing.T) {
+	tree := NewTree(2)
+	empty := tree.Root()
+
+	tree.Set("a", 1)
+	withA := tree.Root()
+	if withA == empty {
+		t.Fatalf("Expected adding a key to change the root")
+	}
+	tree.Set("a", 2)
+	if tree.Root() == withA {
+		t.Errorf("Expected a new version to change the root")
+	}
+	tree.Set("a", 1)
+	if tree.Root() != withA {
+		t.Errorf("Expected restoring the version to restore the root")
+	}
+	tree.Delete("a")
+	if tree.Root() != empty || tree.Len() != 0 {
+		t.Errorf("Expected deleting the only key to restore the empty root")
+	}
+
+	// Only the changed leaf and its ancestors change.
+	tree.Set("b", 1)
+	leaf := tree.leafOf("b")
+	for i := 0; i < len(tree.hashes[2]); i++ {
+		if i != leaf && tree.Hash(2, i) != 0 {
+			t.Fatalf("Expected leaf %d to be empty", i)
+		}
+	}
+	if items := tree.Leaf(leaf); len(items) != 1 || items["b"] != 1 {
+		t.Errorf("Expected leaf %d to hold b, got %v", leaf, items)
+	}
+}
+
+func TestNewTree_Depth(t *testing.T) {
+	if d := NewTree(0).Depth(); d != DefaultDepth {
+		t.Errorf("Expected the default depth, got %d", d)
+	}
+	if d := NewTree(MaxDepth + 1).Depth(); d != MaxDepth {
+		t.Errorf("Expected the depth to be capped at %d, got %d", MaxDepth, d)
+	}
+}
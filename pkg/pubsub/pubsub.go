@@ -0,0 +1,344 @@
+// Package pubsub delivers messages to the nodes subscribed to a topic, over
+// the gossip layer.
+//
+// Nodes advertise the topics they subscribe to as tags on their member
+// record, so every node learns who subscribes to what from its membership
+// view. A published message is sent directly to a few random subscribers of
+// its topic, and every subscriber forwards it, on first receipt, to a few
+// more. Nodes that do not subscribe never see the topic's messages, and
+// duplicates are dropped per topic. Delivery is best-effort: a subscriber
+// misses a message only if none of the several nodes forwarding it to them
+// gets through, which the fanout makes unlikely but not impossible.
+//
+// A PubSub is wired to a Gossiper through its message handler:
+//
+//	var ps *pubsub.PubSub
+//	g, err := gossip.NewGossiper(name, addr, peers, transport,
+//		gossip.WithMessageHandler(func(from string, payload []byte) {
+//			ps.HandleMessage(from, payload)
+//		}))
+//	ps = pubsub.New(name, g)
+//	ps.Subscribe("deploys", func(topic, publisher string, payload []byte) { ... })
+package pubsub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+const (
+	// DefaultFanout is the number of subscribers each node forwards a
+	// message to, before scaling with the number of subscribers, when no
+	// WithFanout option is given.
+	DefaultFanout = 3
+	// DefaultDedupWindow is how long message IDs are remembered for
+	// de-duplication when no WithDedupWindow option is given.
+	DefaultDedupWindow = time.Minute
+)
+
+// TagPrefix prefixes the tag a node sets for every topic it subscribes to.
+// The tag's key is the prefix followed by the topic, and its value is empty.
+const TagPrefix = "pubsub:"
+
+// magic prefixes every message of the protocol, so that HandleMessage can
+// tell them apart from the application's own messages.
+var magic = []byte("PSUB")
+
+// ErrEmptyTopic is returned when subscribing or publishing to the empty
+// topic.
+var ErrEmptyTopic = errors.New("empty topic")
+
+// Handler is called with every message published to a subscribed topic.
+// publisher is the name of the node that published it. It is called from the
+// gossiper's receive goroutine, so it should return quickly, and must not
+// retain payload after returning.
+type Handler func(topic, publisher string, payload []byte)
+
+// Cluster is the part of a Gossiper a PubSub uses: the membership view to
+// find subscribers, the local tags to advertise subscriptions, and direct
+// messages to disseminate.
+type Cluster interface {
+	Members() []gossip.Node
+	Tags() map[string]string
+	SetTags(tags map[string]string) error
+	SendTo(node string, payload []byte) error
+}
+
+// Option configures a PubSub.
+type Option func(*PubSub)
+
+// WithFanout sets the number of subscribers each node forwards a message to.
+// The fanout grows with the logarithm of the number of subscribers, like the
+// gossiper's retransmits, so that the chance of a subscriber missing a
+// message stays low as topics grow.
+func WithFanout(n int) Option {
+	return func(ps *PubSub) {
+		ps.fanout = n
+	}
+}
+
+// WithDedupWindow sets how long message IDs are remembered. A copy of a
+// message arriving after the window is delivered again, so the window must
+// exceed the time a message takes to spread.
+func WithDedupWindow(d time.Duration) Option {
+	return func(ps *PubSub) {
+		ps.dedupWindow = d
+	}
+}
+
+// message is the payload of a published message.
+type message struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"`
+	Publisher string `json:"pub"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// PubSub publishes and delivers messages by topic. It is safe for concurrent
+// use.
+type PubSub struct {
+	node        string
+	cluster     Cluster
+	fanout      int
+	dedupWindow time.Duration
+	// now returns the current time. It is replaceable for tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	// seen holds the IDs of the messages of each topic already handled,
+	// with the time they expire.
+	seen      map[string]map[string]time.Time
+	lastPurge time.Time
+}
+
+// New creates a PubSub for the local node of cluster. node is the local
+// node's name, the gossiper's node name, and is used to leave it out of its
+// own subscriber lists. Messages from peers must be passed to HandleMessage.
+func New(node string, cluster Cluster, opts ...Option) *PubSub {
+	ps := &PubSub{
+		node:        node,
+		cluster:     cluster,
+		fanout:      DefaultFanout,
+		dedupWindow: DefaultDedupWindow,
+		now:         time.Now,
+		handlers:    make(map[string]Handler),
+		seen:        make(map[string]map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(ps)
+	}
+	return ps
+}
+
+// Subscribe delivers the messages published to topic to h, replacing any
+// earlier handler of the topic, and advertises the subscription in the local
+// node's tags. Other tags are kept. It fails with gossip.ErrMetadataTooLarge
+// if the tags no longer fit the gossiper's metadata limit.
+func (ps *PubSub) Subscribe(topic string, h Handler) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	tags := ps.cluster.Tags()
+	tags[TagPrefix+topic] = ""
+	if err := ps.cluster.SetTags(tags); err != nil {
+		return fmt.Errorf("subscribe to %q: %w", topic, err)
+	}
+	ps.handlers[topic] = h
+	return nil
+}
+
+// Unsubscribe stops delivering the messages of topic and withdraws the
+// subscription from the local node's tags. Messages already on their way are
+// still forwarded, but not delivered.
+func (ps *PubSub) Unsubscribe(topic string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.handlers, topic)
+	tags := ps.cluster.Tags()
+	if _, ok := tags[TagPrefix+topic]; !ok {
+		return nil
+	}
+	delete(tags, TagPrefix+topic)
+	return ps.cluster.SetTags(tags)
+}
+
+// Topics returns the topics the local node subscribes to, sorted.
+func (ps *PubSub) Topics() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	topics := make([]string, 0, len(ps.handlers))
+	for topic := range ps.handlers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Subscribers returns the addresses of the other members that advertise a
+// subscription to topic, sorted.
+func (ps *PubSub) Subscribers(topic string) []string {
+	var addrs []string
+	for _, m := range ps.subscribers(topic) {
+		addrs = append(addrs, m.Addr.String())
+	}
+	return addrs
+}
+
+// subscribers returns the other alive or suspected members that advertise a
+// subscription to topic, sorted by address.
+func (ps *PubSub) subscribers(topic string) []gossip.Node {
+	members := ps.cluster.Members()
+	subs := members[:0]
+	for _, m := range members {
+		if _, ok := m.Tags[TagPrefix+topic]; ok && m.Name != ps.node {
+			subs = append(subs, m)
+		}
+	}
+	return subs
+}
+
+// Publish sends payload to the subscribers of topic on other nodes. The local
+// handler of the topic, if any, is not called. Publishing to a topic without
+// subscribers does nothing. It returns an error only if the message could not
+// be sent to any subscriber.
+func (ps *PubSub) Publish(topic string, payload []byte) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	msg := &message{
+		ID:        hex.EncodeToString(id[:]),
+		Topic:     topic,
+		Publisher: ps.node,
+		Payload:   payload,
+	}
+	ps.mu.Lock()
+	ps.markSeen(msg)
+	ps.mu.Unlock()
+	return ps.forward(msg, "")
+}
+
+// HandleMessage handles a message of the protocol sent by the node from, and
+// reports whether msg was one. Other messages are left to the caller, so it
+// can be called first from the gossiper's message handler.
+func (ps *PubSub) HandleMessage(from string, msg []byte) bool {
+	if !bytes.HasPrefix(msg, magic) {
+		return false
+	}
+	var m message
+	if err := json.Unmarshal(msg[len(magic):], &m); err != nil || m.ID == "" || m.Topic == "" {
+		return true
+	}
+
+	ps.mu.Lock()
+	if !ps.markSeen(&m) {
+		ps.mu.Unlock()
+		return true
+	}
+	h := ps.handlers[m.Topic]
+	ps.mu.Unlock()
+
+	if h != nil {
+		h(m.Topic, m.Publisher, m.Payload)
+	}
+	if err := ps.forward(&m, from); err != nil {
+		// Log.Printf("[%s] failed to forward message on %s: %v", ps.node, m.Topic, err)
+	}
+	return true
+}
+
+// markSeen records the message's ID and reports whether it was new. Expired
+// IDs are purged every half window. The caller must hold ps.mu.
+func (ps *PubSub) markSeen(m *message) bool {
+	now := ps.now()
+	if now.Sub(ps.lastPurge) > ps.dedupWindow/2 {
+		for topic, ids := range ps.seen {
+			for id, expires := range ids {
+				if now.After(expires) {
+					delete(ids, id)
+				}
+			}
+			if len(ids) == 0 {
+				delete(ps.seen, topic)
+			}
+		}
+		ps.lastPurge = now
+	}
+
+	ids := ps.seen[m.Topic]
+	if ids == nil {
+		ids = make(map[string]time.Time)
+		ps.seen[m.Topic] = ids
+	}
+	if _, ok := ids[m.ID]; ok {
+		return false
+	}
+	ids[m.ID] = now.Add(ps.dedupWindow)
+	return true
+}
+
+// forward sends m to up to fanout random subscribers of its topic, leaving
+// out the node it came from and its publisher, who already have it.
+func (ps *PubSub) forward(m *message, from string) error {
+	var targets []string
+	for _, sub := range ps.subscribers(m.Topic) {
+		addr := sub.Addr.String()
+		if sub.Name == m.Publisher || from != "" && (sub.Name == from || addr == from) {
+			continue
+		}
+		targets = append(targets, addr)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data = append(append([]byte(nil), magic...), data...)
+
+	n := ps.fanoutFor(len(targets))
+	mrand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	var errs []string
+	for _, addr := range targets[:n] {
+		if err := ps.cluster.SendTo(addr, data); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == n {
+		return fmt.Errorf("failed to send to any of %d subscribers: %s", n, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fanoutFor returns the number of the n candidate subscribers a message is
+// sent to: the configured fanout plus the natural logarithm of n. Each
+// subscriber then misses a message with a probability of about e^-fanout/n,
+// so the expected number of subscribers missing it does not grow with the
+// topic.
+func (ps *PubSub) fanoutFor(n int) int {
+	f := ps.fanout + int(math.Ceil(math.Log(float64(n))))
+	if f > n {
+		return n
+	}
+	return f
+}
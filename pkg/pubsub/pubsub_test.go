@@ -0,0 +1,297 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/internal/testutil"
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// network is an in-memory cluster whose members see each other's tags
+// immediately and exchange messages through a queue that may drop them.
+type network struct {
+	r      *rand.Rand
+	loss   float64
+	nodes  []*fakeNode
+	queue  []delivery
+	byAddr map[string]*fakeNode
+	counts map[string]int
+}
+
+type delivery struct {
+	from, to string
+	payload  []byte
+}
+
+// fakeNode implements Cluster for one member of a network.
+type fakeNode struct {
+	net  *network
+	name string
+	addr *net.UDPAddr
+	tags map[string]string
+	ps   *PubSub
+}
+
+func newNetwork(n int, loss float64, seed int64, opts ...Option) *network {
+	nw := &network{r: rand.New(rand.NewSource(seed)), loss: loss, byAddr: make(map[string]*fakeNode), counts: make(map[string]int)}
+	for i := 0; i < n; i++ {
+		node := &fakeNode{
+			net:  nw,
+			name: fmt.Sprintf("node-%d", i),
+			addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i},
+			tags: map[string]string{"role": "api"},
+		}
+		node.ps = New(node.name, node, opts...)
+		nw.nodes = append(nw.nodes, node)
+		nw.byAddr[node.addr.String()] = node
+	}
+	return nw
+}
+
+func (n *fakeNode) Members() []gossip.Node {
+	var members []gossip.Node
+	for _, other := range n.net.nodes {
+		members = append(members, gossip.Node{
+			Name:  other.name,
+			Addr:  other.addr,
+			State: gossip.Alive,
+			Tags:  other.Tags(),
+		})
+	}
+	return members
+}
+
+func (n *fakeNode) Tags() map[string]string {
+	tags := make(map[string]string, len(n.tags))
+	for k, v := range n.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (n *fakeNode) SetTags(tags map[string]string) error {
+	n.tags = tags
+	return nil
+}
+
+func (n *fakeNode) SendTo(node string, payload []byte) error {
+	n.net.queue = append(n.net.queue, delivery{from: n.name, to: node, payload: payload})
+	return nil
+}
+
+// pump delivers queued messages, and the messages they cause, until the
+// queue is empty.
+func (nw *network) pump() {
+	for len(nw.queue) > 0 {
+		d := nw.queue[0]
+		nw.queue = nw.queue[1:]
+		if nw.r.Float64() < nw.loss {
+			continue
+		}
+		node := nw.byAddr[d.to]
+		nw.counts[node.name]++
+		node.ps.HandleMessage(d.from, d.payload)
+	}
+}
+
+// recorder counts the messages each node delivers, by payload.
+type recorder struct {
+	mu       sync.Mutex
+	received map[string]map[string]int
+}
+
+func (r *recorder) handler(node string) Handler {
+	return func(topic, publisher string, payload []byte) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.received[node] == nil {
+			r.received[node] = make(map[string]int)
+		}
+		r.received[node][topic+"/"+string(payload)]++
+	}
+}
+
+func TestPubSub_DeliversOnlyToSubscribers(t *testing.T) {
+	// A fanout covering every subscriber makes delivery certain, so that
+	// each message can be checked to arrive exactly once.
+	nw := newNetwork(50, 0, 1, WithFanout(50))
+	rec := &recorder{received: make(map[string]map[string]int)}
+	subscribed := make(map[string]bool)
+	for i, node := range nw.nodes {
+		switch {
+		case i%5 < 2:
+			node.ps.Subscribe("deploys", rec.handler(node.name))
+			subscribed[node.name] = true
+		case i%5 == 2:
+			node.ps.Subscribe("alerts", rec.handler(node.name))
+		}
+	}
+
+	const messages = 20
+	for i := 0; i < messages; i++ {
+		publisher := nw.nodes[nw.r.Intn(len(nw.nodes))]
+		if err := publisher.ps.Publish("deploys", []byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+		nw.pump()
+
+		// Every subscriber but the publisher delivers the message once.
+		key := fmt.Sprintf("deploys/m%d", i)
+		for _, node := range nw.nodes {
+			want := 0
+			if subscribed[node.name] && node != publisher {
+				want = 1
+			}
+			if got := rec.received[node.name][key]; got != want {
+				t.Errorf("Expected %s to deliver %s %d times, got %d", node.name, key, want, got)
+			}
+		}
+	}
+	for _, node := range nw.nodes {
+		if !subscribed[node.name] && (len(rec.received[node.name]) != 0 || nw.counts[node.name] != 0) {
+			t.Errorf("Expected %s to see no messages, got %d packets", node.name, nw.counts[node.name])
+		}
+	}
+}
+
+// TestPubSub_Loss measures the share of subscribers reached when a tenth of
+// the packets are dropped.
+func TestPubSub_Loss(t *testing.T) {
+	for _, size := range []int{10, 30, 100} {
+		nw := newNetwork(size, 0.1, int64(size))
+		delivered := 0
+		for _, node := range nw.nodes {
+			node.ps.Subscribe("events", func(string, string, []byte) { delivered++ })
+		}
+		const messages = 30
+		for i := 0; i < messages; i++ {
+			nw.nodes[i%size].ps.Publish("events", []byte("x"))
+			nw.pump()
+		}
+		ratio := float64(delivered) / float64(messages*(size-1))
+		t.Logf("%3d subscribers: %.2f%% delivered, %.1f packets per subscriber and message",
+			size, ratio*100, float64(sum(nw.counts))/float64(messages*(size-1)))
+		if ratio < 0.98 {
+			t.Errorf("Expected at least 98%% delivered with %d subscribers, got %.2f%%", size, ratio*100)
+		}
+	}
+}
+
+func sum(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+func TestPubSub_Dedup(t *testing.T) {
+	nw := newNetwork(2, 0, 1)
+	a, b := nw.nodes[0], nw.nodes[1]
+	now := time.Unix(1700000000, 0)
+	b.ps.now = func() time.Time { return now }
+	delivered := 0
+	b.ps.Subscribe("t", func(string, string, []byte) { delivered++ })
+
+	a.ps.Publish("t", []byte("x"))
+	msg := nw.queue[0].payload
+	for i := 0; i < 3; i++ {
+		b.ps.HandleMessage(a.name, msg)
+	}
+	if delivered != 1 {
+		t.Errorf("Expected one delivery of a duplicated message, got %d", delivered)
+	}
+
+	// IDs are forgotten after the window.
+	now = now.Add(2 * DefaultDedupWindow)
+	b.ps.HandleMessage(a.name, msg)
+	if delivered != 2 {
+		t.Errorf("Expected a delivery once the ID expired, got %d deliveries", delivered)
+	}
+}
+
+func TestPubSub_Subscriptions(t *testing.T) {
+	nw := newNetwork(2, 0, 1)
+	a, b := nw.nodes[0], nw.nodes[1]
+	if err := a.ps.Subscribe("", nil); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("Expected ErrEmptyTopic, got %v", err)
+	}
+	a.ps.Subscribe("x", func(string, string, []byte) {})
+	a.ps.Subscribe("y", func(string, string, []byte) {})
+	if got := b.ps.Subscribers("x"); len(got) != 1 || got[0] != a.addr.String() {
+		t.Errorf("Expected %s to subscribe to x, got %v", a.addr, got)
+	}
+	if got := a.ps.Subscribers("x"); len(got) != 0 {
+		t.Errorf("Expected the local node to be left out, got %v", got)
+	}
+
+	a.ps.Unsubscribe("x")
+	if got := b.ps.Subscribers("x"); len(got) != 0 {
+		t.Errorf("Expected no subscribers after unsubscribing, got %v", got)
+	}
+	if a.tags["role"] != "api" {
+		t.Errorf("Expected other tags to be kept, got %v", a.tags)
+	}
+	if got := a.ps.Topics(); len(got) != 1 || got[0] != "y" {
+		t.Errorf("Expected [y], got %v", got)
+	}
+	if a.ps.HandleMessage(b.name, []byte("hello")) {
+		t.Errorf("Expected other messages to be left to the caller")
+	}
+	if err := a.ps.Publish("nobody", []byte("x")); err != nil || len(nw.queue) != 0 {
+		t.Errorf("Expected publishing without subscribers to do nothing, got %v", err)
+	}
+}
+
+func TestFanoutFor(t *testing.T) {
+	ps := New("a", nil)
+	for _, tc := range []struct{ n, want int }{{1, 1}, {3, 3}, {10, 6}, {100, 8}, {1000, 10}} {
+		if got := ps.fanoutFor(tc.n); got != tc.want {
+			t.Errorf("fanoutFor(%d): expected %d, got %d", tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestPubSub_Gossip(t *testing.T) {
+	addrs := []string{"127.0.0.1:7103", "127.0.0.1:7104", "127.0.0.1:7105"}
+	rec := &recorder{received: make(map[string]map[string]int)}
+	pss := make([]*PubSub, len(addrs))
+	gossipers := testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithMessageHandler(func(from string, payload []byte) {
+				pss[i].HandleMessage(from, payload)
+			}),
+			gossip.WithGossip(20*time.Millisecond, 3),
+		}
+	})
+	for i, g := range gossipers {
+		pss[i] = New(addrs[i], g)
+	}
+	testutil.Start(gossipers)
+
+	// The last two nodes subscribe, and the first learns of it through
+	// their tags.
+	for _, i := range []int{1, 2} {
+		if err := pss[i].Subscribe("deploys", rec.handler(addrs[i])); err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+	}
+	testutil.WaitFor(t, 5*time.Second, "the subscriptions", func() bool {
+		return len(pss[0].Subscribers("deploys")) == 2
+	})
+
+	if err := pss[0].Publish("deploys", []byte("v42")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	testutil.WaitFor(t, 5*time.Second, "the deliveries", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return rec.received[addrs[1]]["deploys/v42"] == 1 && rec.received[addrs[2]]["deploys/v42"] == 1
+	})
+}
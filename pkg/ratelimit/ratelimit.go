@@ -0,0 +1,342 @@
+// Package ratelimit enforces approximate cluster-wide rate limits per tenant
+// without a central store.
+//
+// Every node admits requests from local token buckets, and periodically
+// gossips each tenant's local demand to the other nodes. A node's bucket
+// refills at the share of the tenant's global rate that matches its share of
+// the tenant's cluster-wide demand, so the fleet as a whole admits about the
+// global rate however the load is spread. The estimate of the other nodes'
+// demand is as stale as the report interval plus the time gossip takes to
+// deliver a report, and the fleet overshoots or undershoots while demand
+// shifts faster than that.
+//
+// A Limiter is wired to a Gossiper through its broadcasts:
+//
+//	limiter := ratelimit.New(name, ratelimit.Limit{Rate: 100, Burst: 20})
+//	g, err := gossip.NewGossiper(name, addr, peers, transport,
+//		gossip.WithBroadcastHandler(limiter.HandleBroadcast))
+//	go limiter.Run(ctx, g)
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReportInterval is how often local demand is gossiped when no
+	// WithReportInterval option is given.
+	DefaultReportInterval = time.Second
+	// DefaultMaxReportSize is the maximum size of a single demand report in
+	// bytes when no WithMaxReportSize option is given. It keeps reports
+	// within the gossiper's default broadcast size limit.
+	DefaultMaxReportSize = 448
+)
+
+// broadcastName is the name of the user broadcasts carrying demand reports.
+const broadcastName = "ratelimit"
+
+// demandSmoothing is the weight of the latest interval in the local demand
+// estimate.
+const demandSmoothing = 0.5
+
+// Limit is the global rate limit of a tenant.
+type Limit struct {
+	// Rate is the number of requests per second admitted across the
+	// cluster.
+	Rate float64
+	// Burst is the number of requests the cluster admits at once after a
+	// quiet period.
+	Burst int
+}
+
+// Broadcaster sends a payload to every other node, such as
+// gossip.Gossiper.BroadcastKey. A payload sent with the same key as one still
+// on its way replaces it, so a node's pending reports never pile up behind
+// gossip.
+type Broadcaster interface {
+	BroadcastKey(name, key string, payload []byte) error
+}
+
+// Option configures a Limiter.
+type Option func(*Limiter)
+
+// WithTenantLimit sets the limit of one tenant, overriding the default limit.
+func WithTenantLimit(tenant string, limit Limit) Option {
+	return func(l *Limiter) {
+		l.limits[tenant] = limit
+	}
+}
+
+// WithReportInterval sets how often local demand is gossiped. Shorter
+// intervals track shifting load more closely at the cost of more broadcasts.
+// Reports older than three intervals are discarded.
+func WithReportInterval(d time.Duration) Option {
+	return func(l *Limiter) {
+		l.interval = d
+	}
+}
+
+// WithMaxReportSize sets the maximum size of a single demand report in bytes.
+// Demand for more tenants is split across several reports. It should not
+// exceed the gossiper's broadcast size limit.
+func WithMaxReportSize(n int) Option {
+	return func(l *Limiter) {
+		l.maxReportSize = n
+	}
+}
+
+// report is the payload of a demand report: the requests per second each
+// tenant received on the sending node over the last interval.
+type report struct {
+	Node   string             `json:"node"`
+	Demand map[string]float64 `json:"demand"`
+}
+
+// remoteDemand is the latest demand another node reported for a tenant.
+type remoteDemand struct {
+	rate     float64
+	received time.Time
+}
+
+// bucket is the state of one tenant on the local node.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// requests counts the requests received in the current interval, and
+	// demand is the smoothed local rate of requests.
+	requests float64
+	demand   float64
+	remote   map[string]remoteDemand
+}
+
+// Limiter admits requests against per-tenant global rate limits. It is safe
+// for concurrent use.
+type Limiter struct {
+	node          string
+	limit         Limit
+	limits        map[string]Limit
+	interval      time.Duration
+	maxReportSize int
+	// now returns the current time. It is replaceable for tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// New creates a limiter that applies limit to every tenant without a limit of
+// its own. node names the local node and must be unique in the cluster; the
+// gossiper's node name is a natural choice.
+func New(node string, limit Limit, opts ...Option) *Limiter {
+	l := &Limiter{
+		node:          node,
+		limit:         limit,
+		limits:        make(map[string]Limit),
+		interval:      DefaultReportInterval,
+		maxReportSize: DefaultMaxReportSize,
+		now:           time.Now,
+		buckets:       make(map[string]*bucket),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Allow reports whether a request of tenant is admitted now.
+func (l *Limiter) Allow(tenant string) bool {
+	return l.AllowN(tenant, 1)
+}
+
+// AllowN reports whether n requests of tenant are admitted now. Either all of
+// them are admitted, consuming n tokens, or none is. Every call counts
+// towards the local demand, admitted or not.
+func (l *Limiter) AllowN(tenant string, n int) bool {
+	now := l.now()
+	limit := l.limitOf(tenant)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[tenant]
+	if b == nil {
+		b = &bucket{remote: make(map[string]remoteDemand)}
+		l.buckets[tenant] = b
+	}
+	b.requests += float64(n)
+
+	share := l.share(b, now)
+	capacity := math.Max(float64(limit.Burst)*share, 1)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate * share
+	}
+	b.tokens = math.Min(b.tokens, capacity)
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Share returns the fraction of tenant's global limit currently allotted to
+// the local node.
+func (l *Limiter) Share(tenant string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[tenant]
+	if b == nil {
+		return 1
+	}
+	return l.share(b, l.now())
+}
+
+// share returns the local node's share of a tenant's limit: its demand over
+// the fresh demand of every node. The requests of the current interval count
+// towards the local demand as soon as they arrive, so that a node whose load
+// just started is not starved until its next report. The caller must hold
+// l.mu.
+func (l *Limiter) share(b *bucket, now time.Time) float64 {
+	local := math.Max(b.demand, b.requests/l.interval.Seconds())
+	total := local
+	for node, r := range b.remote {
+		if now.Sub(r.received) > 3*l.interval {
+			delete(b.remote, node)
+			continue
+		}
+		total += r.rate
+	}
+	if total == 0 {
+		return 1
+	}
+	return local / total
+}
+
+func (l *Limiter) limitOf(tenant string) Limit {
+	if limit, ok := l.limits[tenant]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+// Run gossips the local demand through b every report interval until ctx is
+// done.
+func (l *Limiter) Run(ctx context.Context, b Broadcaster) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.report(b)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// report closes the current interval, folds its requests into the demand
+// estimates and broadcasts them. Tenants without demand anywhere are
+// forgotten after one last report of zero.
+func (l *Limiter) report(b Broadcaster) {
+	now := l.now()
+	l.mu.Lock()
+	demand := make(map[string]float64, len(l.buckets))
+	for tenant, bk := range l.buckets {
+		rate := bk.requests / l.interval.Seconds()
+		bk.demand = demandSmoothing*rate + (1-demandSmoothing)*bk.demand
+		bk.requests = 0
+		if bk.demand < 0.01 {
+			bk.demand = 0
+		}
+		for node, r := range bk.remote {
+			if now.Sub(r.received) > 3*l.interval {
+				delete(bk.remote, node)
+			}
+		}
+		if bk.demand == 0 && rate == 0 && len(bk.remote) == 0 {
+			delete(l.buckets, tenant)
+		}
+		demand[tenant] = bk.demand
+	}
+	l.mu.Unlock()
+
+	for i, payload := range l.encodeReports(demand) {
+		key := fmt.Sprintf("%s:%s:%d", broadcastName, l.node, i)
+		if err := b.BroadcastKey(broadcastName, key, payload); err != nil {
+			// Log.Printf("[%s] failed to broadcast demand report: %v", l.node, err)
+		}
+	}
+}
+
+// encodeReports splits demand into reports of at most the configured size.
+// Rates are rounded to thousandths to keep reports short.
+func (l *Limiter) encodeReports(demand map[string]float64) [][]byte {
+	tenants := make([]string, 0, len(demand))
+	for tenant := range demand {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var payloads [][]byte
+	r := report{Node: l.node, Demand: make(map[string]float64)}
+	flush := func() {
+		if len(r.Demand) == 0 {
+			return
+		}
+		if data, err := json.Marshal(&r); err == nil {
+			payloads = append(payloads, data)
+		}
+		r.Demand = make(map[string]float64)
+	}
+	for _, tenant := range tenants {
+		rate := math.Round(demand[tenant]*1000) / 1000
+		r.Demand[tenant] = rate
+		data, err := json.Marshal(&r)
+		if err != nil {
+			delete(r.Demand, tenant)
+			continue
+		}
+		if len(data) > l.maxReportSize && len(r.Demand) > 1 {
+			delete(r.Demand, tenant)
+			flush()
+			r.Demand[tenant] = rate
+		}
+	}
+	flush()
+	return payloads
+}
+
+// HandleBroadcast merges a demand report gossiped by another node. It ignores
+// broadcasts of other names, so it can be installed as the gossiper's
+// broadcast handler or called from one.
+func (l *Limiter) HandleBroadcast(name string, payload []byte) {
+	if name != broadcastName {
+		return
+	}
+	var r report
+	if err := json.Unmarshal(payload, &r); err != nil || r.Node == "" || r.Node == l.node {
+		return
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for tenant, rate := range r.Demand {
+		if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+			continue
+		}
+		b := l.buckets[tenant]
+		if b == nil {
+			b = &bucket{remote: make(map[string]remoteDemand)}
+			l.buckets[tenant] = b
+		}
+		b.remote[r.Node] = remoteDemand{rate: rate, received: now}
+	}
+}
@@ -0,0 +1,263 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/go-gossip/internal/testutil"
+	"github.com/princetheprogrammer/go-gossip/pkg/gossip"
+)
+
+// simBroadcaster delivers reports to the other limiters of a simulation after
+// a random gossip delay.
+type simBroadcaster struct {
+	sim  *simulation
+	from int
+}
+
+func (b *simBroadcaster) BroadcastKey(name, key string, payload []byte) error {
+	for to := range b.sim.limiters {
+		if to == b.from {
+			continue
+		}
+		delay := time.Duration(1+b.sim.r.Intn(3)) * b.sim.gossipInterval
+		b.sim.inflight = append(b.sim.inflight, simMessage{
+			at:      b.sim.now.Add(delay),
+			to:      to,
+			name:    name,
+			payload: append([]byte(nil), payload...),
+		})
+	}
+	return nil
+}
+
+type simMessage struct {
+	at      time.Time
+	to      int
+	name    string
+	payload []byte
+}
+
+// simulation runs a fleet of limiters on a simulated clock.
+type simulation struct {
+	r              *rand.Rand
+	now            time.Time
+	gossipInterval time.Duration
+	limiters       []*Limiter
+	inflight       []simMessage
+}
+
+// run offers demand[i] requests per second to node i for d, and returns the
+// number of requests the fleet admitted after warmup.
+func (s *simulation) run(demand []float64, d, warmup time.Duration) int {
+	const step = 10 * time.Millisecond
+	reportEvery := int(s.limiters[0].interval / step)
+	start := s.now
+	carry := make([]float64, len(demand))
+	admitted := 0
+
+	for i := 0; s.now.Sub(start) < d; i++ {
+		s.now = s.now.Add(step)
+
+		// Deliver the reports that are due.
+		sort.Slice(s.inflight, func(i, j int) bool { return s.inflight[i].at.Before(s.inflight[j].at) })
+		for len(s.inflight) > 0 && !s.inflight[0].at.After(s.now) {
+			m := s.inflight[0]
+			s.inflight = s.inflight[1:]
+			s.limiters[m.to].HandleBroadcast(m.name, m.payload)
+		}
+
+		for n, l := range s.limiters {
+			carry[n] += demand[n] * step.Seconds()
+			for ; carry[n] >= 1; carry[n]-- {
+				if l.Allow("tenant") && s.now.Sub(start) >= warmup {
+					admitted++
+				}
+			}
+			// Nodes report out of phase with each other.
+			if (i+n)%reportEvery == 0 {
+				l.report(&simBroadcaster{sim: s, from: n})
+			}
+		}
+	}
+	return admitted
+}
+
+func newSimulation(nodes int, limit Limit, seed int64) *simulation {
+	s := &simulation{
+		r:              rand.New(rand.NewSource(seed)),
+		now:            time.Unix(1700000000, 0),
+		gossipInterval: 200 * time.Millisecond,
+	}
+	for i := 0; i < nodes; i++ {
+		l := New(fmt.Sprintf("node-%d", i), limit, WithReportInterval(500*time.Millisecond))
+		l.now = func() time.Time { return s.now }
+		s.limiters = append(s.limiters, l)
+	}
+	return s
+}
+
+// TestLimiter_Simulation measures how close the fleet stays to the global
+// limit for several cluster sizes and load distributions. Every node learns
+// the others' demand half a second to a second late: up to one report
+// interval, plus one to three gossip rounds.
+func TestLimiter_Simulation(t *testing.T) {
+	const rate = 1000.0
+	limit := Limit{Rate: rate, Burst: 100}
+	const d, warmup = 30 * time.Second, 5 * time.Second
+	measured := (d - warmup).Seconds()
+
+	scenarios := []struct {
+		name string
+		// demand returns the requests per second offered to each node.
+		demand func(nodes int) []float64
+		// want is the expected admitted rate as a fraction of the limit.
+		want float64
+	}{
+		{"uniform 3x", func(n int) []float64 { return spread(n, 3*rate, 0) }, 1},
+		{"one hot node 3x", func(n int) []float64 { return spread(n, 3*rate, 0.5) }, 1},
+		{"under limit", func(n int) []float64 { return spread(n, 0.5*rate, 0) }, 0.5},
+	}
+	for _, sc := range scenarios {
+		for _, nodes := range []int{1, 3, 10, 30} {
+			s := newSimulation(nodes, limit, int64(nodes))
+			admitted := s.run(sc.demand(nodes), d, warmup)
+			got := float64(admitted) / measured / rate
+			t.Logf("%-16s %2d nodes: %6.0f req/s admitted, %5.1f%% of the limit", sc.name, nodes, float64(admitted)/measured, got*100)
+			if got < sc.want*0.9 || got > sc.want*1.1 {
+				t.Errorf("%s with %d nodes: admitted %.2f of the limit, want %.2f ± 10%%", sc.name, nodes, got, sc.want)
+			}
+		}
+	}
+}
+
+// spread splits total demand over n nodes: the first node gets the fraction
+// hot of it, and the rest is split evenly among all of them.
+func spread(n int, total, hot float64) []float64 {
+	demand := make([]float64, n)
+	if n == 1 {
+		demand[0] = total
+		return demand
+	}
+	demand[0] = total * hot
+	for i := range demand {
+		demand[i] += total * (1 - hot) / float64(n)
+	}
+	return demand
+}
+
+func TestLimiter_Local(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New("a", Limit{Rate: 10, Burst: 5}, WithTenantLimit("vip", Limit{Rate: 100, Burst: 50}))
+	l.now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if l.Allow("t") {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected the burst of 5 to be admitted, got %d", allowed)
+	}
+	now = now.Add(time.Second)
+	if !l.AllowN("t", 5) || l.AllowN("t", 6) {
+		t.Errorf("Expected the bucket to refill to its burst after a second")
+	}
+	if !l.AllowN("vip", 50) {
+		t.Errorf("Expected the tenant limit to apply")
+	}
+}
+
+func TestLimiter_Share(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New("a", Limit{Rate: 100, Burst: 10}, WithReportInterval(time.Second))
+	l.now = func() time.Time { return now }
+
+	l.AllowN("t", 30)
+	l.HandleBroadcast("ratelimit", []byte(`{"node":"b","demand":{"t":90}}`))
+	l.HandleBroadcast("other", []byte(`{"node":"c","demand":{"t":1000}}`))
+	if got := l.Share("t"); got < 0.249 || got > 0.251 {
+		t.Errorf("Expected a quarter of the limit, got %v", got)
+	}
+
+	// Reports expire after three intervals.
+	now = now.Add(4 * time.Second)
+	if got := l.Share("t"); got != 1 {
+		t.Errorf("Expected the whole limit once the report expired, got %v", got)
+	}
+}
+
+func TestLimiter_ReportSize(t *testing.T) {
+	l := New("a", Limit{Rate: 10}, WithMaxReportSize(100))
+	demand := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		demand[fmt.Sprintf("tenant-%02d", i)] = 1.0 / 3
+	}
+	payloads := l.encodeReports(demand)
+	if len(payloads) < 2 {
+		t.Fatalf("Expected the report to be split, got %d payloads", len(payloads))
+	}
+	tenants := 0
+	for _, p := range payloads {
+		if len(p) > 100 {
+			t.Errorf("Expected reports of at most 100 bytes, got %d", len(p))
+		}
+		other := New("b", Limit{Rate: 10})
+		other.HandleBroadcast("ratelimit", p)
+		tenants += len(other.buckets)
+	}
+	if tenants != 20 {
+		t.Errorf("Expected every tenant to be reported once, got %d", tenants)
+	}
+}
+
+// TestLimiter_ReportQueue checks that reports that cannot be gossiped yet
+// replace each other rather than piling up in the gossiper's queue.
+func TestLimiter_ReportQueue(t *testing.T) {
+	addr := "127.0.0.1:7117"
+	g := testutil.Cluster(t, []string{addr}, nil)[0]
+
+	l := New(addr, Limit{Rate: 100, Burst: 10})
+	for i := 0; i < 100; i++ {
+		l.Allow("tenant")
+		l.report(g)
+	}
+	if n := g.Stats().QueuedBroadcasts; n != 1 {
+		t.Errorf("Expected one queued report, got %d", n)
+	}
+}
+
+func TestLimiter_Gossip(t *testing.T) {
+	addrs := []string{"127.0.0.1:7101", "127.0.0.1:7102"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var limiters []*Limiter
+	for _, addr := range addrs {
+		limiters = append(limiters, New(addr, Limit{Rate: 100, Burst: 10}, WithReportInterval(50*time.Millisecond)))
+	}
+	gossipers := testutil.Cluster(t, addrs, func(i int) []gossip.Option {
+		return []gossip.Option{
+			gossip.WithBroadcastHandler(limiters[i].HandleBroadcast),
+			gossip.WithGossip(20*time.Millisecond, 3),
+		}
+	})
+	for i, g := range gossipers {
+		go limiters[i].Run(ctx, g)
+	}
+	testutil.Start(gossipers)
+
+	// With equal load on both nodes, each settles at about half the limit.
+	testutil.WaitFor(t, 5*time.Second, "the demand reports", func() bool {
+		for _, l := range limiters {
+			l.Allow("tenant")
+		}
+		s0, s1 := limiters[0].Share("tenant"), limiters[1].Share("tenant")
+		return s0 > 0.3 && s0 < 0.7 && s1 > 0.3 && s1 < 0.7
+	})
+}